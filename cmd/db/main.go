@@ -4,9 +4,18 @@ import (
 	"build-your-own-database/pkg/db"
 	"fmt"
 	"log"
+	"os"
 )
 
 func main() {
+	// "db compact <path>" compacts an existing database file
+	if len(os.Args) > 1 && os.Args[1] == "compact" {
+		if len(os.Args) != 3 {
+			log.Fatalf("Usage: %s compact <path>", os.Args[0])
+		}
+		os.Exit(compact(os.Args[2]))
+	}
+
 	// Initialize the database
 	database, err := db.NewDB("data/db")
 	if err != nil {
@@ -32,15 +41,20 @@ func main() {
 
 	// Traverse the database and print all key-value pairs
 	fmt.Println("\nDatabase Contents:")
-	database.Traverse(func(key, value []byte) {
+	err = database.Traverse(func(key, value []byte) {
 		fmt.Printf("%s -> %s\n", string(key), string(value))
 	})
+	if err != nil {
+		log.Printf("Failed to traverse database: %v", err)
+	}
 
 	// Test searching for keys
 	searchKeys := []string{"apple", "banana", "mango"}
 	fmt.Println("\nSearch Results:")
 	for _, key := range searchKeys {
-		if value, found := database.Get([]byte(key)); found {
+		if value, found, err := database.Get([]byte(key)); err != nil {
+			log.Printf("Failed to search %s: %v", key, err)
+		} else if found {
 			fmt.Printf("Found: %s -> %s\n", key, string(value))
 		} else {
 			fmt.Printf("Not Found: %s\n", key)
@@ -54,9 +68,37 @@ func main() {
 	}
 
 	// Verify deletion
-	if value, found := database.Get([]byte("apple")); found {
+	if value, found, err := database.Get([]byte("apple")); err != nil {
+		log.Printf("Failed to search apple: %v", err)
+	} else if found {
 		fmt.Printf("Apple still exists: %s\n", string(value))
 	} else {
 		fmt.Println("Apple successfully deleted")
 	}
 }
+
+// compact rewrites the database at path into a file holding only live pages
+// Returns the exit code of the subcommand
+func compact(path string) int {
+	// A missing database is an error, not an empty one to compact
+	database, err := db.Open(path, &db.Options{})
+	if err != nil {
+		log.Printf("Failed to open database: %v", err)
+		return 1
+	}
+
+	// Close checkpoints the log and releases the lock, also after a failure
+	code := 0
+	reclaimed, err := database.Compact()
+	if err != nil {
+		log.Printf("Failed to compact database: %v", err)
+		code = 1
+	} else {
+		fmt.Printf("Compacted %s, reclaimed %d bytes\n", path, reclaimed)
+	}
+	if err := database.Close(); err != nil {
+		log.Printf("Failed to close database: %v", err)
+		code = 1
+	}
+	return code
+}
@@ -0,0 +1,257 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"iter"
+)
+
+/*
+Bulk Loading:
+
+BulkLoad builds a tree bottom-up from pairs in strictly increasing key order
+instead of inserting them one by one. Pairs are appended to the current leaf
+until it reaches the fill factor, then the leaf is written and its first key
+and page are appended to the current node of the level above, which is filled
+and written the same way. Every page is written exactly once, in the order
+the nodes are completed, and no node is ever split or rewritten.
+
+Each level keeps its last completed node in memory until the next one is
+complete, so the last two nodes of a level can be rebalanced at the end
+instead of leaving a nearly empty node behind.
+*/
+
+// DefaultFillFactor is the share of a page BulkLoad fills by default,
+// leaving room for later inserts before nodes split
+const DefaultFillFactor = 0.9
+
+var (
+	// ErrUnsorted is returned by BulkLoad for keys that are not strictly increasing
+	ErrUnsorted = errors.New("btree: bulk load input is not strictly sorted")
+
+	// ErrTreeNotEmpty is returned by BulkLoad for a tree that already holds keys
+	ErrTreeNotEmpty = errors.New("btree: bulk load into a tree that is not empty")
+)
+
+// bulkEntry is a key with its value or child page, waiting to be put into a node
+type bulkEntry struct {
+	ptr uint64 // Child page, or first overflow page of the value in a leaf
+	key []byte
+	val []byte
+}
+
+// size returns the number of bytes the entry takes up in a node
+func (e bulkEntry) size() int {
+	return ptrSize + offsetSize + kvLenSize + len(e.key) + len(e.val)
+}
+
+// bulkLevel holds the nodes of one tree level that are not written yet
+type bulkLevel struct {
+	prev    []bulkEntry // Last completed node, written once the next one is complete
+	cur     []bulkEntry // Node being filled
+	size    int         // Size of cur in bytes
+	written int         // Number of nodes written on this level
+}
+
+// bulkLoader builds a tree bottom-up, see Bulk Loading
+type bulkLoader struct {
+	tree   *BTree
+	limit  int          // Size in bytes a node is filled up to
+	levels []*bulkLevel // Levels from the leaves up
+}
+
+// BulkLoad builds the tree from pairs in strictly increasing key order
+// Parameters:
+//   - pairs: The key-value pairs, keys and values may be reused by the iterator
+//   - fill: Share of each page to fill, in (0, 1], other values select DefaultFillFactor
+//
+// Returns:
+//   - int: The number of pairs loaded
+//   - error: ErrTreeNotEmpty if the tree holds keys, ErrUnsorted if a key is
+//     not greater than the one before, an error from Config.Validate for a
+//     pair the tree cannot store, or any error writing pages. On error the
+//     tree is left unchanged.
+func (tree *BTree) BulkLoad(pairs iter.Seq2[[]byte, []byte], fill float64) (int, error) {
+	if fill <= 0 || fill > 1 {
+		fill = DefaultFillFactor
+	}
+	b := &bulkLoader{tree: tree, limit: int(fill * float64(tree.Config.PageSize))}
+
+	var count int
+	err := tree.update(func() error {
+		if err := b.release(); err != nil {
+			return err
+		}
+
+		var last []byte
+		for key, val := range pairs {
+			if err := tree.Config.Validate(key, val); err != nil {
+				return fmt.Errorf("pair %d: %w", count, err)
+			}
+			if count > 0 && bytes.Compare(key, last) <= 0 {
+				return fmt.Errorf("%w: key %d is not greater than the one before", ErrUnsorted, count)
+			}
+			if count == 0 {
+				// the sentinel makes the tree cover the whole key space
+				if err := b.add(0, bulkEntry{}); err != nil {
+					return err
+				}
+			}
+			if err := b.addPair(key, val); err != nil {
+				return err
+			}
+			last = append(last[:0], key...)
+			count++
+		}
+		return b.finish()
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// release frees the root of a tree that holds no keys besides the sentinel
+func (b *bulkLoader) release() error {
+	tree := b.tree
+	if tree.Root == 0 {
+		return nil
+	}
+	root, err := tree.getNode(tree.Root)
+	if err != nil {
+		return err
+	}
+	if root.btype() != NodeTypeLeaf || root.nkeys() != 1 {
+		return ErrTreeNotEmpty
+	}
+	tree.delNode(tree.Root)
+	tree.Root = 0
+	return nil
+}
+
+// addPair appends a key-value pair to the current leaf
+// Long values are moved to overflow pages like Insert does
+func (b *bulkLoader) addPair(key, val []byte) error {
+	var head uint64
+	if len(val) > int(b.tree.Config.InlineValSize) {
+		var err error
+		if head, val, err = writeOverflow(b.tree, val); err != nil {
+			return err
+		}
+	}
+	return b.add(0, bulkEntry{ptr: head, key: bytes.Clone(key), val: bytes.Clone(val)})
+}
+
+// add appends an entry to the node being filled on a level, completing the
+// node first if the entry would take it past the fill factor
+// A node gets at least two entries whenever they fit into a page, otherwise
+// entries larger than the fill factor allows would make every level as wide
+// as the one below and the tree as deep as it has keys.
+func (b *bulkLoader) add(depth int, e bulkEntry) error {
+	if depth == len(b.levels) {
+		b.levels = append(b.levels, &bulkLevel{size: headerSize})
+	}
+	lv := b.levels[depth]
+
+	size := lv.size + e.size()
+	if len(lv.cur) > 0 && (len(lv.cur) >= 2 && size > b.limit || size > int(b.tree.Config.PageSize)) {
+		if lv.prev != nil {
+			if err := b.write(depth, lv.prev); err != nil {
+				return err
+			}
+		}
+		lv.prev, lv.cur, lv.size = lv.cur, nil, headerSize
+	}
+	lv.cur = append(lv.cur, e)
+	lv.size += e.size()
+	return nil
+}
+
+// finish writes the remaining nodes of every level and sets the root
+func (b *bulkLoader) finish() error {
+	// writing the nodes of a level may add the level above
+	for depth := 0; depth < len(b.levels); depth++ {
+		lv := b.levels[depth]
+		if lv.written == 0 && lv.prev == nil {
+			// a single node is the root, an internal one needs two kids
+			if depth > 0 && len(lv.cur) == 1 {
+				b.tree.Root = lv.cur[0].ptr
+				return nil
+			}
+			ptr, err := b.tree.newNode(b.node(depth, lv.cur))
+			if err != nil {
+				return err
+			}
+			b.tree.Root = ptr
+			return nil
+		}
+
+		for _, entries := range b.rebalance(lv.prev, lv.cur) {
+			if err := b.write(depth, entries); err != nil {
+				return err
+			}
+		}
+	}
+	return nil // no pairs
+}
+
+// rebalance moves entries from the last full node of a level to a small
+// last node, or merges both if they fit into a page
+func (b *bulkLoader) rebalance(prev, cur []bulkEntry) [][]bulkEntry {
+	if prev == nil {
+		return [][]bulkEntry{cur}
+	}
+	pageSize := int(b.tree.Config.PageSize)
+	total := headerSize
+	for _, e := range prev {
+		total += e.size()
+	}
+	small := headerSize
+	for _, e := range cur {
+		small += e.size()
+	}
+	if small > pageSize/4 && len(cur) >= 2 {
+		return [][]bulkEntry{prev, cur}
+	}
+	all := append(prev[:len(prev):len(prev)], cur...)
+	if total+small-headerSize <= pageSize {
+		return [][]bulkEntry{all}
+	}
+
+	// split the entries of both nodes in half by size, unless large
+	// entries leave a half that does not fit into a page
+	half, size := 1, headerSize+all[0].size()
+	for half < len(all)-1 && size+all[half].size() <= (total+small)/2 {
+		size += all[half].size()
+		half++
+	}
+	if total+small-size > pageSize {
+		return [][]bulkEntry{prev, cur}
+	}
+	return [][]bulkEntry{all[:half], all[half:]}
+}
+
+// write stores a completed node and adds it to the level above
+func (b *bulkLoader) write(depth int, entries []bulkEntry) error {
+	ptr, err := b.tree.newNode(b.node(depth, entries))
+	if err != nil {
+		return err
+	}
+	b.levels[depth].written++
+	return b.add(depth+1, bulkEntry{ptr: ptr, key: entries[0].key})
+}
+
+// node lays out the entries of a level as a node
+func (b *bulkLoader) node(depth int, entries []bulkEntry) BNode {
+	btype := NodeTypeInternal
+	if depth == 0 {
+		btype = NodeTypeLeaf
+	}
+	node := BNode(make([]byte, b.tree.Config.PageSize))
+	node.setHeader(btype, uint16(len(entries)))
+	for i, e := range entries {
+		nodeAppendKV(node, uint16(i), e.ptr, e.key, e.val)
+	}
+	return node
+}
@@ -0,0 +1,305 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"iter"
+	"testing"
+)
+
+// bulkPairs yields n sorted pairs, reusing the same buffers like a reader would
+func bulkPairs(n int, val func(i int) []byte) iter.Seq2[[]byte, []byte] {
+	return func(yield func(key, val []byte) bool) {
+		key := make([]byte, 0, 16)
+		for i := 0; i < n; i++ {
+			key = fmt.Appendf(key[:0], "key%08d", i)
+			if !yield(key, val(i)) {
+				return
+			}
+		}
+	}
+}
+
+// checkTree verifies the layout of a tree: every node is valid, every kid
+// starts with the key its parent holds for it, and all leaves are at the
+// same depth. Returns the number of leaves.
+func checkTree(t *testing.T, tree *BTree) int {
+	t.Helper()
+	leafDepth, leaves := -1, 0
+	var walk func(ptr uint64, depth int, first []byte)
+	walk = func(ptr uint64, depth int, first []byte) {
+		node, err := tree.getNode(ptr)
+		if err != nil {
+			t.Fatalf("Failed to read node %d: %v", ptr, err)
+		}
+		if !bytes.Equal(node.getKey(0), first) {
+			t.Fatalf("Node %d starts with %q, parent holds %q", ptr, node.getKey(0), first)
+		}
+		for i := uint16(1); i < node.nkeys(); i++ {
+			if bytes.Compare(node.getKey(i-1), node.getKey(i)) >= 0 {
+				t.Fatalf("Keys of node %d are not sorted", ptr)
+			}
+		}
+		if node.btype() == NodeTypeLeaf {
+			if leafDepth != -1 && leafDepth != depth {
+				t.Fatalf("Leaves at depth %d and %d", leafDepth, depth)
+			}
+			leafDepth = depth
+			leaves++
+			return
+		}
+		if ptr != tree.Root && node.nkeys() < 2 {
+			t.Errorf("Internal node %d has a single kid", ptr)
+		}
+		for i := uint16(0); i < node.nkeys(); i++ {
+			walk(node.getPtr(i), depth+1, node.getKey(i))
+		}
+	}
+	if tree.Root != 0 {
+		walk(tree.Root, 0, nil)
+	}
+	return leaves
+}
+
+// TestBulkLoad verifies that BulkLoad builds a valid tree holding exactly
+// the input pairs for various sizes and fill factors, and that the tree can
+// be modified afterwards
+func TestBulkLoad(t *testing.T) {
+	value := func(i int) []byte { return []byte(fmt.Sprintf("value%d", i)) }
+
+	for _, n := range []int{0, 1, 2, 100, 1000, 20000} {
+		for _, fill := range []float64{0.5, 0, 1} {
+			t.Run(fmt.Sprintf("n=%d/fill=%v", n, fill), func(t *testing.T) {
+				tree := NewTestTree()
+				count, err := tree.BulkLoad(bulkPairs(n, value), fill)
+				if err != nil || count != n {
+					t.Fatalf("Expected %d pairs loaded, got %d, err %v", n, count, err)
+				}
+				checkTree(t, tree)
+
+				i := 0
+				err = tree.Traverse(func(key, val []byte) {
+					if want := fmt.Sprintf("key%08d", i); string(key) != want || !bytes.Equal(val, value(i)) {
+						t.Fatalf("Expected %s at position %d, got %s", want, i, key)
+					}
+					i++
+				})
+				if err != nil || i != n {
+					t.Fatalf("Expected %d pairs, traversed %d, err %v", n, i, err)
+				}
+
+				// The tree behaves like one built with Insert
+				if err := tree.Insert([]byte("key00000000a"), []byte("new")); err != nil {
+					t.Fatalf("Failed to insert: %v", err)
+				}
+				if n > 0 {
+					if found, err := tree.Delete([]byte("key00000000")); err != nil || !found {
+						t.Fatalf("Failed to delete: found %v, err %v", found, err)
+					}
+				}
+				if val, found, _ := tree.Search([]byte("key00000000a")); !found || string(val) != "new" {
+					t.Errorf("Expected new, got %q", val)
+				}
+				checkTree(t, tree)
+			})
+		}
+	}
+}
+
+// TestBulkLoadFillFactor verifies that leaves are packed up to the fill
+// factor, much tighter than by repeated inserts
+func TestBulkLoadFillFactor(t *testing.T) {
+	const n = 20000
+	value := func(int) []byte { return []byte("value") }
+
+	inserted := NewTestTree()
+	for key, val := range bulkPairs(n, value) {
+		if err := inserted.Insert(key, val); err != nil {
+			t.Fatalf("Failed to insert: %v", err)
+		}
+	}
+	full, half := NewTestTree(), NewTestTree()
+	if _, err := full.BulkLoad(bulkPairs(n, value), 1); err != nil {
+		t.Fatalf("Failed to bulk load: %v", err)
+	}
+	if _, err := half.BulkLoad(bulkPairs(n, value), 0.5); err != nil {
+		t.Fatalf("Failed to bulk load: %v", err)
+	}
+
+	insertedLeaves, fullLeaves, halfLeaves := checkTree(t, inserted), checkTree(t, full), checkTree(t, half)
+	entry := ptrSize + offsetSize + kvLenSize + len("key00000000") + len("value")
+	for _, tt := range []struct {
+		leaves, limit int
+	}{
+		{fullLeaves, int(DefaultConfig.PageSize)},
+		{halfLeaves, int(DefaultConfig.PageSize) / 2},
+	} {
+		perLeaf := (tt.limit - headerSize) / entry
+		if want := (n + 1) / perLeaf; tt.leaves < want || tt.leaves > want+2 {
+			t.Errorf("Expected about %d leaves filled up to %d bytes, got %d", want, tt.limit, tt.leaves)
+		}
+	}
+	if fullLeaves >= insertedLeaves {
+		t.Errorf("Expected fewer leaves than the %d from inserting, got %d", insertedLeaves, fullLeaves)
+	}
+}
+
+// TestBulkLoadOverflowValues verifies that long values are moved to overflow pages
+func TestBulkLoadOverflowValues(t *testing.T) {
+	tree := NewTestTree()
+	value := func(i int) []byte {
+		if i%10 == 0 {
+			return testValue(3*overflowCapacity(tree.Config) + i)
+		}
+		return []byte("small")
+	}
+	if _, err := tree.BulkLoad(bulkPairs(200, value), 0); err != nil {
+		t.Fatalf("Failed to bulk load: %v", err)
+	}
+	checkTree(t, tree)
+	for i := 0; i < 200; i += 5 {
+		val, found, err := tree.Search([]byte(fmt.Sprintf("key%08d", i)))
+		if err != nil || !found || !bytes.Equal(val, value(i)) {
+			t.Errorf("Wrong value for key %d: %d bytes, found %v, err %v", i, len(val), found, err)
+		}
+	}
+}
+
+// TestBulkLoadLargeEntries verifies that entries larger than the fill factor
+// allows still give nodes with at least two entries where two fit into a
+// page, so the tree stays shallow
+func TestBulkLoadLargeEntries(t *testing.T) {
+	const n = 2000
+	cfg := DefaultConfig
+	for _, tt := range []struct {
+		name   string
+		keyLen int
+		valLen int
+		fill   float64
+	}{
+		{"small pairs, low fill", 0, 10, 0.1},
+		{"inline values", 0, int(cfg.InlineValSize), 0},
+		{"inline values, low fill", 0, int(cfg.InlineValSize) - 100, 0.1},
+		{"long keys, low fill", 500, 10, 0.1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			pairs := func(yield func(key, val []byte) bool) {
+				for i := 0; i < n; i++ {
+					key := fmt.Appendf(nil, "key%08d%s", i, bytes.Repeat([]byte("k"), tt.keyLen))
+					if !yield(key, bytes.Repeat([]byte("v"), tt.valLen)) {
+						return
+					}
+				}
+			}
+			tree := NewTestTree()
+			if count, err := tree.BulkLoad(pairs, tt.fill); err != nil || count != n {
+				t.Fatalf("Expected %d pairs loaded, got %d, err %v", n, count, err)
+			}
+			// checkTree fails on internal nodes with a single kid, which would
+			// make the tree as deep as it has keys
+			checkTree(t, tree)
+			depth := 0
+			for ptr := tree.Root; ; depth++ {
+				node, err := tree.getNode(ptr)
+				if err != nil {
+					t.Fatalf("Failed to read node: %v", err)
+				}
+				if node.btype() == NodeTypeLeaf {
+					break
+				}
+				ptr = node.getPtr(0)
+			}
+			if depth > 12 {
+				t.Errorf("Expected a tree of depth at most 12 for %d pairs, got %d", n, depth)
+			}
+		})
+	}
+}
+
+// TestBulkLoadErrors verifies that BulkLoad
+// 1. Rejects unsorted and duplicate keys, invalid pairs and non-empty trees
+// 2. Leaves the tree unchanged and releases every page it wrote
+func TestBulkLoadErrors(t *testing.T) {
+	sorted := bulkPairs(5000, func(int) []byte { return []byte("value") })
+	unsorted := func(at int, key []byte) iter.Seq2[[]byte, []byte] {
+		return func(yield func(key, val []byte) bool) {
+			for k, v := range sorted {
+				if string(k) == fmt.Sprintf("key%08d", at) {
+					if !yield(key, v) {
+						return
+					}
+					continue
+				}
+				if !yield(k, v) {
+					return
+				}
+			}
+		}
+	}
+
+	tests := []struct {
+		name  string
+		pairs iter.Seq2[[]byte, []byte]
+		err   error
+	}{
+		{"duplicate", unsorted(3000, []byte("key00002999")), ErrUnsorted},
+		{"descending", unsorted(3000, []byte("key00000001")), ErrUnsorted},
+		{"empty key", unsorted(0, nil), ErrEmptyKey},
+		{"key too large", unsorted(4000, bytes.Repeat([]byte("x"), 2000)), ErrKeyTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := NewMockStorage()
+			tree := NewBTree(mock.Get, mock.New, mock.Del)
+			if _, err := tree.BulkLoad(tt.pairs, 0); !errors.Is(err, tt.err) {
+				t.Fatalf("Expected %v, got %v", tt.err, err)
+			}
+			if tree.Root != 0 || len(mock.pages) != 0 {
+				t.Errorf("Failed bulk load left root %d and %d pages", tree.Root, len(mock.pages))
+			}
+		})
+	}
+
+	t.Run("not empty", func(t *testing.T) {
+		tree := NewTestTree()
+		if err := tree.Insert([]byte("key"), []byte("value")); err != nil {
+			t.Fatalf("Failed to insert: %v", err)
+		}
+		if _, err := tree.BulkLoad(sorted, 0); !errors.Is(err, ErrTreeNotEmpty) {
+			t.Errorf("Expected ErrTreeNotEmpty, got %v", err)
+		}
+
+		// A tree whose keys were all deleted can be loaded again
+		if _, err := tree.Delete([]byte("key")); err != nil {
+			t.Fatalf("Failed to delete: %v", err)
+		}
+		if count, err := tree.BulkLoad(sorted, 0); err != nil || count != 5000 {
+			t.Errorf("Expected 5000 pairs loaded, got %d, err %v", count, err)
+		}
+	})
+}
+
+// BenchmarkBulkLoad compares BulkLoad with repeated inserts of sorted keys
+func BenchmarkBulkLoad(b *testing.B) {
+	const n = 100000
+	value := func(int) []byte { return []byte("value") }
+
+	b.Run("insert", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			tree := NewTestTree()
+			for key, val := range bulkPairs(n, value) {
+				if err := tree.Insert(key, val); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("bulk", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := NewTestTree().BulkLoad(bulkPairs(n, value), 0); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,269 @@
+package btree
+
+import (
+	"bytes"
+	"iter"
+)
+
+// Cursor walks the key-value pairs of a tree in key order
+// It keeps the path from the root to the current leaf, so moving to the
+// neighbouring key only reads the nodes that change. The tree must not be
+// modified while a cursor is in use.
+type Cursor struct {
+	tree *BTree
+	path []BNode  // Nodes from the root to the current leaf
+	pos  []uint16 // Index of the current entry in each node of path
+	err  error    // First error reading the nodes, the cursor is invalid once set
+}
+
+// NewCursor creates a cursor that is not positioned yet
+// Call Seek, First or Last before reading from it
+func (tree *BTree) NewCursor() *Cursor {
+	return &Cursor{tree: tree}
+}
+
+// Seek positions the cursor at the first key greater than or equal to key
+// Returns whether there is such a key
+func (c *Cursor) Seek(key []byte) bool {
+	return c.move(func() error {
+		if err := c.descend(func(node BNode) uint16 {
+			idx := nodeLookupLE(node, key)
+			if idx == invalidIndex {
+				return 0 // every key is greater, start at the first one
+			}
+			return idx
+		}); err != nil {
+			return err
+		}
+
+		// The lookup lands on the last key less than or equal to key,
+		// step past it unless it is an exact match (never the sentinel)
+		if c.valid() && (len(c.Key()) == 0 || bytes.Compare(c.Key(), key) < 0) {
+			return c.step(true)
+		}
+		return nil
+	})
+}
+
+// First positions the cursor at the smallest key
+// Returns whether the tree has any keys
+func (c *Cursor) First() bool {
+	return c.Seek(nil)
+}
+
+// Last positions the cursor at the largest key
+// Returns whether the tree has any keys
+func (c *Cursor) Last() bool {
+	return c.move(func() error {
+		if err := c.descend(func(node BNode) uint16 {
+			return node.nkeys() - 1
+		}); err != nil {
+			return err
+		}
+		if c.valid() && len(c.Key()) == 0 {
+			c.path, c.pos = nil, nil // only the sentinel is left
+		}
+		return nil
+	})
+}
+
+// Next moves the cursor to the following key
+// Returns false once the cursor moves past the last key
+func (c *Cursor) Next() bool {
+	if !c.Valid() {
+		return false
+	}
+	return c.move(func() error {
+		return c.step(true)
+	})
+}
+
+// Prev moves the cursor to the preceding key
+// Returns false once the cursor moves before the first key
+func (c *Cursor) Prev() bool {
+	if !c.Valid() {
+		return false
+	}
+	return c.move(func() error {
+		if err := c.step(false); err != nil {
+			return err
+		}
+		if c.valid() && len(c.Key()) == 0 {
+			c.path, c.pos = nil, nil // the sentinel comes before every key
+		}
+		return nil
+	})
+}
+
+// Valid reports whether the cursor is positioned at a key
+func (c *Cursor) Valid() bool {
+	return c.err == nil && c.valid()
+}
+
+// Key returns the key at the cursor position
+// The key points into a page returned by Get and is only valid until the
+// cursor moves. Must only be called while Valid is true.
+func (c *Cursor) Key() []byte {
+	leaf := len(c.path) - 1
+	return c.path[leaf].getKey(c.pos[leaf])
+}
+
+// Value returns the value at the cursor position
+// Inline values point into a page returned by Get and are only valid until
+// the cursor moves. Returns nil and invalidates the cursor if an overflow
+// chain cannot be read, Err reports why. Must only be called while Valid is true.
+func (c *Cursor) Value() []byte {
+	var val []byte
+	c.move(func() (err error) {
+		leaf := len(c.path) - 1
+		val, err = leafValue(c.tree, c.path[leaf], c.pos[leaf])
+		return err
+	})
+	return val
+}
+
+// Err returns the error that invalidated the cursor, if any
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// Close releases the nodes held by the cursor
+func (c *Cursor) Close() {
+	c.path, c.pos = nil, nil
+}
+
+// All returns an iterator over the pairs from the cursor position onwards,
+// positioning the cursor at the first key if it is not valid yet
+// The iteration stops early if a node cannot be read, check Err afterwards.
+func (c *Cursor) All() iter.Seq2[[]byte, []byte] {
+	return func(yield func(key, val []byte) bool) {
+		if !c.Valid() && !c.First() {
+			return
+		}
+		for ; c.Valid(); c.Next() {
+			val := c.Value()
+			if val == nil && c.err != nil {
+				return
+			}
+			if !yield(c.Key(), val) {
+				return
+			}
+		}
+	}
+}
+
+// Backward returns an iterator over the pairs from the cursor position back to
+// the smallest key, positioning the cursor at the last key if it is not valid yet
+// The iteration stops early if a node cannot be read, check Err afterwards.
+func (c *Cursor) Backward() iter.Seq2[[]byte, []byte] {
+	return func(yield func(key, val []byte) bool) {
+		if !c.Valid() && !c.Last() {
+			return
+		}
+		for ; c.Valid(); c.Prev() {
+			val := c.Value()
+			if val == nil && c.err != nil {
+				return
+			}
+			if !yield(c.Key(), val) {
+				return
+			}
+		}
+	}
+}
+
+// move runs an operation that repositions the cursor
+// A failed assertion or read error invalidates the cursor and is kept for Err
+func (c *Cursor) move(fn func() error) bool {
+	if c.err != nil {
+		return false
+	}
+	if err := guard(fn); err != nil {
+		c.err = err
+		c.path, c.pos = nil, nil
+		return false
+	}
+	return c.valid()
+}
+
+// guard turns failed assertions in fn into ErrCorruptNode
+func guard(fn func() error) (err error) {
+	defer recoverAssert(&err)
+	return fn()
+}
+
+// valid reports whether the path ends at an entry of a leaf
+func (c *Cursor) valid() bool {
+	leaf := len(c.path) - 1
+	return leaf >= 0 && c.pos[leaf] < c.path[leaf].nkeys()
+}
+
+// descend rebuilds the path from the root, choosing the entry to follow in
+// every node with pick. The path is empty for an empty tree.
+func (c *Cursor) descend(pick func(node BNode) uint16) error {
+	c.path, c.pos = c.path[:0], c.pos[:0]
+	if c.tree.Root == 0 {
+		return nil
+	}
+	node, err := c.tree.getNode(c.tree.Root)
+	if err != nil {
+		return err
+	}
+	for {
+		idx := pick(node)
+		c.path = append(c.path, node)
+		c.pos = append(c.pos, idx)
+
+		switch node.btype() {
+		case NodeTypeLeaf:
+			return nil
+		case NodeTypeInternal:
+			if node, err = c.tree.getNode(node.getPtr(idx)); err != nil {
+				return err
+			}
+		default:
+			assert(false) // unknown node type
+		}
+	}
+}
+
+// step moves to the neighbouring entry, climbing up until a node has one in
+// that direction and descending to the nearest leaf entry below it. The
+// sentinel is skipped going forward, the path is cleared past either end.
+func (c *Cursor) step(forward bool) error {
+	level := len(c.path) - 1
+	for ; level >= 0; level-- {
+		idx := c.pos[level]
+		if forward && idx+1 < c.path[level].nkeys() {
+			c.pos[level]++
+			break
+		}
+		if !forward && idx > 0 {
+			c.pos[level]--
+			break
+		}
+	}
+	if level < 0 {
+		c.path, c.pos = nil, nil // no more entries in this direction
+		return nil
+	}
+
+	for ; level < len(c.path)-1; level++ {
+		kid, err := c.tree.getNode(c.path[level].getPtr(c.pos[level]))
+		if err != nil {
+			return err
+		}
+		assert(kid.nkeys() > 0)
+		c.path[level+1] = kid
+		if forward {
+			c.pos[level+1] = 0
+		} else {
+			c.pos[level+1] = kid.nkeys() - 1
+		}
+	}
+
+	if forward && len(c.Key()) == 0 {
+		return c.step(true) // the sentinel, keys are never empty otherwise
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// cursorTree builds a tree holding the keys key0000, key0002, ..., leaving
+// the odd numbers out so seeks can land between keys
+func cursorTree(t *testing.T, n int) (*BTree, *MockStorage) {
+	t.Helper()
+	mock := NewMockStorage()
+	tree := NewBTree(mock.Get, mock.New, mock.Del)
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("key%04d", 2*i))
+		if err := tree.Insert(key, []byte(fmt.Sprintf("value%d", 2*i))); err != nil {
+			t.Fatalf("Failed to insert: %v", err)
+		}
+	}
+	return tree, mock
+}
+
+// TestCursorEmptyTree verifies that a cursor over an empty tree is never valid
+// 1. Before the first insert
+// 2. After the last key was deleted and only the sentinel is left
+func TestCursorEmptyTree(t *testing.T) {
+	tree := NewTestTree()
+	c := tree.NewCursor()
+	if c.First() || c.Last() || c.Seek([]byte("a")) || c.Valid() {
+		t.Errorf("Expected cursor over an empty tree to be invalid")
+	}
+
+	if err := tree.Insert([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	if _, err := tree.Delete([]byte("a")); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	if c.First() || c.Last() || c.Seek(nil) {
+		t.Errorf("Expected cursor to skip the sentinel")
+	}
+	if c.Err() != nil {
+		t.Errorf("Unexpected error: %v", c.Err())
+	}
+}
+
+// TestCursorForwardAndBackward verifies that a cursor over a multi-level tree
+// 1. Visits every key in order with Next, starting at First
+// 2. Visits every key in reverse order with Prev, starting at Last
+// 3. Becomes invalid past either end
+func TestCursorForwardAndBackward(t *testing.T) {
+	const n = 1000
+	tree, _ := cursorTree(t, n)
+	c := tree.NewCursor()
+	defer c.Close()
+
+	i := 0
+	for ok := c.First(); ok; ok = c.Next() {
+		expected := fmt.Sprintf("key%04d", 2*i)
+		if string(c.Key()) != expected || string(c.Value()) != fmt.Sprintf("value%d", 2*i) {
+			t.Fatalf("Expected %s at position %d, got %s", expected, i, c.Key())
+		}
+		i++
+	}
+	if i != n || c.Valid() || c.Next() || c.Err() != nil {
+		t.Fatalf("Expected %d keys forward, got %d, err %v", n, i, c.Err())
+	}
+
+	i = n - 1
+	for ok := c.Last(); ok; ok = c.Prev() {
+		if expected := fmt.Sprintf("key%04d", 2*i); string(c.Key()) != expected {
+			t.Fatalf("Expected %s at position %d, got %s", expected, i, c.Key())
+		}
+		i--
+	}
+	if i != -1 || c.Valid() || c.Prev() || c.Err() != nil {
+		t.Fatalf("Expected %d keys backward, stopped at %d, err %v", n, i, c.Err())
+	}
+}
+
+// TestCursorSeek verifies that Seek lands on the first key greater than or
+// equal to the target and that the cursor can move both ways from there
+func TestCursorSeek(t *testing.T) {
+	tree, _ := cursorTree(t, 1000)
+	c := tree.NewCursor()
+
+	tests := []struct {
+		target   string
+		expected string // empty if no key is greater or equal
+	}{
+		{"", "key0000"},
+		{"a", "key0000"},
+		{"key0000", "key0000"},
+		{"key0001", "key0002"},
+		{"key0999", "key1000"},
+		{"key1998", "key1998"},
+		{"key1999", ""},
+		{"z", ""},
+	}
+	for _, tt := range tests {
+		ok := c.Seek([]byte(tt.target))
+		if ok != (tt.expected != "") || (ok && string(c.Key()) != tt.expected) {
+			t.Errorf("Seek(%q): expected %q, got valid %v", tt.target, tt.expected, ok)
+		}
+	}
+
+	c.Seek([]byte("key1001"))
+	if !c.Prev() || string(c.Key()) != "key1000" {
+		t.Errorf("Expected key1000 before key1002")
+	}
+	if !c.Next() || string(c.Key()) != "key1002" {
+		t.Errorf("Expected key1002 after key1000")
+	}
+}
+
+// TestCursorAll verifies the iterator adapter
+// 1. Starts at the first key on an unpositioned cursor
+// 2. Starts at the cursor position after a Seek
+// 3. Stops when the loop breaks
+func TestCursorAll(t *testing.T) {
+	tree, _ := cursorTree(t, 300)
+	c := tree.NewCursor()
+
+	count := 0
+	for key, val := range c.All() {
+		if !bytes.HasPrefix(val, []byte("value")) || len(key) == 0 {
+			t.Fatalf("Unexpected pair %s=%s", key, val)
+		}
+		count++
+	}
+	if count != 300 {
+		t.Errorf("Expected 300 pairs, got %d", count)
+	}
+
+	c.Seek([]byte("key0500"))
+	var keys []string
+	for key := range c.All() {
+		keys = append(keys, string(key))
+		if len(keys) == 3 {
+			break
+		}
+	}
+	if fmt.Sprint(keys) != "[key0500 key0502 key0504]" {
+		t.Errorf("Unexpected keys %v", keys)
+	}
+}
+
+// TestCursorBackward verifies the reverse iterator adapter
+// 1. Starts at the last key on an unpositioned cursor
+// 2. Walks back across leaf boundaries from the cursor position
+func TestCursorBackward(t *testing.T) {
+	tree, _ := cursorTree(t, 1000)
+	c := tree.NewCursor()
+
+	i := 999
+	for key := range c.Backward() {
+		if expected := fmt.Sprintf("key%04d", 2*i); string(key) != expected {
+			t.Fatalf("Expected %s, got %s", expected, key)
+		}
+		i--
+	}
+	if i != -1 || c.Err() != nil {
+		t.Errorf("Expected all keys in reverse, stopped at %d, err %v", i, c.Err())
+	}
+
+	c.Seek([]byte("key0101"))
+	var keys []string
+	for key := range c.Backward() {
+		keys = append(keys, string(key))
+	}
+	if len(keys) != 52 || keys[0] != "key0102" || keys[51] != "key0000" {
+		t.Errorf("Unexpected keys walking back from key0102: %d keys, %v ... %v", len(keys), keys[0], keys[len(keys)-1])
+	}
+}
+
+// TestCursorOverflowValues verifies that Value reads overflow chains
+func TestCursorOverflowValues(t *testing.T) {
+	tree, _ := cursorTree(t, 10)
+	big := testValue(5 * overflowCapacity(tree.Config))
+	if err := tree.Insert([]byte("key0005"), big); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+
+	c := tree.NewCursor()
+	if !c.Seek([]byte("key0005")) || !bytes.Equal(c.Value(), big) {
+		t.Fatalf("Expected the overflow value, err %v", c.Err())
+	}
+}
+
+// TestCursorCorruptNode verifies that a corrupt node invalidates the cursor
+// and is reported by Err
+func TestCursorCorruptNode(t *testing.T) {
+	tree, mock := cursorTree(t, 1000)
+	root, err := tree.getNode(tree.Root)
+	if err != nil {
+		t.Fatalf("Failed to read root: %v", err)
+	}
+	// Break the last child of the root, the first leaves stay readable
+	mock.pages[root.getPtr(root.nkeys()-1)][0] = 0xFF
+
+	c := tree.NewCursor()
+	if !c.First() {
+		t.Fatalf("Failed to position cursor: %v", c.Err())
+	}
+	for c.Next() {
+	}
+	if !errors.Is(c.Err(), ErrCorruptNode) {
+		t.Errorf("Expected ErrCorruptNode, got %v", c.Err())
+	}
+	if c.Valid() || c.First() {
+		t.Errorf("Expected cursor to stay invalid after an error")
+	}
+}
@@ -75,17 +75,23 @@ Size: 4096 bytes
 | ... remaining space ...                                                                 |
 |                                                                                         |
 +-----------------------------------------------------------------------------------------+
+
+A leaf pointer is only set for a value that lives in overflow pages (see overflow.go);
+it then points to the first page of the chain and the value holds the total length.
 */
 
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
 )
 
 const (
 	// Node types
 	NodeTypeInternal uint16 = 1
 	NodeTypeLeaf     uint16 = 2
+	NodeTypeOverflow uint16 = 3 // Page of an overflow chain, see overflow.go
 
 	// Memory layout constants
 	headerSize = 4 // Size of node header (2B type + 2B nkeys)
@@ -99,16 +105,67 @@ const (
 
 // Config holds B+ tree configuration parameters
 type Config struct {
-	PageSize   uint16 // Size of each node page in bytes
-	MaxKeySize uint16 // Maximum allowed key size in bytes
-	MaxValSize uint16 // Maximum allowed value size in bytes
+	PageSize      uint16 // Size of each node page in bytes
+	MaxKeySize    uint16 // Maximum allowed key size in bytes
+	MaxValSize    uint32 // Maximum allowed value size in bytes
+	InlineValSize uint16 // Longer values are moved to overflow pages
+
+	// CheckedPages tells the tree that Get only returns pages that passed
+	// CheckPage, so visiting a node only checks its type. Otherwise the whole
+	// layout of a node is checked every time it is read.
+	CheckedPages bool
 }
 
+var (
+	// ErrCorruptNode is returned when a node violates the layout invariants,
+	// which means the page it was read from does not hold a valid node
+	ErrCorruptNode = errors.New("btree: corrupt node")
+
+	// ErrEmptyKey is returned for an empty key, which is reserved for the
+	// sentinel entry of the leftmost leaf
+	ErrEmptyKey = errors.New("btree: empty key")
+
+	// ErrKeyTooLarge is returned for a key longer than Config.MaxKeySize
+	ErrKeyTooLarge = errors.New("btree: key too large")
+
+	// ErrValueTooLarge is returned for a value longer than Config.MaxValSize
+	ErrValueTooLarge = errors.New("btree: value too large")
+)
+
 // DefaultConfig provides default configuration values
 var DefaultConfig = Config{
-	PageSize:   4096,
-	MaxKeySize: 1000,
-	MaxValSize: 3000,
+	PageSize:      4096,
+	MaxKeySize:    1000,
+	MaxValSize:    64 << 20,
+	InlineValSize: 3000,
+}
+
+// maxNodeSize is the largest node that can be addressed, positions within
+// a node are 16-bit
+const maxNodeSize = 1<<16 - 1
+
+// MaxPageSize returns the largest PageSize the configuration supports
+// Before it is split, a node may outgrow its page by the entries one update
+// adds: a leaf by one pair, an internal node by the two keys of a three-way
+// split. All positions within the grown node must still fit into 16 bits.
+func (cfg Config) MaxPageSize() int {
+	entry := ptrSize + offsetSize + kvLenSize + int(cfg.MaxKeySize)
+	return maxNodeSize - max(entry+int(cfg.InlineValSize), 2*entry)
+}
+
+// Validate checks that a key-value pair can be stored in the tree
+// Returns ErrEmptyKey, ErrKeyTooLarge or ErrValueTooLarge
+func (cfg Config) Validate(key []byte, val []byte) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	if len(key) > int(cfg.MaxKeySize) {
+		return fmt.Errorf("%w: %d bytes, limit is %d", ErrKeyTooLarge, len(key), cfg.MaxKeySize)
+	}
+	if uint64(len(val)) > uint64(cfg.MaxValSize) {
+		return fmt.Errorf("%w: %d bytes, limit is %d", ErrValueTooLarge, len(val), cfg.MaxValSize)
+	}
+	return nil
 }
 
 // BNode represents a B+ tree node as a byte slice
@@ -204,6 +261,50 @@ func (node BNode) nbytes() uint16 {
 	return node.kvPos(node.nkeys())
 }
 
+// valid reports whether the node layout fits into the page, so that reading
+// any of its pointers, keys and values stays within bounds
+func (node BNode) valid() bool {
+	if len(node) < headerSize {
+		return false
+	}
+	if btype := node.btype(); btype != NodeTypeInternal && btype != NodeTypeLeaf {
+		return false
+	}
+
+	nkeys := int(node.nkeys())
+	pos := headerSize + (ptrSize+offsetSize)*nkeys
+	if pos > len(node) {
+		return false
+	}
+
+	// every offset must point right behind the previous key-value pair
+	for i := 1; i <= nkeys; i++ {
+		if pos+kvLenSize > len(node) {
+			return false
+		}
+		klen := int(binary.LittleEndian.Uint16(node[pos:]))
+		vlen := int(binary.LittleEndian.Uint16(node[pos+2:]))
+		pos += kvLenSize + klen + vlen
+		if pos > len(node) || pos != int(node.kvPos(uint16(i))) {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckPage verifies that a page read from disk can be used by the tree
+// Returns ErrCorruptNode for a node whose pointers, keys or values would reach
+// past the page. Overflow pages pass, their chain is checked as it is read.
+func CheckPage(page []byte) error {
+	if len(page) >= headerSize && BNode(page).btype() == NodeTypeOverflow {
+		return nil
+	}
+	if !BNode(page).valid() {
+		return ErrCorruptNode
+	}
+	return nil
+}
+
 // Search Operations
 
 // nodeLookupLE finds the last position where the key is less than or equal to the target
@@ -218,26 +319,44 @@ func nodeLookupLE(node BNode, key []byte) uint16 {
 		return invalidIndex // Return invalidIndex for nodes with no keys
 	}
 
-	// Linear search through keys
-	for i := uint16(0); i < nkeys; i++ {
-		cmp := bytes.Compare(node.getKey(i), key)
+	// Binary search for the first key greater than the target,
+	// keys within a node are sorted
+	lo, hi := uint16(0), nkeys
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		cmp := bytes.Compare(node.getKey(mid), key)
 		if cmp == 0 {
-			return i // Exact match
+			return mid // Exact match
 		}
-		if cmp > 0 {
-			return i - 1 // Found first key greater than target
+		if cmp < 0 {
+			lo = mid + 1
+		} else {
+			hi = mid
 		}
 	}
 
-	return nkeys - 1 // All keys are less than target
+	// The key before it is the last one less than the target,
+	// lo-1 wraps to invalidIndex if every key is greater
+	return lo - 1
 }
 
 // Utility Functions
 
-// assert panics if the condition is false
+// assert panics with ErrCorruptNode if the condition is false
 // Used for runtime validation of node operations
 func assert(b bool) {
 	if !b {
-		panic("assertion failed")
+		panic(ErrCorruptNode)
+	}
+}
+
+// recoverAssert turns a failed assertion into an error stored in err
+// Any other panic is passed on
+func recoverAssert(err *error) {
+	if r := recover(); r != nil {
+		if r != ErrCorruptNode {
+			panic(r)
+		}
+		*err = ErrCorruptNode
 	}
 }
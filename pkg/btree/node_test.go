@@ -3,6 +3,7 @@ package btree
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"testing"
 )
 
@@ -387,3 +388,87 @@ func TestNodeBytes(t *testing.T) {
 		t.Errorf("Node size %d exceeds page size %d", size, DefaultConfig.PageSize)
 	}
 }
+
+// linearLookupLE is the original linear scan, kept as a reference for nodeLookupLE
+func linearLookupLE(node BNode, key []byte) uint16 {
+	nkeys := node.nkeys()
+	for i := uint16(0); i < nkeys; i++ {
+		cmp := bytes.Compare(node.getKey(i), key)
+		if cmp == 0 {
+			return i
+		}
+		if cmp > 0 {
+			return i - 1
+		}
+	}
+	return nkeys - 1
+}
+
+// lookupNode builds a leaf holding n sorted keys of keySize bytes each
+// The keys are the even numbers 2, 4, ..., 2n, so odd numbers fall between them.
+func lookupNode(n int, keySize int) (BNode, [][]byte) {
+	node := newNode()
+	node.setHeader(NodeTypeLeaf, uint16(n))
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = lookupKey(2*(i+1), keySize)
+		nodeAppendKV(node, uint16(i), 0, keys[i], []byte("v"))
+	}
+	return node, keys
+}
+
+// lookupKey encodes a number as a big-endian key of the given size
+func lookupKey(num int, keySize int) []byte {
+	key := make([]byte, keySize)
+	for i := keySize - 1; i >= 0 && num > 0; i-- {
+		key[i] = byte(num)
+		num >>= 8
+	}
+	return key
+}
+
+// TestNodeLookupLEMatchesLinear verifies that the binary search returns the same
+// index as a linear scan for every key in a node, the keys between them and
+// the keys before the first and after the last one
+func TestNodeLookupLEMatchesLinear(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 7, 64, 170} {
+		node, _ := lookupNode(n, 8)
+		for num := 0; num <= 2*n+1; num++ {
+			key := lookupKey(num, 8)
+			got, expected := nodeLookupLE(node, key), linearLookupLE(node, key)
+			if got != expected {
+				t.Errorf("n=%d, key %d: expected %d, got %d", n, num, expected, got)
+			}
+		}
+	}
+}
+
+// benchmarkLookup looks up every key of a node with n keys of keySize bytes
+func benchmarkLookup(b *testing.B, lookup func(BNode, []byte) uint16, n int, keySize int) {
+	node, keys := lookupNode(n, keySize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lookup(node, keys[i%n])
+	}
+}
+
+// BenchmarkNodeLookupLE compares the binary search with a linear scan on the
+// fan-outs of a 4 KB page with small, medium and large keys
+func BenchmarkNodeLookupLE(b *testing.B) {
+	fanouts := []struct {
+		keys    int
+		keySize int
+	}{
+		{170, 8},
+		{80, 32},
+		{28, 128},
+	}
+	for _, f := range fanouts {
+		b.Run(fmt.Sprintf("binary/%dx%dB", f.keys, f.keySize), func(b *testing.B) {
+			benchmarkLookup(b, nodeLookupLE, f.keys, f.keySize)
+		})
+		b.Run(fmt.Sprintf("linear/%dx%dB", f.keys, f.keySize), func(b *testing.B) {
+			benchmarkLookup(b, linearLookupLE, f.keys, f.keySize)
+		})
+	}
+}
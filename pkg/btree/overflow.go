@@ -0,0 +1,138 @@
+package btree
+
+import "encoding/binary"
+
+/*
+Overflow Page Layout:
+
+Values longer than Config.InlineValSize do not fit into a leaf and are stored
+in a chain of overflow pages instead. The leaf entry keeps the key, its pointer
+(unused in leaves otherwise) holds the first page of the chain, and its value
+is replaced by the total length of the real value (8 bytes):
+
++----------------+----------------+----------------+--------------------------+
+| Type = 3 (2B)  | Reserved (2B)  | Next (8B)      | Data (PageSize - 12B)    |
++----------------+----------------+----------------+--------------------------+
+
+  - Type: NodeTypeOverflow, so a chain page is never mistaken for a node
+  - Next: page number of the next page in the chain (0 for the last one)
+  - Data: the next part of the value, the last page is only partially used
+
+Chains are never modified. Updating or deleting the entry releases the whole
+chain, an update writes a new one, just like copy-on-write nodes.
+*/
+
+const (
+	overflowHeaderSize = 12 // Size of overflow page header (2B type + 2B reserved + 8B next)
+	overflowRefSize    = 8  // Size of the value stored in the leaf (total length)
+)
+
+// overflowCapacity returns how many value bytes fit into one overflow page
+func overflowCapacity(cfg Config) int {
+	return int(cfg.PageSize) - overflowHeaderSize
+}
+
+// writeOverflow stores a value in a new chain of overflow pages
+// Returns the first page of the chain and the reference to keep in the leaf
+func writeOverflow(tree *BTree, val []byte) (uint64, []byte, error) {
+	capacity := overflowCapacity(tree.Config)
+	npages := (len(val) + capacity - 1) / capacity
+
+	// write the chain back to front, so every page knows its successor
+	var next uint64
+	for i := npages - 1; i >= 0; i-- {
+		page := make([]byte, tree.Config.PageSize)
+		binary.LittleEndian.PutUint16(page[0:2], NodeTypeOverflow)
+		binary.LittleEndian.PutUint64(page[4:12], next)
+		copy(page[overflowHeaderSize:], val[i*capacity:min((i+1)*capacity, len(val))])
+
+		ptr, err := tree.newNode(page)
+		if err != nil {
+			return 0, nil, err
+		}
+		next = ptr
+	}
+
+	ref := make([]byte, overflowRefSize)
+	binary.LittleEndian.PutUint64(ref, uint64(len(val)))
+	return next, ref, nil
+}
+
+// overflowSize decodes the length of a value stored in overflow pages
+// Returns ErrCorruptNode for a reference no valid value could have
+func overflowSize(tree *BTree, ref []byte) (uint64, error) {
+	if len(ref) != overflowRefSize {
+		return 0, ErrCorruptNode
+	}
+	size := binary.LittleEndian.Uint64(ref)
+	if size <= uint64(tree.Config.InlineValSize) || size > uint64(tree.Config.MaxValSize) {
+		return 0, ErrCorruptNode
+	}
+	return size, nil
+}
+
+// walkOverflow visits the pages of a chain in order
+// Parameters:
+// - head: first page of the chain
+// - ref: the value stored in the leaf entry
+// - fn: called with each page number and the part of the value it holds
+func walkOverflow(tree *BTree, head uint64, ref []byte, fn func(ptr uint64, data []byte)) error {
+	size, err := overflowSize(tree, ref)
+	if err != nil {
+		return err
+	}
+
+	capacity := uint64(overflowCapacity(tree.Config))
+	for ptr := head; size > 0; {
+		if ptr == 0 {
+			return ErrCorruptNode // the chain ends early
+		}
+		page, err := tree.Get(ptr)
+		if err != nil {
+			return err
+		}
+		n := min(size, capacity)
+		if uint64(len(page)) < overflowHeaderSize+n || binary.LittleEndian.Uint16(page[0:2]) != NodeTypeOverflow {
+			return ErrCorruptNode
+		}
+
+		fn(ptr, page[overflowHeaderSize:overflowHeaderSize+n])
+		size -= n
+		ptr = binary.LittleEndian.Uint64(page[4:12])
+	}
+	return nil
+}
+
+// leafValue returns the value of a leaf entry, reading its overflow chain if it has one
+func leafValue(tree *BTree, node BNode, idx uint16) ([]byte, error) {
+	head := node.getPtr(idx)
+	if head == 0 {
+		return node.getVal(idx), nil
+	}
+
+	// The length is checked before it is allocated
+	ref := node.getVal(idx)
+	size, err := overflowSize(tree, ref)
+	if err != nil {
+		return nil, err
+	}
+	val := make([]byte, 0, size)
+	err = walkOverflow(tree, head, ref, func(ptr uint64, data []byte) {
+		val = append(val, data...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return val, nil
+}
+
+// leafFree releases the overflow chain of a leaf entry that is updated or deleted
+func leafFree(tree *BTree, node BNode, idx uint16) error {
+	head := node.getPtr(idx)
+	if head == 0 {
+		return nil
+	}
+	return walkOverflow(tree, head, node.getVal(idx), func(ptr uint64, data []byte) {
+		tree.delNode(ptr)
+	})
+}
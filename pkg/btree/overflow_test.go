@@ -0,0 +1,187 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+)
+
+// testValue returns a value of the given size whose bytes depend on the position
+func testValue(size int) []byte {
+	val := make([]byte, size)
+	for i := range val {
+		val[i] = byte(i % 251)
+	}
+	return val
+}
+
+// TestOverflowValues verifies that values around and far beyond the inline limit
+// 1. Are returned unchanged by Search
+// 2. Are returned unchanged by Traverse
+// 3. Survive splits caused by many other keys
+func TestOverflowValues(t *testing.T) {
+	tree := NewTestTree()
+	cfg := tree.Config
+	capacity := overflowCapacity(cfg)
+
+	sizes := []int{
+		int(cfg.InlineValSize),
+		int(cfg.InlineValSize) + 1,
+		capacity,
+		capacity + 1,
+		3 * capacity,
+		1 << 20,
+	}
+	values := make(map[string][]byte)
+	for i, size := range sizes {
+		key := fmt.Sprintf("big%d", i)
+		values[key] = testValue(size)
+		if err := tree.Insert([]byte(key), values[key]); err != nil {
+			t.Fatalf("Failed to insert value of %d bytes: %v", size, err)
+		}
+	}
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		values[key] = []byte(fmt.Sprintf("value%d", i))
+		if err := tree.Insert([]byte(key), values[key]); err != nil {
+			t.Fatalf("Failed to insert: %v", err)
+		}
+	}
+
+	for key, expected := range values {
+		val, found, err := tree.Search([]byte(key))
+		if err != nil || !found {
+			t.Fatalf("Failed to find key %s: found %v, err %v", key, found, err)
+		}
+		if !bytes.Equal(val, expected) {
+			t.Errorf("Wrong value for key %s: got %d bytes, expected %d", key, len(val), len(expected))
+		}
+	}
+
+	visited := 0
+	err := tree.Traverse(func(key, val []byte) {
+		visited++
+		if !bytes.Equal(val, values[string(key)]) {
+			t.Errorf("Traverse returned wrong value for key %s", key)
+		}
+	})
+	if err != nil {
+		t.Fatalf("Failed to traverse: %v", err)
+	}
+	if visited != len(values) {
+		t.Errorf("Expected %d pairs, visited %d", len(values), visited)
+	}
+}
+
+// TestOverflowPagesReleased verifies that the overflow chain of an entry is
+// handed to Del when the entry is updated or deleted
+func TestOverflowPagesReleased(t *testing.T) {
+	mock := NewMockStorage()
+	tree := NewBTree(mock.Get, mock.New, mock.Del)
+
+	if err := tree.Insert([]byte("key"), []byte("small")); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	baseline := len(mock.pages)
+
+	big := testValue(100 << 10)
+	chain := (len(big) + overflowCapacity(tree.Config) - 1) / overflowCapacity(tree.Config)
+	if err := tree.Insert([]byte("key"), big); err != nil {
+		t.Fatalf("Failed to insert big value: %v", err)
+	}
+	if len(mock.pages) != baseline+chain {
+		t.Errorf("Expected %d pages with the chain, found %d", baseline+chain, len(mock.pages))
+	}
+
+	// Replacing the value with another big one swaps the chain
+	if err := tree.Insert([]byte("key"), testValue(len(big))); err != nil {
+		t.Fatalf("Failed to update big value: %v", err)
+	}
+	if len(mock.pages) != baseline+chain {
+		t.Errorf("Expected %d pages after replacing the chain, found %d", baseline+chain, len(mock.pages))
+	}
+
+	if err := tree.Insert([]byte("key"), []byte("small")); err != nil {
+		t.Fatalf("Failed to update to a small value: %v", err)
+	}
+	if len(mock.pages) != baseline {
+		t.Errorf("Expected %d pages after dropping the chain, found %d", baseline, len(mock.pages))
+	}
+
+	if err := tree.Insert([]byte("key"), big); err != nil {
+		t.Fatalf("Failed to insert big value: %v", err)
+	}
+	if found, err := tree.Delete([]byte("key")); err != nil || !found {
+		t.Fatalf("Failed to delete: found %v, err %v", found, err)
+	}
+	if len(mock.pages) != 1 {
+		t.Errorf("Expected only the root page after deleting, found %d pages", len(mock.pages))
+	}
+}
+
+// TestOverflowWriteFailure verifies that a failure while writing a chain
+// leaves neither the entry nor any chain pages behind
+func TestOverflowWriteFailure(t *testing.T) {
+	mock := NewMockStorage()
+	tree := NewBTree(mock.Get, mock.New, mock.Del)
+
+	if err := tree.Insert([]byte("key"), []byte("small")); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	root, pages := tree.Root, snapshotPages(mock)
+
+	mock.failAt = mock.next + 5
+	if err := tree.Insert([]byte("key"), testValue(10*overflowCapacity(tree.Config))); !errors.Is(err, errDiskFull) {
+		t.Fatalf("Expected insert to fail with a full disk, got %v", err)
+	}
+	if tree.Root != root || len(mock.pages) != len(pages) {
+		t.Errorf("Failed insert changed the tree: root %d -> %d, %d -> %d pages", root, tree.Root, len(pages), len(mock.pages))
+	}
+	if val, _, err := tree.Search([]byte("key")); err != nil || string(val) != "small" {
+		t.Errorf("Expected the old value, got %q, err %v", val, err)
+	}
+}
+
+// TestCorruptOverflowChain verifies that a chain page that is not an overflow
+// page is reported as ErrCorruptNode
+func TestCorruptOverflowChain(t *testing.T) {
+	mock := NewMockStorage()
+	tree := NewBTree(mock.Get, mock.New, mock.Del)
+
+	if err := tree.Insert([]byte("key"), testValue(3*overflowCapacity(tree.Config))); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+
+	// The chain is written back to front, so page 2 is its second page
+	mock.pages[2][0] = byte(NodeTypeLeaf)
+
+	if _, _, err := tree.Search([]byte("key")); !errors.Is(err, ErrCorruptNode) {
+		t.Errorf("Expected ErrCorruptNode from Search, got %v", err)
+	}
+	if _, err := tree.Delete([]byte("key")); !errors.Is(err, ErrCorruptNode) {
+		t.Errorf("Expected ErrCorruptNode from Delete, got %v", err)
+	}
+}
+
+// TestCorruptOverflowLength verifies that a leaf entry with an overflow
+// length no value can have fails with ErrCorruptNode, before it is allocated
+func TestCorruptOverflowLength(t *testing.T) {
+	mock := NewMockStorage()
+	tree := NewBTree(mock.Get, mock.New, mock.Del)
+
+	if err := tree.Insert([]byte("key"), testValue(3*overflowCapacity(tree.Config))); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+
+	leaf := BNode(mock.pages[tree.Root])
+	ref := leaf.getVal(nodeLookupLE(leaf, []byte("key")))
+	for _, size := range []uint64{math.MaxUint64, uint64(tree.Config.MaxValSize) + 1, uint64(tree.Config.InlineValSize), 0} {
+		binary.LittleEndian.PutUint64(ref, size)
+		if _, _, err := tree.Search([]byte("key")); !errors.Is(err, ErrCorruptNode) {
+			t.Errorf("Expected ErrCorruptNode from Search for length %d, got %v", size, err)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package btree
+
+import "bytes"
+
+// DeleteRange removes every key with start <= key < end
+// A nil or empty start begins at the smallest key, a nil or empty end runs to
+// the largest key. Subtrees that lie completely inside the range are released
+// without rewriting their pages, only the nodes on the two boundary paths are
+// rewritten. Returns the number of keys removed, on error the tree is left
+// unchanged.
+func (tree *BTree) DeleteRange(start, end []byte) (int, error) {
+	var count int
+	err := tree.update(func() error {
+		var err error
+		count, err = treeDeleteRangeRoot(tree, start, end)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// treeDeleteRangeRoot deletes the range starting at the root and removes
+// levels while the root is left with a single child
+func treeDeleteRangeRoot(tree *BTree, start, end []byte) (int, error) {
+	if tree.Root == 0 {
+		return 0, nil
+	}
+	old, err := tree.getNode(tree.Root)
+	if err != nil {
+		return 0, err
+	}
+	node, count, err := treeDeleteRange(tree, old, start, end)
+	if err != nil || node == nil {
+		return 0, err // nothing in the range
+	}
+
+	// The leftmost path keeps the sentinel, so the root never becomes empty
+	assert(node.nkeys() > 0)
+	tree.delNode(tree.Root)
+	if node.btype() == NodeTypeInternal && node.nkeys() == 1 {
+		// the root has a single child, remove levels until it has more
+		ptr := node.getPtr(0)
+		for {
+			kid, err := tree.getNode(ptr)
+			if err != nil {
+				return 0, err
+			}
+			if kid.btype() != NodeTypeInternal || kid.nkeys() != 1 {
+				break
+			}
+			tree.delNode(ptr)
+			ptr = kid.getPtr(0)
+		}
+		tree.Root = ptr
+		return count, nil
+	}
+
+	ptr, err := tree.newNode(node)
+	if err != nil {
+		return 0, err
+	}
+	tree.Root = ptr
+	return count, nil
+}
+
+// inRange reports whether key lies in [start, end), empty bounds are open
+func inRange(key, start, end []byte) bool {
+	return bytes.Compare(key, start) >= 0 && (len(end) == 0 || bytes.Compare(key, end) < 0)
+}
+
+// rangeKid is an entry of an internal node being rebuilt by treeDeleteRange
+type rangeKid struct {
+	ptr  uint64 // Page of an unchanged kid, 0 if node holds a rewritten one
+	key  []byte // First key of the kid
+	node BNode  // Rewritten kid, not yet written
+}
+
+// treeDeleteRange removes the keys in [start, end) below a node
+// Returns the new node, which has no keys if everything below it was removed,
+// or nil if nothing was removed, and the number of keys removed
+func treeDeleteRange(tree *BTree, node BNode, start, end []byte) (BNode, int, error) {
+	switch node.btype() {
+	case NodeTypeLeaf:
+		return leafDeleteRange(tree, node, start, end)
+	case NodeTypeInternal:
+		return nodeDeleteRange(tree, node, start, end)
+	}
+
+	assert(false) // unknown node type
+	return nil, 0, nil
+}
+
+// leafDeleteRange removes the keys in [start, end) from a leaf and
+// releases their overflow chains
+func leafDeleteRange(tree *BTree, node BNode, start, end []byte) (BNode, int, error) {
+	new := BNode(make([]byte, tree.Config.PageSize))
+	var kept uint16
+	for i := uint16(0); i < node.nkeys(); i++ {
+		// the sentinel is never removed
+		if len(node.getKey(i)) == 0 || !inRange(node.getKey(i), start, end) {
+			kept++
+		}
+	}
+	if kept == node.nkeys() {
+		return nil, 0, nil
+	}
+
+	new.setHeader(NodeTypeLeaf, kept)
+	idx := uint16(0)
+	for i := uint16(0); i < node.nkeys(); i++ {
+		key := node.getKey(i)
+		if len(key) == 0 || !inRange(key, start, end) {
+			nodeAppendKV(new, idx, node.getPtr(i), key, node.getVal(i))
+			idx++
+			continue
+		}
+		if err := leafFree(tree, node, i); err != nil {
+			return nil, 0, err
+		}
+	}
+	return new, int(node.nkeys() - kept), nil
+}
+
+// nodeDeleteRange removes the keys in [start, end) below an internal node
+// Kids completely inside the range are dropped with freeSubtree, kids
+// overlapping it are rewritten and merged with a neighbour if they got small.
+func nodeDeleteRange(tree *BTree, node BNode, start, end []byte) (BNode, int, error) {
+	var kids []rangeKid
+	total, changed := 0, false
+	for i := uint16(0); i < node.nkeys(); i++ {
+		ptr, key := node.getPtr(i), node.getKey(i)
+
+		// Kid i holds the keys from its own key up to the key of kid i+1
+		var next []byte
+		if i+1 < node.nkeys() {
+			next = node.getKey(i + 1)
+		}
+		before := next != nil && bytes.Compare(next, start) <= 0
+		after := len(end) > 0 && bytes.Compare(key, end) >= 0
+		inside := len(key) > 0 && bytes.Compare(key, start) >= 0 &&
+			(len(end) == 0 || (next != nil && bytes.Compare(next, end) <= 0))
+
+		switch {
+		case before || after:
+			kids = append(kids, rangeKid{ptr: ptr, key: key})
+
+		case inside:
+			count, err := freeSubtree(tree, ptr)
+			if err != nil {
+				return nil, 0, err
+			}
+			total += count
+			changed = true
+
+		default:
+			kid, err := tree.getNode(ptr)
+			if err != nil {
+				return nil, 0, err
+			}
+			updated, count, err := treeDeleteRange(tree, kid, start, end)
+			if err != nil {
+				return nil, 0, err
+			}
+			if updated == nil {
+				kids = append(kids, rangeKid{ptr: ptr, key: key})
+				continue
+			}
+			tree.delNode(ptr)
+			total += count
+			changed = true
+			if updated.nkeys() > 0 {
+				kids = append(kids, rangeKid{key: updated.getKey(0), node: updated})
+			}
+		}
+	}
+	if !changed {
+		return nil, 0, nil
+	}
+
+	kids, err := mergeRangeKids(tree, kids)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	new := BNode(make([]byte, tree.Config.PageSize))
+	new.setHeader(NodeTypeInternal, uint16(len(kids)))
+	for i, kid := range kids {
+		ptr := kid.ptr
+		if kid.node != nil {
+			if ptr, err = tree.newNode(kid.node); err != nil {
+				return nil, 0, err
+			}
+		}
+		nodeAppendKV(new, uint16(i), ptr, kid.key, nil)
+	}
+	return new, total, nil
+}
+
+// mergeRangeKids merges every small rewritten kid into a neighbour if the
+// result fits into a page, like shouldMerge does for a single delete
+func mergeRangeKids(tree *BTree, kids []rangeKid) ([]rangeKid, error) {
+	load := func(kid rangeKid) (BNode, error) {
+		if kid.node != nil {
+			return kid.node, nil
+		}
+		return tree.getNode(kid.ptr)
+	}
+
+	for i := 0; i < len(kids); i++ {
+		if kids[i].node == nil || kids[i].node.nbytes() > tree.Config.PageSize/4 {
+			continue
+		}
+		for _, j := range []int{i - 1, i + 1} {
+			if j < 0 || j >= len(kids) {
+				continue
+			}
+			sibling, err := load(kids[j])
+			if err != nil {
+				return nil, err
+			}
+			if int(sibling.nbytes())+int(kids[i].node.nbytes())-4 > int(tree.Config.PageSize) { // 4 is HEADER
+				continue
+			}
+
+			left, right := min(i, j), max(i, j)
+			leftNode, err := load(kids[left])
+			if err != nil {
+				return nil, err
+			}
+			rightNode, err := load(kids[right])
+			if err != nil {
+				return nil, err
+			}
+			merged := BNode(make([]byte, tree.Config.PageSize))
+			nodeMerge(merged, leftNode, rightNode)
+			if kids[j].ptr != 0 {
+				tree.delNode(kids[j].ptr)
+			}
+
+			kids[left] = rangeKid{key: kids[left].key, node: merged}
+			kids = append(kids[:right], kids[right+1:]...)
+			i = left - 1 // the merged kid may still be small
+			break
+		}
+	}
+	return kids, nil
+}
+
+// freeSubtree releases every page below and including ptr, along with the
+// overflow chains of its leaves. Returns the number of keys released.
+func freeSubtree(tree *BTree, ptr uint64) (int, error) {
+	node, err := tree.getNode(ptr)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	switch node.btype() {
+	case NodeTypeLeaf:
+		for i := uint16(0); i < node.nkeys(); i++ {
+			assert(len(node.getKey(i)) > 0) // the sentinel is never released
+			if err := leafFree(tree, node, i); err != nil {
+				return 0, err
+			}
+		}
+		count = int(node.nkeys())
+	case NodeTypeInternal:
+		for i := uint16(0); i < node.nkeys(); i++ {
+			n, err := freeSubtree(tree, node.getPtr(i))
+			if err != nil {
+				return 0, err
+			}
+			count += n
+		}
+	default:
+		assert(false) // unknown node type
+	}
+
+	tree.delNode(ptr)
+	return count, nil
+}
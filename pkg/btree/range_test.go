@@ -0,0 +1,147 @@
+package btree
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// rangeKeys lists the keys of a tree in order
+func rangeKeys(t *testing.T, tree *BTree) []string {
+	t.Helper()
+	var keys []string
+	if err := tree.Traverse(func(key, val []byte) {
+		keys = append(keys, string(key))
+	}); err != nil {
+		t.Fatalf("Failed to traverse: %v", err)
+	}
+	return keys
+}
+
+// TestDeleteRange verifies that DeleteRange removes exactly the keys in
+// [start, end) for ranges inside one leaf, across many leaves, at either end
+// and over the whole tree, and releases all pages they used
+func TestDeleteRange(t *testing.T) {
+	const n = 2000
+	tests := []struct {
+		start, end  string
+		first, stop int // removed keys are first <= i < stop
+	}{
+		{"key0100", "key0105", 100, 105},
+		{"key0100", "key1900", 100, 1900},
+		{"", "key0500", 0, 500},
+		{"key1500", "", 1500, n},
+		{"key0999a", "key1000a", 1000, 1001},
+		{"", "", 0, n},
+		{"key5000", "", 0, 0},
+		{"key0050", "key0050", 0, 0},
+	}
+	for _, tt := range tests {
+		mock := NewMockStorage()
+		tree := NewBTree(mock.Get, mock.New, mock.Del)
+		for i := 0; i < n; i++ {
+			if err := tree.Insert([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprintf("value%d", i))); err != nil {
+				t.Fatalf("Failed to insert: %v", err)
+			}
+		}
+
+		count, err := tree.DeleteRange([]byte(tt.start), []byte(tt.end))
+		if err != nil {
+			t.Fatalf("DeleteRange(%q, %q) failed: %v", tt.start, tt.end, err)
+		}
+		if count != tt.stop-tt.first {
+			t.Errorf("DeleteRange(%q, %q): expected %d keys removed, got %d", tt.start, tt.end, tt.stop-tt.first, count)
+		}
+
+		keys := rangeKeys(t, tree)
+		if len(keys) != n-count {
+			t.Errorf("DeleteRange(%q, %q): expected %d keys left, got %d", tt.start, tt.end, n-count, len(keys))
+		}
+		for _, key := range keys {
+			var i int
+			fmt.Sscanf(key, "key%04d", &i)
+			if i >= tt.first && i < tt.stop {
+				t.Errorf("DeleteRange(%q, %q): key %s was not removed", tt.start, tt.end, key)
+			}
+			if val, found, err := tree.Search([]byte(key)); err != nil || !found || string(val) != fmt.Sprintf("value%d", i) {
+				t.Errorf("DeleteRange(%q, %q): lost key %s", tt.start, tt.end, key)
+			}
+		}
+
+		// The remaining keys still fit into about as many pages as inserting them afresh
+		fresh := NewMockStorage()
+		freshTree := NewBTree(fresh.Get, fresh.New, fresh.Del)
+		for _, key := range keys {
+			if err := freshTree.Insert([]byte(key), []byte("value")); err != nil {
+				t.Fatalf("Failed to insert: %v", err)
+			}
+		}
+		if len(mock.pages) > 2*len(fresh.pages)+2 {
+			t.Errorf("DeleteRange(%q, %q): %d pages left for %d keys, a fresh tree needs %d",
+				tt.start, tt.end, len(mock.pages), len(keys), len(fresh.pages))
+		}
+
+		// The tree stays usable
+		if err := tree.Insert([]byte("key0102"), []byte("again")); err != nil {
+			t.Fatalf("Failed to insert after DeleteRange: %v", err)
+		}
+		if val, _, _ := tree.Search([]byte("key0102")); string(val) != "again" {
+			t.Errorf("Expected reinserted key to be found")
+		}
+	}
+}
+
+// TestDeleteRangeReleasesAllPages verifies that deleting every key, including
+// ones with overflow chains, leaves only the root behind
+func TestDeleteRangeReleasesAllPages(t *testing.T) {
+	mock := NewMockStorage()
+	tree := NewBTree(mock.Get, mock.New, mock.Del)
+	for i := 0; i < 500; i++ {
+		val := []byte("small")
+		if i%50 == 0 {
+			val = testValue(3 * overflowCapacity(tree.Config))
+		}
+		if err := tree.Insert([]byte(fmt.Sprintf("key%04d", i)), val); err != nil {
+			t.Fatalf("Failed to insert: %v", err)
+		}
+	}
+
+	count, err := tree.DeleteRange(nil, nil)
+	if err != nil || count != 500 {
+		t.Fatalf("Expected 500 keys removed, got %d, err %v", count, err)
+	}
+	if len(mock.pages) != 1 {
+		t.Errorf("Expected only the root page, found %d pages", len(mock.pages))
+	}
+	if c := tree.NewCursor(); c.First() {
+		t.Errorf("Expected an empty tree, found %s", c.Key())
+	}
+}
+
+// TestDeleteRangeFailure verifies that a failed DeleteRange leaves the tree unchanged
+func TestDeleteRangeFailure(t *testing.T) {
+	mock := NewMockStorage()
+	tree := NewBTree(mock.Get, mock.New, mock.Del)
+	for i := 0; i < 1000; i++ {
+		if err := tree.Insert([]byte(fmt.Sprintf("key%04d", i)), []byte("value")); err != nil {
+			t.Fatalf("Failed to insert: %v", err)
+		}
+	}
+	root, pages := tree.Root, snapshotPages(mock)
+
+	mock.failAt = mock.next + 2
+	if _, err := tree.DeleteRange([]byte("key0100"), []byte("key0900")); !errors.Is(err, errDiskFull) {
+		t.Fatalf("Expected DeleteRange to fail with a full disk, got %v", err)
+	}
+	if tree.Root != root || len(mock.pages) != len(pages) {
+		t.Errorf("Failed DeleteRange changed the tree: root %d -> %d, %d -> %d pages", root, tree.Root, len(pages), len(mock.pages))
+	}
+	for ptr := range pages {
+		if _, ok := mock.pages[ptr]; !ok {
+			t.Errorf("Page %d was released", ptr)
+		}
+	}
+	if keys := rangeKeys(t, tree); len(keys) != 1000 {
+		t.Errorf("Expected 1000 keys, found %d", len(keys))
+	}
+}
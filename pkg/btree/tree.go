@@ -3,6 +3,7 @@ package btree
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 )
 
 // BTree represents a B+ tree structure for efficient key-value storage
@@ -14,16 +15,20 @@ type BTree struct {
 	Root uint64
 
 	// Storage interface callbacks for managing on-disk pages
-	Get func(uint64) []byte // Reads data from a page number
-	New func([]byte) uint64 // Allocates a new page and returns its number
-	Del func(uint64)        // Deallocates a page by its number
+	Get func(uint64) ([]byte, error) // Reads data from a page number
+	New func([]byte) (uint64, error) // Allocates a new page and returns its number
+	Del func(uint64) error           // Deallocates a page by its number
 
 	// Configuration for the B+ tree
 	Config Config
+
+	// Pages allocated and released by the update in progress
+	allocated []uint64
+	released  []uint64
 }
 
 // NewBTree creates a new B+ tree with default configuration
-func NewBTree(get func(uint64) []byte, new func([]byte) uint64, del func(uint64)) *BTree {
+func NewBTree(get func(uint64) ([]byte, error), new func([]byte) (uint64, error), del func(uint64) error) *BTree {
 	return &BTree{
 		Get:    get,
 		New:    new,
@@ -32,6 +37,65 @@ func NewBTree(get func(uint64) []byte, new func([]byte) uint64, del func(uint64)
 	}
 }
 
+// update runs fn as a single modification of the tree
+// Pages are only handed to Del once fn succeeded, so a failed update leaves
+// the tree as it was: the root is restored and the pages fn allocated are
+// released again.
+func (tree *BTree) update(fn func() error) (err error) {
+	root := tree.Root
+	defer func() {
+		pages := tree.released
+		if err != nil {
+			tree.Root = root
+			pages = tree.allocated
+		}
+		tree.allocated, tree.released = nil, nil
+
+		for _, ptr := range pages {
+			if derr := tree.Del(ptr); derr != nil {
+				err = errors.Join(err, derr)
+			}
+		}
+	}()
+	defer recoverAssert(&err)
+
+	return fn()
+}
+
+// getNode reads a node through the Get callback and checks its layout,
+// or only its type with Config.CheckedPages
+func (tree *BTree) getNode(ptr uint64) (BNode, error) {
+	data, err := tree.Get(ptr)
+	if err != nil {
+		return nil, err
+	}
+	node := BNode(data)
+	if tree.Config.CheckedPages {
+		if len(node) < headerSize || (node.btype() != NodeTypeInternal && node.btype() != NodeTypeLeaf) {
+			return nil, ErrCorruptNode
+		}
+	} else if !node.valid() {
+		return nil, ErrCorruptNode
+	}
+	return node, nil
+}
+
+// newNode stores a node through the New callback and remembers the page
+// in case the update fails
+func (tree *BTree) newNode(node BNode) (uint64, error) {
+	ptr, err := tree.New(node)
+	if err != nil {
+		return 0, err
+	}
+	tree.allocated = append(tree.allocated, ptr)
+	return ptr, nil
+}
+
+// delNode marks a page as no longer used, Del is called once the update succeeds
+func (tree *BTree) delNode(ptr uint64) {
+	tree.released = append(tree.released, ptr)
+}
+
 // nodeAppendKV appends a key-value pair to a node at the specified index
 // Parameters:
 // - new: target node to append to
@@ -68,20 +132,21 @@ func nodeAppendRange(new BNode, old BNode, dstNew uint16, srcOld uint16, n uint1
 }
 
 // leafInsert inserts a new key-value pair into a leaf node
-// Creates a new node with the inserted pair at the specified position
-func leafInsert(new BNode, old BNode, idx uint16, key []byte, val []byte) {
+// Creates a new node with the inserted pair at the specified position,
+// ptr is the first overflow page of the value or 0 for an inline value
+func leafInsert(new BNode, old BNode, idx uint16, ptr uint64, key []byte, val []byte) {
 	new.setHeader(NodeTypeLeaf, old.nkeys()+1)
 	nodeAppendRange(new, old, 0, 0, idx)                   // copy the keys before 'idx'
-	nodeAppendKV(new, idx, 0, key, val)                    // the new key
+	nodeAppendKV(new, idx, ptr, key, val)                  // the new key
 	nodeAppendRange(new, old, idx+1, idx, old.nkeys()-idx) // keys from 'idx'
 }
 
 // leafUpdate updates an existing key's value in a leaf node
-// Creates a new node with the updated value
-func leafUpdate(new BNode, old BNode, idx uint16, key []byte, val []byte) {
+// Creates a new node with the updated value, ptr as in leafInsert
+func leafUpdate(new BNode, old BNode, idx uint16, ptr uint64, key []byte, val []byte) {
 	new.setHeader(NodeTypeLeaf, old.nkeys())
 	nodeAppendRange(new, old, 0, 0, idx)
-	nodeAppendKV(new, idx, 0, key, val)
+	nodeAppendKV(new, idx, ptr, key, val)
 	nodeAppendRange(new, old, idx+1, idx+1, old.nkeys()-(idx+1))
 }
 
@@ -147,7 +212,7 @@ func nodeSplit3(old BNode, cfg Config) (uint16, [3]BNode) {
 		return 1, [3]BNode{old} // not split
 	}
 
-	left := BNode(make([]byte, 2*cfg.PageSize)) // might be split later
+	left := BNode(make([]byte, 2*int(cfg.PageSize))) // might be split later
 	right := BNode(make([]byte, cfg.PageSize))
 	nodeSplit2(left, right, old, cfg)
 
@@ -165,16 +230,17 @@ func nodeSplit3(old BNode, cfg Config) (uint16, [3]BNode) {
 }
 
 // treeInsert handles recursive insertion into the B+ tree
+// ptr is the first overflow page of the value or 0 for an inline value
 // Returns the modified node after insertion
-func treeInsert(tree *BTree, node BNode, key []byte, val []byte) BNode {
+func treeInsert(tree *BTree, node BNode, ptr uint64, key []byte, val []byte) (BNode, error) {
 	// The extra size allows it to exceed 1 page temporarily
-	new := BNode(make([]byte, 2*tree.Config.PageSize))
+	new := BNode(make([]byte, 2*int(tree.Config.PageSize)))
 
 	// Handle empty node case
 	if len(node) == 0 {
 		new.setHeader(NodeTypeLeaf, 1)
 		nodeAppendKV(new, 0, 0, key, val)
-		return new
+		return new, nil
 	}
 
 	// where to insert the key
@@ -184,142 +250,264 @@ func treeInsert(tree *BTree, node BNode, key []byte, val []byte) BNode {
 	case NodeTypeLeaf: // leaf node
 		if idx == 0xFFFF {
 			// No suitable position found, insert at the beginning
-			leafInsert(new, node, 0, key, val)
+			leafInsert(new, node, 0, ptr, key, val)
 		} else if bytes.Equal(key, node.getKey(idx)) {
-			leafUpdate(new, node, idx, key, val) // found, update it
+			// found, release the old overflow chain and update it
+			if err := leafFree(tree, node, idx); err != nil {
+				return nil, err
+			}
+			leafUpdate(new, node, idx, ptr, key, val)
 		} else {
-			leafInsert(new, node, idx+1, key, val) // not found, insert
+			leafInsert(new, node, idx+1, ptr, key, val) // not found, insert
 		}
 
 	case NodeTypeInternal: // internal node, walk into the child node
 		// recursive insertion to the kid node
 		kptr := node.getPtr(idx)
-		kid := tree.Get(kptr)
-		if len(kid) == 0 {
-			// If we get an empty node, treat it as a leaf node
-			leafInsert(new, node, idx+1, key, val)
-		} else {
-			knode := treeInsert(tree, kid, key, val)
+		kid, err := tree.getNode(kptr)
+		if err != nil {
+			return nil, err
+		}
+		knode, err := treeInsert(tree, kid, ptr, key, val)
+		if err != nil {
+			return nil, err
+		}
 
-			// after insertion, split the result
-			nsplit, split := nodeSplit3(knode, tree.Config)
+		// after insertion, split the result
+		nsplit, split := nodeSplit3(knode, tree.Config)
 
-			// deallocate the old kid node
-			tree.Del(kptr)
+		// deallocate the old kid node
+		tree.delNode(kptr)
 
-			// update the kid links
-			nodeReplaceKidN(tree, new, node, idx, split[:nsplit]...)
+		// update the kid links
+		if err := nodeReplaceKidN(tree, new, node, idx, split[:nsplit]...); err != nil {
+			return nil, err
 		}
+
+	default:
+		assert(false) // unknown node type
 	}
 
-	return new
+	return new, nil
 }
 
 // nodeReplaceKidN replaces a child node with multiple nodes (after split)
-func nodeReplaceKidN(tree *BTree, new BNode, old BNode, idx uint16, kids ...BNode) {
+func nodeReplaceKidN(tree *BTree, new BNode, old BNode, idx uint16, kids ...BNode) error {
 	inc := uint16(len(kids))
 
 	new.setHeader(NodeTypeInternal, old.nkeys()+inc-1)
 	nodeAppendRange(new, old, 0, 0, idx)
 
 	for i, node := range kids {
-		nodeAppendKV(new, idx+uint16(i), tree.New(node), node.getKey(0), nil)
+		ptr, err := tree.newNode(node)
+		if err != nil {
+			return err
+		}
+		nodeAppendKV(new, idx+uint16(i), ptr, node.getKey(0), nil)
 	}
 
 	nodeAppendRange(new, old, idx+inc, idx+1, old.nkeys()-(idx+1))
+	return nil
 }
 
 // Insert adds or updates a key-value pair in the tree
-func (tree *BTree) Insert(key []byte, val []byte) {
+// The pair is checked with Config.Validate first, on error the tree is left unchanged
+func (tree *BTree) Insert(key []byte, val []byte) error {
+	if err := tree.Config.Validate(key, val); err != nil {
+		return err
+	}
+	return tree.update(func() error {
+		return treeInsertRoot(tree, key, val)
+	})
+}
+
+// treeInsertRoot inserts into the tree starting at the root and grows
+// the tree by a level if the root is split
+func treeInsertRoot(tree *BTree, key []byte, val []byte) error {
+	// a long value is moved to overflow pages, the leaf keeps a reference
+	var head uint64
+	if len(val) > int(tree.Config.InlineValSize) {
+		var err error
+		if head, val, err = writeOverflow(tree, val); err != nil {
+			return err
+		}
+	}
+
 	if tree.Root == 0 {
 		// create the first node
 		root := BNode(make([]byte, tree.Config.PageSize))
-		root.setHeader(NodeTypeLeaf, 2)
+		root.setHeader(NodeTypeLeaf, 1)
 
 		// a dummy (sentinel) key, this makes the tree cover the whole key space.
 		// thus a lookup can always find a containing node.
+		// the actual key-value pair goes through the regular insertion below,
+		// so a key equal to the sentinel updates it instead of duplicating it.
 		nodeAppendKV(root, 0, 0, nil, nil)
-		// insert the actual key-value pair
-		nodeAppendKV(root, 1, 0, key, val)
-		tree.Root = tree.New(root)
-		return
+		ptr, err := tree.newNode(root)
+		if err != nil {
+			return err
+		}
+		tree.Root = ptr
+	}
+
+	old, err := tree.getNode(tree.Root)
+	if err != nil {
+		return err
+	}
+	node, err := treeInsert(tree, old, head, key, val)
+	if err != nil {
+		return err
 	}
 
-	node := treeInsert(tree, tree.Get(tree.Root), key, val)
 	nsplit, split := nodeSplit3(node, tree.Config)
-	tree.Del(tree.Root)
+	tree.delNode(tree.Root)
 	if nsplit > 1 {
 		// the root was split, add a new level.
 		root := BNode(make([]byte, tree.Config.PageSize))
 		root.setHeader(NodeTypeInternal, nsplit)
 
 		for i, knode := range split[:nsplit] {
-			ptr, key := tree.New(knode), knode.getKey(0)
-			nodeAppendKV(root, uint16(i), ptr, key, nil)
+			ptr, err := tree.newNode(knode)
+			if err != nil {
+				return err
+			}
+			nodeAppendKV(root, uint16(i), ptr, knode.getKey(0), nil)
 		}
+		split[0] = root
+	}
 
-		tree.Root = tree.New(root)
-	} else {
-		tree.Root = tree.New(split[0])
+	ptr, err := tree.newNode(split[0])
+	if err != nil {
+		return err
 	}
+	tree.Root = ptr
+	return nil
 }
 
-func (tree *BTree) Search(key []byte) ([]byte, bool) {
+// Search looks up the value of a key
+// Returns a copy of the value, whether the key was found, and any error
+// reading the nodes or ErrEmptyKey
+func (tree *BTree) Search(key []byte) (val []byte, found bool, err error) {
+	defer recoverAssert(&err)
+
+	if len(key) == 0 {
+		return nil, false, ErrEmptyKey
+	}
 	if tree.Root == 0 {
-		return nil, false
+		return nil, false, nil
+	}
+	node, err := tree.getNode(tree.Root)
+	if err != nil {
+		return nil, false, err
 	}
-	return treeSearch(tree, tree.Get(tree.Root), key)
+	return treeSearch(tree, node, key)
 }
 
-func treeSearch(tree *BTree, node BNode, key []byte) ([]byte, bool) {
+func treeSearch(tree *BTree, node BNode, key []byte) ([]byte, bool, error) {
 	idx := nodeLookupLE(node, key)
 
 	switch node.btype() {
 	case NodeTypeLeaf:
 		if idx < node.nkeys() && bytes.Equal(node.getKey(idx), key) {
-			return node.getVal(idx), true
+			val, err := leafValue(tree, node, idx)
+			if err != nil {
+				return nil, false, err
+			}
+			if node.getPtr(idx) == 0 {
+				// inline values point into the page returned by Get, which may be reused
+				val = bytes.Clone(val)
+			}
+			return val, true, nil
 		}
-		return nil, false
+		return nil, false, nil
 
 	case NodeTypeInternal:
-		return treeSearch(tree, tree.Get(node.getPtr(idx)), key)
+		kid, err := tree.getNode(node.getPtr(idx))
+		if err != nil {
+			return nil, false, err
+		}
+		return treeSearch(tree, kid, key)
 	}
 
-	return nil, false
+	assert(false) // unknown node type
+	return nil, false, nil
 }
 
-func (tree *BTree) Delete(key []byte) {
+// Delete removes a key from the tree
+// Returns whether the key was found, on error (including ErrEmptyKey)
+// the tree is left unchanged
+func (tree *BTree) Delete(key []byte) (bool, error) {
+	if len(key) == 0 {
+		return false, ErrEmptyKey
+	}
+
+	var found bool
+	err := tree.update(func() error {
+		var err error
+		found, err = treeDeleteRoot(tree, key)
+		return err
+	})
+	return found && err == nil, err
+}
+
+// treeDeleteRoot deletes starting at the root and removes a level
+// if the root is left with a single child
+func treeDeleteRoot(tree *BTree, key []byte) (bool, error) {
 	if tree.Root == 0 {
-		return
+		return false, nil
+	}
+	old, err := tree.getNode(tree.Root)
+	if err != nil {
+		return false, err
+	}
+	node, err := treeDelete(tree, old, key)
+	if err != nil || len(node) == 0 {
+		return false, err // not found
 	}
-	node := treeDelete(tree, tree.Get(tree.Root), key)
-	if len(node) > 0 {
-		tree.Root = tree.New(node)
+
+	tree.delNode(tree.Root)
+	if node.btype() == NodeTypeInternal && node.nkeys() == 1 {
+		// the root has a single child, remove a level
+		tree.Root = node.getPtr(0)
+		return true, nil
+	}
+
+	ptr, err := tree.newNode(node)
+	if err != nil {
+		return false, err
 	}
+	tree.Root = ptr
+	return true, nil
 }
 
-func shouldMerge(tree *BTree, node BNode, idx uint16, updated BNode) (int, BNode) {
+func shouldMerge(tree *BTree, node BNode, idx uint16, updated BNode) (int, BNode, error) {
 	if updated.nbytes() > tree.Config.PageSize/4 {
-		return 0, BNode{}
+		return 0, BNode{}, nil
 	}
 
 	if idx > 0 {
-		sibling := BNode(tree.Get(node.getPtr(idx - 1)))
-		merged := sibling.nbytes() + updated.nbytes() - 4 // 4 is HEADER
-		if merged <= tree.Config.PageSize {
-			return -1, sibling // left
+		sibling, err := tree.getNode(node.getPtr(idx - 1))
+		if err != nil {
+			return 0, BNode{}, err
+		}
+		merged := int(sibling.nbytes()) + int(updated.nbytes()) - 4 // 4 is HEADER
+		if merged <= int(tree.Config.PageSize) {
+			return -1, sibling, nil // left
 		}
 	}
 
 	if idx+1 < node.nkeys() {
-		sibling := BNode(tree.Get(node.getPtr(idx + 1)))
-		merged := sibling.nbytes() + updated.nbytes() - 4 // 4 is HEADER
-		if merged <= tree.Config.PageSize {
-			return +1, sibling // right
+		sibling, err := tree.getNode(node.getPtr(idx + 1))
+		if err != nil {
+			return 0, BNode{}, err
+		}
+		merged := int(sibling.nbytes()) + int(updated.nbytes()) - 4 // 4 is HEADER
+		if merged <= int(tree.Config.PageSize) {
+			return +1, sibling, nil // right
 		}
 	}
 
-	return 0, BNode{}
+	return 0, BNode{}, nil
 }
 
 func nodeMerge(dest BNode, left BNode, right BNode) {
@@ -332,86 +520,128 @@ func nodeReplace2Kid(new BNode, old BNode, idx uint16, ptr uint64, key []byte) {
 	new.setHeader(NodeTypeInternal, old.nkeys()-1)
 	nodeAppendRange(new, old, 0, 0, idx)
 	nodeAppendKV(new, idx, ptr, key, nil)
-	nodeAppendRange(new, old, idx+1, idx+2, old.nkeys()-(idx+1))
+	nodeAppendRange(new, old, idx+1, idx+2, old.nkeys()-(idx+2))
 }
 
-func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) BNode {
+func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) (BNode, error) {
 	// recurse into the kid
 	kptr := node.getPtr(idx)
-	updated := treeDelete(tree, tree.Get(kptr), key)
-	if len(updated) == 0 {
-		return BNode{} // not found
+	kid, err := tree.getNode(kptr)
+	if err != nil {
+		return nil, err
+	}
+	updated, err := treeDelete(tree, kid, key)
+	if err != nil || len(updated) == 0 {
+		return BNode{}, err // not found
 	}
-	tree.Del(kptr)
+	tree.delNode(kptr)
 
 	new := BNode(make([]byte, tree.Config.PageSize))
 	// check for merging
-	mergeDir, sibling := shouldMerge(tree, node, idx, updated)
+	mergeDir, sibling, err := shouldMerge(tree, node, idx, updated)
+	if err != nil {
+		return nil, err
+	}
 	switch {
 	case mergeDir < 0: // left
 		merged := BNode(make([]byte, tree.Config.PageSize))
 		nodeMerge(merged, sibling, updated)
-		tree.Del(node.getPtr(idx - 1))
-		nodeReplace2Kid(new, node, idx-1, tree.New(merged), merged.getKey(0))
+		tree.delNode(node.getPtr(idx - 1))
+		ptr, err := tree.newNode(merged)
+		if err != nil {
+			return nil, err
+		}
+		nodeReplace2Kid(new, node, idx-1, ptr, merged.getKey(0))
 
 	case mergeDir > 0: // right
 		merged := BNode(make([]byte, tree.Config.PageSize))
 		nodeMerge(merged, updated, sibling)
-		tree.Del(node.getPtr(idx + 1))
-		nodeReplace2Kid(new, node, idx, tree.New(merged), merged.getKey(0))
+		tree.delNode(node.getPtr(idx + 1))
+		ptr, err := tree.newNode(merged)
+		if err != nil {
+			return nil, err
+		}
+		nodeReplace2Kid(new, node, idx, ptr, merged.getKey(0))
 
 	case mergeDir == 0 && updated.nkeys() == 0:
 		assert(node.nkeys() == 1 && idx == 0) // 1 empty child but no sibling
 		new.setHeader(NodeTypeInternal, 0)    // the parent becomes empty too
 
 	case mergeDir == 0 && updated.nkeys() > 0: // no merge
-		nodeReplaceKidN(tree, new, node, idx, updated)
+		if err := nodeReplaceKidN(tree, new, node, idx, updated); err != nil {
+			return nil, err
+		}
 	}
 
-	return new
+	return new, nil
 }
 
-func treeDelete(tree *BTree, node BNode, key []byte) BNode {
+func treeDelete(tree *BTree, node BNode, key []byte) (BNode, error) {
 	idx := nodeLookupLE(node, key)
 
 	switch node.btype() {
 	case NodeTypeLeaf:
 		if idx < node.nkeys() && bytes.Equal(node.getKey(idx), key) {
+			if err := leafFree(tree, node, idx); err != nil {
+				return nil, err
+			}
 			new := BNode(make([]byte, tree.Config.PageSize))
 			new.setHeader(NodeTypeLeaf, node.nkeys()-1)
 			nodeAppendRange(new, node, 0, 0, idx)
 			nodeAppendRange(new, node, idx, idx+1, node.nkeys()-idx-1)
-			return new
+			return new, nil
 		}
-		return BNode{}
+		return BNode{}, nil
 
 	case NodeTypeInternal:
-		updated := nodeDelete(tree, node, idx, key)
-		if len(updated) == 0 {
-			return BNode{}
-		}
-		return updated
+		return nodeDelete(tree, node, idx, key)
 	}
 
-	return BNode{}
+	assert(false) // unknown node type
+	return BNode{}, nil
 }
 
-func (tree *BTree) Traverse(visit func(key, val []byte)) {
+// Traverse calls visit for every key-value pair in key order
+// The key and value may point into pages returned by Get and are only valid
+// during the call. Returns the first error reading the nodes.
+func (tree *BTree) Traverse(visit func(key, val []byte)) (err error) {
+	defer recoverAssert(&err)
+
 	if tree.Root == 0 {
-		return
+		return nil
+	}
+	node, err := tree.getNode(tree.Root)
+	if err != nil {
+		return err
 	}
-	treeTraverse(tree, tree.Get(tree.Root), visit)
+	return treeTraverse(tree, node, visit)
 }
 
-func treeTraverse(tree *BTree, node BNode, visit func(key, val []byte)) {
+func treeTraverse(tree *BTree, node BNode, visit func(key, val []byte)) error {
 	switch node.btype() {
 	case NodeTypeLeaf:
-		for i := uint16(1); i < node.nkeys(); i++ {
-			visit(node.getKey(i), node.getVal(i))
+		for i := uint16(0); i < node.nkeys(); i++ {
+			if len(node.getKey(i)) == 0 {
+				continue // the sentinel, keys are never empty otherwise
+			}
+			val, err := leafValue(tree, node, i)
+			if err != nil {
+				return err
+			}
+			visit(node.getKey(i), val)
 		}
 	case NodeTypeInternal:
 		for i := uint16(0); i < node.nkeys(); i++ {
-			treeTraverse(tree, tree.Get(node.getPtr(i)), visit)
+			kid, err := tree.getNode(node.getPtr(i))
+			if err != nil {
+				return err
+			}
+			if err := treeTraverse(tree, kid, visit); err != nil {
+				return err
+			}
 		}
+	default:
+		assert(false) // unknown node type
 	}
+	return nil
 }
@@ -2,6 +2,8 @@ package btree
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"strings"
 	"sync"
@@ -11,10 +13,15 @@ import (
 // MockStorage provides an in-memory storage implementation for testing.
 // It simulates a disk storage system by maintaining a map of page numbers to their contents.
 type MockStorage struct {
-	pages map[uint64][]byte // Maps page numbers to their contents
-	mu    sync.RWMutex      // Protects concurrent access to pages
+	pages  map[uint64][]byte // Maps page numbers to their contents
+	next   uint64            // Last allocated page number
+	failAt uint64            // New fails instead of allocating this page number (0 never fails)
+	mu     sync.RWMutex      // Protects concurrent access to pages
 }
 
+// errDiskFull is returned by the mock storage once it runs out of pages
+var errDiskFull = errors.New("disk full")
+
 // NewMockStorage creates a new mock storage instance with an empty page map.
 // This is used to simulate a fresh disk storage system.
 func NewMockStorage() *MockStorage {
@@ -24,30 +31,42 @@ func NewMockStorage() *MockStorage {
 }
 
 // Get retrieves the contents of a page by its number.
-// Returns nil if the page doesn't exist.
-func (m *MockStorage) Get(ptr uint64) []byte {
+// Returns an error if the page doesn't exist.
+func (m *MockStorage) Get(ptr uint64) ([]byte, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-	return m.pages[ptr]
+	page, ok := m.pages[ptr]
+	if !ok {
+		return nil, fmt.Errorf("page %d not found", ptr)
+	}
+	return page, nil
 }
 
 // New allocates a new page and stores the provided data.
-// Returns the new page number (1-based index).
-func (m *MockStorage) New(node []byte) uint64 {
+// Returns the new page number (1-based, never reused).
+func (m *MockStorage) New(node []byte) (uint64, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	ptr := uint64(len(m.pages) + 1)
+	if m.next+1 == m.failAt {
+		return 0, errDiskFull
+	}
+	m.next++
+	ptr := m.next
 	m.pages[ptr] = make([]byte, len(node))
 	copy(m.pages[ptr], node)
-	return ptr
+	return ptr, nil
 }
 
 // Del removes a page from storage by its number.
 // This simulates deallocating a page on disk.
-func (m *MockStorage) Del(ptr uint64) {
+func (m *MockStorage) Del(ptr uint64) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	if _, ok := m.pages[ptr]; !ok {
+		return fmt.Errorf("page %d freed twice", ptr)
+	}
 	delete(m.pages, ptr)
+	return nil
 }
 
 // NewTestTree creates a new BTree instance with mock storage for testing.
@@ -65,7 +84,7 @@ func TestInsertAndSearch(t *testing.T) {
 	tree := NewTestTree()
 
 	// Verify that searching in an empty tree returns false
-	if _, found := tree.Search([]byte("key")); found {
+	if _, found, _ := tree.Search([]byte("key")); found {
 		t.Error("Empty tree should not find any keys")
 	}
 
@@ -75,14 +94,14 @@ func TestInsertAndSearch(t *testing.T) {
 	tree.Insert(key, value)
 
 	// Verify the inserted key can be found with correct value
-	if val, found := tree.Search(key); !found {
+	if val, found, _ := tree.Search(key); !found {
 		t.Error("Failed to find inserted key")
 	} else if !bytes.Equal(val, value) {
 		t.Errorf("Expected value %s, got %s", value, val)
 	}
 
 	// Verify that searching for a non-existent key returns false
-	if _, found := tree.Search([]byte("nonexistent")); found {
+	if _, found, _ := tree.Search([]byte("nonexistent")); found {
 		t.Error("Should not find non-existent key")
 	}
 }
@@ -106,7 +125,7 @@ func TestMultipleInsertions(t *testing.T) {
 
 	// Verify that all pairs can be retrieved with correct values
 	for k, v := range pairs {
-		if val, found := tree.Search([]byte(k)); !found {
+		if val, found, _ := tree.Search([]byte(k)); !found {
 			t.Errorf("Failed to find key %s", k)
 		} else if !bytes.Equal(val, []byte(v)) {
 			t.Errorf("Expected value %s for key %s, got %s", v, k, val)
@@ -131,7 +150,7 @@ func TestUpdateExistingKey(t *testing.T) {
 	tree.Insert(key, newValue)
 
 	// Verify that the value was updated correctly
-	if val, found := tree.Search(key); !found {
+	if val, found, _ := tree.Search(key); !found {
 		t.Error("Failed to find updated key")
 	} else if !bytes.Equal(val, newValue) {
 		t.Errorf("Expected updated value %s, got %s", newValue, val)
@@ -154,7 +173,7 @@ func TestDelete(t *testing.T) {
 	tree.Delete(key)
 
 	// Verify the key is no longer in the tree
-	if _, found := tree.Search(key); found {
+	if _, found, _ := tree.Search(key); found {
 		t.Error("Deleted key should not be found")
 	}
 }
@@ -180,6 +199,255 @@ func TestDeleteNonExistentKey(t *testing.T) {
 	}
 }
 
+// TestDeleteReleasesPages verifies that deleting keys hands every page
+// that is no longer referenced back to the Del callback:
+// 1. Grow the tree to several levels
+// 2. Delete all keys again
+// 3. Verify only the root page is still allocated
+func TestDeleteReleasesPages(t *testing.T) {
+	mock := NewMockStorage()
+	tree := NewBTree(mock.Get, mock.New, mock.Del)
+
+	const numPairs = 2000
+	for i := 0; i < numPairs; i++ {
+		tree.Insert([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i)))
+	}
+	for i := 0; i < numPairs; i++ {
+		tree.Delete([]byte(fmt.Sprintf("key%d", i)))
+	}
+
+	if len(mock.pages) != 1 {
+		t.Errorf("Expected only the root page to remain, found %d pages", len(mock.pages))
+	}
+	if _, ok := mock.pages[tree.Root]; !ok {
+		t.Error("Root page is not allocated")
+	}
+}
+
+// snapshotPages copies the set of allocated page numbers
+func snapshotPages(mock *MockStorage) map[uint64]bool {
+	pages := make(map[uint64]bool, len(mock.pages))
+	for ptr := range mock.pages {
+		pages[ptr] = true
+	}
+	return pages
+}
+
+// TestFailedUpdateLeavesTreeUnchanged verifies that when New fails in the
+// middle of an update:
+// 1. Insert and Delete return the error
+// 2. The root and the set of allocated pages are the same as before
+// 3. All keys are still readable and later updates succeed
+func TestFailedUpdateLeavesTreeUnchanged(t *testing.T) {
+	mock := NewMockStorage()
+	tree := NewBTree(mock.Get, mock.New, mock.Del)
+
+	const numPairs = 1000
+	for i := 0; i < numPairs; i++ {
+		if err := tree.Insert([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatalf("Failed to insert: %v", err)
+		}
+	}
+
+	checkUnchanged := func(op string, root uint64, pages map[uint64]bool) {
+		t.Helper()
+		if tree.Root != root {
+			t.Errorf("%s: root changed from %d to %d", op, root, tree.Root)
+		}
+		if len(mock.pages) != len(pages) {
+			t.Errorf("%s: expected %d pages, found %d", op, len(pages), len(mock.pages))
+		}
+		for ptr := range mock.pages {
+			if !pages[ptr] {
+				t.Errorf("%s: page %d leaked", op, ptr)
+			}
+		}
+		for i := 0; i < numPairs; i++ {
+			key := []byte(fmt.Sprintf("key%d", i))
+			if _, found, err := tree.Search(key); err != nil || !found {
+				t.Fatalf("%s: key %s lost: found %v, err %v", op, key, found, err)
+			}
+		}
+	}
+
+	// Let the updates fail after each possible number of allocations,
+	// an update of the two-level tree allocates a leaf and a new root
+	for allowed := uint64(0); allowed < 2; allowed++ {
+		root, pages := tree.Root, snapshotPages(mock)
+		mock.failAt = mock.next + allowed + 1
+		if err := tree.Insert([]byte("new"), []byte("value")); !errors.Is(err, errDiskFull) {
+			t.Fatalf("Expected insert to fail with a full disk, got %v", err)
+		}
+		checkUnchanged("insert", root, pages)
+
+		mock.failAt = mock.next + allowed + 1
+		if _, err := tree.Delete([]byte("key500")); !errors.Is(err, errDiskFull) {
+			t.Fatalf("Expected delete to fail with a full disk, got %v", err)
+		}
+		checkUnchanged("delete", root, pages)
+	}
+
+	mock.failAt = 0
+	if err := tree.Insert([]byte("new"), []byte("value")); err != nil {
+		t.Fatalf("Failed to insert after the disk was freed: %v", err)
+	}
+	if found, err := tree.Delete([]byte("key500")); err != nil || !found {
+		t.Fatalf("Failed to delete after the disk was freed: found %v, err %v", found, err)
+	}
+}
+
+// TestCorruptNodeReturnsError verifies that a page that does not hold a valid
+// node is reported as ErrCorruptNode instead of panicking
+func TestCorruptNodeReturnsError(t *testing.T) {
+	mock := NewMockStorage()
+	tree := NewBTree(mock.Get, mock.New, mock.Del)
+	if err := tree.Insert([]byte("key"), []byte("value")); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+
+	// An unknown node type with a key count past the end of the page
+	garbage := bytes.Repeat([]byte{0xFF}, int(tree.Config.PageSize))
+	copy(mock.pages[tree.Root], garbage)
+
+	if _, _, err := tree.Search([]byte("key")); !errors.Is(err, ErrCorruptNode) {
+		t.Errorf("Expected ErrCorruptNode from Search, got %v", err)
+	}
+	if err := tree.Insert([]byte("key"), []byte("value")); !errors.Is(err, ErrCorruptNode) {
+		t.Errorf("Expected ErrCorruptNode from Insert, got %v", err)
+	}
+	if _, err := tree.Delete([]byte("key")); !errors.Is(err, ErrCorruptNode) {
+		t.Errorf("Expected ErrCorruptNode from Delete, got %v", err)
+	}
+	if err := tree.Traverse(func(key, val []byte) {}); !errors.Is(err, ErrCorruptNode) {
+		t.Errorf("Expected ErrCorruptNode from Traverse, got %v", err)
+	}
+}
+
+// TestCheckPage verifies that
+// 1. CheckPage accepts the nodes and overflow pages the tree writes
+// 2. CheckPage rejects a node whose layout reaches past the page
+// 3. A tree with Config.CheckedPages still rejects a page that is not a node
+func TestCheckPage(t *testing.T) {
+	mock := NewMockStorage()
+	tree := NewBTree(mock.Get, mock.New, mock.Del)
+	tree.Config.CheckedPages = true
+	for i := 0; i < 200; i++ {
+		if err := tree.Insert([]byte(fmt.Sprintf("key%03d", i)), []byte("value")); err != nil {
+			t.Fatalf("Failed to insert: %v", err)
+		}
+	}
+	if err := tree.Insert([]byte("large"), bytes.Repeat([]byte("x"), int(tree.Config.InlineValSize)+1)); err != nil {
+		t.Fatalf("Failed to insert a large value: %v", err)
+	}
+	for ptr, page := range mock.pages {
+		if err := CheckPage(page); err != nil {
+			t.Errorf("Expected page %d to pass, got %v", ptr, err)
+		}
+	}
+
+	// A leaf claiming more keys than fit into the page
+	node := BNode(mock.pages[tree.Root])
+	binary.LittleEndian.PutUint16(node[2:4], 0xFFFF)
+	if err := CheckPage(node); !errors.Is(err, ErrCorruptNode) {
+		t.Errorf("Expected ErrCorruptNode from CheckPage, got %v", err)
+	}
+
+	copy(mock.pages[tree.Root], bytes.Repeat([]byte{0xFF}, int(tree.Config.PageSize)))
+	if _, _, err := tree.Search([]byte("key000")); !errors.Is(err, ErrCorruptNode) {
+		t.Errorf("Expected ErrCorruptNode from Search, got %v", err)
+	}
+}
+
+// TestKeyValueLimits verifies that Insert
+// 1. Accepts keys and values right at Config.MaxKeySize and Config.MaxValSize
+// 2. Rejects empty keys and anything over the limits with typed errors
+// 3. Leaves the tree unchanged when rejecting a pair
+func TestKeyValueLimits(t *testing.T) {
+	tree := NewTestTree()
+	cfg := tree.Config
+
+	maxKey := bytes.Repeat([]byte("k"), int(cfg.MaxKeySize))
+	maxVal := bytes.Repeat([]byte("v"), int(cfg.MaxValSize))
+	if err := tree.Insert(maxKey, maxVal); err != nil {
+		t.Fatalf("Failed to insert pair at the limits: %v", err)
+	}
+	if err := tree.Insert([]byte("empty value"), nil); err != nil {
+		t.Fatalf("Failed to insert empty value: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		key  []byte
+		val  []byte
+		err  error
+	}{
+		{"nil key", nil, []byte("value"), ErrEmptyKey},
+		{"empty key", []byte{}, []byte("value"), ErrEmptyKey},
+		{"key over limit", append(maxKey, 'k'), []byte("value"), ErrKeyTooLarge},
+		{"value over limit", []byte("key"), append(maxVal, 'v'), ErrValueTooLarge},
+		{"key over uint16", make([]byte, 1<<16), nil, ErrKeyTooLarge},
+	}
+
+	root := tree.Root
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tree.Insert(tt.key, tt.val); !errors.Is(err, tt.err) {
+				t.Errorf("Expected %v, got %v", tt.err, err)
+			}
+			if tree.Root != root {
+				t.Error("Rejected insert changed the tree")
+			}
+		})
+	}
+
+	if _, _, err := tree.Search(nil); !errors.Is(err, ErrEmptyKey) {
+		t.Errorf("Expected ErrEmptyKey from Search, got %v", err)
+	}
+	if _, err := tree.Delete(nil); !errors.Is(err, ErrEmptyKey) {
+		t.Errorf("Expected ErrEmptyKey from Delete, got %v", err)
+	}
+	if val, found, err := tree.Search(maxKey); err != nil || !found || !bytes.Equal(val, maxVal) {
+		t.Errorf("Pair at the limits not found: found %v, err %v", found, err)
+	}
+}
+
+// TestMaxPageSize verifies that a tree with the largest supported page
+// stores keys and inline values of the maximum size, whose nodes outgrow
+// the page by almost a whole entry before they are split
+func TestMaxPageSize(t *testing.T) {
+	tree := NewTestTree()
+	tree.Config.PageSize = uint16(tree.Config.MaxPageSize())
+
+	value := func(i int) []byte {
+		return bytes.Repeat([]byte{byte(i)}, int(tree.Config.InlineValSize))
+	}
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("%04d%s", i, strings.Repeat("k", int(tree.Config.MaxKeySize)-4)))
+	}
+
+	const n = 500
+	for i := 0; i < n; i++ {
+		if err := tree.Insert(key(i*7%n), value(i*7%n)); err != nil {
+			t.Fatalf("Failed to insert key %d: %v", i*7%n, err)
+		}
+	}
+	for i := 0; i < n; i++ {
+		if val, found, err := tree.Search(key(i)); err != nil || !found || !bytes.Equal(val, value(i)) {
+			t.Fatalf("Failed to find key %d: found %v, err %v", i, found, err)
+		}
+	}
+	for i := 0; i < n; i += 2 {
+		if _, err := tree.Delete(key(i)); err != nil {
+			t.Fatalf("Failed to delete key %d: %v", i, err)
+		}
+	}
+
+	count := 0
+	if err := tree.Traverse(func(key, value []byte) { count++ }); err != nil || count != n/2 {
+		t.Errorf("Expected %d pairs, got %d, err %v", n/2, count, err)
+	}
+}
+
 // TestTraverse verifies the tree traversal functionality:
 // 1. Correctly visits all key-value pairs
 // 2. Maintains proper ordering
@@ -481,7 +749,7 @@ func TestLargeDataset(t *testing.T) {
 	for i := 0; i < numPairs; i++ {
 		key := []byte(fmt.Sprintf("key%d", i))
 		expectedValue := []byte(fmt.Sprintf("value%d", i))
-		if val, found := tree.Search(key); !found {
+		if val, found, _ := tree.Search(key); !found {
 			t.Errorf("Failed to find key %s", key)
 		} else if !bytes.Equal(val, expectedValue) {
 			t.Errorf("Expected value %s for key %s, got %s", expectedValue, key, val)
@@ -523,7 +791,7 @@ func TestConcurrentOperations(t *testing.T) {
 		for j := 0; j < numOperations; j++ {
 			key := []byte(fmt.Sprintf("key%d_%d", i, j))
 			expectedValue := []byte(fmt.Sprintf("value%d_%d", i, j))
-			if val, found := tree.Search(key); !found {
+			if val, found, _ := tree.Search(key); !found {
 				t.Errorf("Failed to find key %s", key)
 			} else if !bytes.Equal(val, expectedValue) {
 				t.Errorf("Expected value %s for key %s, got %s", expectedValue, key, val)
@@ -544,7 +812,7 @@ func TestEdgeCases(t *testing.T) {
 
 	// Test empty key
 	tree.Insert([]byte{}, []byte("empty"))
-	if val, found := tree.Search([]byte{}); !found {
+	if val, found, _ := tree.Search([]byte{}); !found {
 		t.Error("Failed to find empty key")
 	} else if !bytes.Equal(val, []byte("empty")) {
 		t.Error("Wrong value for empty key")
@@ -554,7 +822,7 @@ func TestEdgeCases(t *testing.T) {
 	longKey := bytes.Repeat([]byte("x"), BTREE_MAX_KEY_SIZE)
 	longValue := bytes.Repeat([]byte("y"), BTREE_MAX_VAL_SIZE)
 	tree.Insert(longKey, longValue)
-	if val, found := tree.Search(longKey); !found {
+	if val, found, _ := tree.Search(longKey); !found {
 		t.Error("Failed to find long key")
 	} else if !bytes.Equal(val, longValue) {
 		t.Error("Wrong value for long key")
@@ -563,7 +831,7 @@ func TestEdgeCases(t *testing.T) {
 	// Test special characters in key
 	specialKey := []byte("!@#$%^&*()")
 	tree.Insert(specialKey, []byte("special"))
-	if val, found := tree.Search(specialKey); !found {
+	if val, found, _ := tree.Search(specialKey); !found {
 		t.Error("Failed to find special key")
 	} else if !bytes.Equal(val, []byte("special")) {
 		t.Error("Wrong value for special key")
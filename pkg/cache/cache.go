@@ -0,0 +1,125 @@
+// Package cache implements a page cache with LRU eviction and a byte budget
+// It keeps recently used pages in memory, so hot pages such as the nodes near
+// the root of the B+ tree are not read and verified again on every access
+package cache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Stats reports how well the cache is doing
+type Stats struct {
+	Hits      uint64 // Lookups answered from the cache
+	Misses    uint64 // Lookups that had to go to storage
+	Evictions uint64 // Pages dropped to stay within the budget
+	Pages     int    // Number of cached pages
+	Bytes     int64  // Total size of the cached pages
+}
+
+// entry is a cached page, stored as the value of an LRU list element
+type entry struct {
+	ptr  uint64 // Page number
+	page []byte // Page contents
+}
+
+// Cache maps page numbers to page contents
+// The least recently used pages are evicted once the budget is exceeded.
+// All methods are safe for concurrent use.
+type Cache struct {
+	mu     sync.Mutex
+	budget int64                    // Maximum total size of the cached pages
+	items  map[uint64]*list.Element // Page number -> element in lru
+	lru    *list.List               // Most recently used page first
+	stats  Stats                    // Counters and current usage
+}
+
+// New creates a cache that holds up to budget bytes of pages
+// A budget of zero or less disables caching, every lookup misses
+func New(budget int64) *Cache {
+	return &Cache{
+		budget: budget,
+		items:  make(map[uint64]*list.Element),
+		lru:    list.New(),
+	}
+}
+
+// Get returns the cached contents of a page
+// The returned slice is shared with the cache and must not be modified
+func (c *Cache) Get(ptr uint64) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[ptr]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*entry).page, true
+}
+
+// Put caches the contents of a page, replacing any previous contents
+// The cache keeps a reference to page, it must not be modified afterwards.
+// Pages larger than the whole budget are not cached.
+func (c *Cache) Put(ptr uint64, page []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.remove(ptr)
+	if int64(len(page)) > c.budget {
+		return
+	}
+
+	c.items[ptr] = c.lru.PushFront(&entry{ptr: ptr, page: page})
+	c.stats.Pages++
+	c.stats.Bytes += int64(len(page))
+
+	for c.stats.Bytes > c.budget {
+		oldest := c.lru.Back().Value.(*entry)
+		c.remove(oldest.ptr)
+		c.stats.Evictions++
+	}
+}
+
+// Invalidate drops a page from the cache
+// It must be called whenever a page is freed or overwritten
+func (c *Cache) Invalidate(ptr uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.remove(ptr)
+}
+
+// Clear drops every cached page, the counters are kept
+// It must be called when the pages of the whole file are replaced
+func (c *Cache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	clear(c.items)
+	c.lru.Init()
+	c.stats.Pages = 0
+	c.stats.Bytes = 0
+}
+
+// Stats returns the current counters and usage
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.stats
+}
+
+// remove drops a page if it is cached, c.mu must be held
+func (c *Cache) remove(ptr uint64) {
+	elem, ok := c.items[ptr]
+	if !ok {
+		return
+	}
+	c.lru.Remove(elem)
+	delete(c.items, ptr)
+	c.stats.Pages--
+	c.stats.Bytes -= int64(len(elem.Value.(*entry).page))
+}
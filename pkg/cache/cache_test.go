@@ -0,0 +1,160 @@
+package cache
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+)
+
+// testPage returns a page of the given size filled with a byte derived from ptr
+func testPage(ptr uint64, size int) []byte {
+	return bytes.Repeat([]byte{byte(ptr)}, size)
+}
+
+// TestGetPut verifies that cached pages are returned and counted
+// 1. A lookup before Put misses
+// 2. A lookup after Put hits and returns the page
+// 3. Put replaces the contents of a cached page
+func TestGetPut(t *testing.T) {
+	c := New(1 << 20)
+
+	if _, ok := c.Get(1); ok {
+		t.Fatalf("Expected a miss for an empty cache")
+	}
+	c.Put(1, testPage(1, 100))
+	page, ok := c.Get(1)
+	if !ok || !bytes.Equal(page, testPage(1, 100)) {
+		t.Fatalf("Failed to get cached page: found %v", ok)
+	}
+
+	c.Put(1, testPage(2, 50))
+	if page, _ := c.Get(1); !bytes.Equal(page, testPage(2, 50)) {
+		t.Errorf("Expected the replaced contents")
+	}
+
+	stats := c.Stats()
+	if stats.Hits != 2 || stats.Misses != 1 || stats.Pages != 1 || stats.Bytes != 50 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+// TestEviction verifies that the least recently used pages are evicted first
+// and that the budget is never exceeded
+func TestEviction(t *testing.T) {
+	c := New(400)
+	for ptr := uint64(1); ptr <= 4; ptr++ {
+		c.Put(ptr, testPage(ptr, 100))
+	}
+
+	// Touch page 1, page 2 becomes the least recently used one
+	c.Get(1)
+	c.Put(5, testPage(5, 100))
+
+	if _, ok := c.Get(2); ok {
+		t.Errorf("Expected page 2 to be evicted")
+	}
+	for _, ptr := range []uint64{1, 3, 4, 5} {
+		if _, ok := c.Get(ptr); !ok {
+			t.Errorf("Expected page %d to be cached", ptr)
+		}
+	}
+
+	stats := c.Stats()
+	if stats.Evictions != 1 || stats.Bytes != 400 || stats.Pages != 4 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+
+	// A page larger than the budget is not cached and does not flush the cache
+	c.Put(6, testPage(6, 500))
+	if _, ok := c.Get(6); ok {
+		t.Errorf("Expected oversized page not to be cached")
+	}
+	if stats := c.Stats(); stats.Pages != 4 {
+		t.Errorf("Expected 4 cached pages, found %d", stats.Pages)
+	}
+}
+
+// TestInvalidate verifies that invalidated pages are no longer returned
+func TestInvalidate(t *testing.T) {
+	c := New(1 << 20)
+	c.Put(1, testPage(1, 100))
+	c.Put(2, testPage(2, 100))
+
+	c.Invalidate(1)
+	c.Invalidate(3) // not cached, nothing happens
+
+	if _, ok := c.Get(1); ok {
+		t.Errorf("Expected page 1 to be invalidated")
+	}
+	if _, ok := c.Get(2); !ok {
+		t.Errorf("Expected page 2 to stay cached")
+	}
+	if stats := c.Stats(); stats.Pages != 1 || stats.Bytes != 100 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+// TestClear verifies that Clear drops every page but keeps the counters
+func TestClear(t *testing.T) {
+	c := New(1 << 20)
+	c.Put(1, testPage(1, 100))
+	c.Put(2, testPage(2, 100))
+	c.Get(1)
+
+	c.Clear()
+	if _, ok := c.Get(1); ok {
+		t.Errorf("Expected page 1 to be dropped")
+	}
+	if stats := c.Stats(); stats.Pages != 0 || stats.Bytes != 0 || stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+
+	// The cache is usable afterwards
+	c.Put(3, testPage(3, 100))
+	if _, ok := c.Get(3); !ok {
+		t.Errorf("Expected page 3 to be cached")
+	}
+}
+
+// TestDisabled verifies that a cache without a budget never holds pages
+func TestDisabled(t *testing.T) {
+	c := New(-1)
+	c.Put(1, testPage(1, 100))
+	if _, ok := c.Get(1); ok {
+		t.Errorf("Expected a disabled cache to miss")
+	}
+	if stats := c.Stats(); stats.Pages != 0 || stats.Misses != 1 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+// TestConcurrentAccess verifies that the cache can be used from many goroutines
+func TestConcurrentAccess(t *testing.T) {
+	c := New(64 * 100)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				ptr := uint64((g*31 + i) % 128)
+				if page, ok := c.Get(ptr); ok {
+					if !bytes.Equal(page, testPage(ptr, 100)) {
+						t.Errorf("Wrong contents for page %d", ptr)
+					}
+					continue
+				}
+				if i%7 == 0 {
+					c.Invalidate(ptr)
+				} else {
+					c.Put(ptr, testPage(ptr, 100))
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if stats := c.Stats(); stats.Bytes > 64*100 || stats.Hits+stats.Misses != 8000 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
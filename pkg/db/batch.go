@@ -0,0 +1,166 @@
+package db
+
+import (
+	"build-your-own-database/pkg/wal"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+/*
+Batch Layout:
+
+A batch is logged as a single wal.RecordBatch record whose value holds the
+mutations back to back, in the order they were added:
+
++----------------+----------------+----------------+-----------+-------------+
+| Type (1B)      | Key Len (4B)   | Value Len (4B) | Key bytes | Value bytes |
++----------------+----------------+----------------+-----------+-------------+
+
+  - Type: wal.RecordPut or wal.RecordDelete
+  - Value Len: 0 for deletes
+
+The record is either replayed completely or not at all, so a crash never
+leaves part of a batch applied.
+*/
+
+const (
+	batchOpHeaderSize = 9 // Size of a mutation header (1B type + 4B key length + 4B value length)
+)
+
+// ErrCorruptBatch is returned when a logged batch cannot be decoded
+var ErrCorruptBatch = errors.New("db: corrupt batch")
+
+// Batch collects mutations that DB.Write applies atomically
+// The zero value is an empty batch ready to use. A batch is not safe for
+// concurrent use.
+type Batch struct {
+	data  []byte // Encoded mutations, see Batch Layout
+	count int    // Number of mutations in data
+}
+
+// Put adds the insertion or update of a key-value pair to the batch
+// The key and value are copied, the slices may be reused afterwards.
+func (b *Batch) Put(key, value []byte) {
+	b.append(wal.RecordPut, key, value)
+}
+
+// Delete adds the removal of a key to the batch
+// The key is copied, the slice may be reused afterwards.
+func (b *Batch) Delete(key []byte) {
+	b.append(wal.RecordDelete, key, nil)
+}
+
+// Len returns the number of mutations in the batch
+func (b *Batch) Len() int {
+	return b.count
+}
+
+// Reset removes all mutations, keeping the memory for reuse
+func (b *Batch) Reset() {
+	b.data = b.data[:0]
+	b.count = 0
+}
+
+// append encodes a mutation at the end of the batch
+func (b *Batch) append(typ wal.RecordType, key, value []byte) {
+	var header [batchOpHeaderSize]byte
+	header[0] = byte(typ)
+	binary.LittleEndian.PutUint32(header[1:5], uint32(len(key)))
+	binary.LittleEndian.PutUint32(header[5:9], uint32(len(value)))
+
+	b.data = append(b.data, header[:]...)
+	b.data = append(b.data, key...)
+	b.data = append(b.data, value...)
+	b.count++
+}
+
+// eachBatchOp decodes the mutations of an encoded batch in order
+// Returns ErrCorruptBatch if data is not a valid batch, or the first error from fn
+func eachBatchOp(data []byte, fn func(typ wal.RecordType, key, value []byte) error) error {
+	for len(data) > 0 {
+		if len(data) < batchOpHeaderSize {
+			return fmt.Errorf("%w: truncated mutation header", ErrCorruptBatch)
+		}
+		typ := wal.RecordType(data[0])
+		klen := uint64(binary.LittleEndian.Uint32(data[1:5]))
+		vlen := uint64(binary.LittleEndian.Uint32(data[5:9]))
+		data = data[batchOpHeaderSize:]
+		if klen+vlen > uint64(len(data)) {
+			return fmt.Errorf("%w: mutation of %d bytes exceeds the batch", ErrCorruptBatch, klen+vlen)
+		}
+		if typ != wal.RecordPut && typ != wal.RecordDelete {
+			return fmt.Errorf("%w: unknown mutation type %d", ErrCorruptBatch, typ)
+		}
+
+		if err := fn(typ, data[:klen], data[klen:klen+vlen]); err != nil {
+			return err
+		}
+		data = data[klen+vlen:]
+	}
+	return nil
+}
+
+// Write applies all mutations of a batch atomically
+// Parameters:
+//   - b: The batch to apply, it is not modified and can be reused after Reset
+//
+// Returns:
+//   - error: Any error that occurred during the operation, ErrClosed, ErrEmptyKey,
+//     ErrKeyTooLarge or ErrValueTooLarge if any mutation is invalid,
+//     ErrCorruptPage if a page on the path to a key fails verification
+//
+// The batch runs as a write transaction: it is logged as one record and
+// synced once, and the tree pages it rewrites are written once at the end
+// instead of once per key. Either all mutations are applied or, on error,
+// none of them.
+func (db *DB) Write(b *Batch) error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if b.Len() == 0 {
+		return nil
+	}
+
+	// Reject invalid mutations before anything is applied
+	err := eachBatchOp(b.data, func(typ wal.RecordType, key, value []byte) error {
+		return db.tree.Config.Validate(key, value)
+	})
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	if err := tx.apply(b.data); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// apply runs the mutations of an encoded batch in a write transaction
+func (tx *Tx) apply(data []byte) error {
+	return eachBatchOp(data, func(typ wal.RecordType, key, value []byte) error {
+		if typ == wal.RecordPut {
+			return tx.Put(key, value)
+		}
+		return tx.Delete(key)
+	})
+}
+
+// replayBatch applies a logged batch during recovery, all or nothing
+// Must only be called while nothing else uses the database
+func (db *DB) replayBatch(data []byte) error {
+	tx := db.newWriteTx()
+	err := tx.apply(data)
+	if err == nil {
+		err = tx.publish()
+	}
+	if err != nil {
+		tx.rollback()
+	}
+	return err
+}
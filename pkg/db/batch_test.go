@@ -0,0 +1,261 @@
+package db
+
+import (
+	"build-your-own-database/pkg/wal"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestBatch verifies that a batch
+// 1. Applies puts and deletes in order, later mutations winning
+// 2. Reports its length and can be reset and reused
+// 3. Is a no-op when empty
+func TestBatch(t *testing.T) {
+	database := openScanDB(t)
+
+	var b Batch
+	if err := database.Write(&b); err != nil {
+		t.Fatalf("Failed to write empty batch: %v", err)
+	}
+
+	for i := 0; i < 50; i++ {
+		b.Put([]byte(fmt.Sprintf("key%03d", i)), []byte("batched"))
+	}
+	b.Delete([]byte("key010"))
+	b.Put([]byte("key020"), []byte("twice"))
+	b.Delete([]byte("key099"))
+	if b.Len() != 53 {
+		t.Errorf("Expected 53 mutations, got %d", b.Len())
+	}
+	if err := database.Write(&b); err != nil {
+		t.Fatalf("Failed to write batch: %v", err)
+	}
+
+	expected := map[string]string{"key000": "batched", "key049": "batched", "key020": "twice", "key050": "value050"}
+	for key, value := range expected {
+		got, found, err := database.Get([]byte(key))
+		if err != nil || !found || string(got) != value {
+			t.Errorf("Expected %s for key %s, got %q, found %v, err %v", value, key, got, found, err)
+		}
+	}
+	for _, key := range []string{"key010", "key099"} {
+		if _, found, _ := database.Get([]byte(key)); found {
+			t.Errorf("Expected key %s to be deleted", key)
+		}
+	}
+
+	b.Reset()
+	if b.Len() != 0 {
+		t.Errorf("Expected an empty batch after Reset, got %d", b.Len())
+	}
+	b.Put([]byte("key010"), []byte("back"))
+	if err := database.Write(&b); err != nil {
+		t.Fatalf("Failed to write reused batch: %v", err)
+	}
+	if got, _, _ := database.Get([]byte("key010")); string(got) != "back" {
+		t.Errorf("Expected the reused batch to be applied, got %q", got)
+	}
+}
+
+// TestBatchRejectsInvalidMutations verifies that one invalid mutation rejects
+// the whole batch before anything is logged
+func TestBatchRejectsInvalidMutations(t *testing.T) {
+	database := openScanDB(t)
+	if err := database.checkpoint(); err != nil {
+		t.Fatalf("Failed to checkpoint: %v", err)
+	}
+
+	var b Batch
+	b.Put([]byte("key000"), []byte("changed"))
+	b.Delete(nil)
+	if err := database.Write(&b); !errors.Is(err, ErrEmptyKey) {
+		t.Fatalf("Expected ErrEmptyKey, got %v", err)
+	}
+	if got, _, _ := database.Get([]byte("key000")); string(got) != "value000" {
+		t.Errorf("Expected the batch to be rejected, got %q", got)
+	}
+	if database.wal.Size() != 0 {
+		t.Errorf("Expected nothing to be logged, the log holds %d bytes", database.wal.Size())
+	}
+}
+
+// TestBatchWritesPagesOnce verifies that pages replaced within a batch are
+// reused right away instead of growing the file
+func TestBatchWritesPagesOnce(t *testing.T) {
+	database := openScanDB(t)
+	before := database.pageCount
+
+	var b Batch
+	for i := 0; i < 1000; i++ {
+		b.Put([]byte("key050"), []byte(fmt.Sprintf("update%d", i)))
+	}
+	if err := database.Write(&b); err != nil {
+		t.Fatalf("Failed to write batch: %v", err)
+	}
+	if grown := database.pageCount - before; grown > 10 {
+		t.Errorf("Expected the file to grow by a few pages, it grew by %d", grown)
+	}
+	if got, _, _ := database.Get([]byte("key050")); string(got) != "update999" {
+		t.Errorf("Expected the last update to win, got %q", got)
+	}
+}
+
+// TestFailedBatchLeavesDatabaseUnchanged verifies that a batch whose pages
+// cannot be written is rolled back completely, including its log record
+func TestFailedBatchLeavesDatabaseUnchanged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	writeTestDB(t, path)
+
+	database, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer database.Close()
+
+	// Swap in a read-only handle, so every page write fails
+	file := database.storage.File
+	readOnly, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	database.storage.File = readOnly
+	root, pageCount := database.tree.Root, database.pageCount
+
+	var b Batch
+	for i := 0; i < 200; i += 2 {
+		b.Put([]byte(fmt.Sprintf("key%03d", i)), []byte("changed"))
+		b.Delete([]byte(fmt.Sprintf("key%03d", i+1)))
+	}
+	if err := database.Write(&b); err == nil {
+		t.Fatal("Expected the batch to fail")
+	}
+	if database.tree.Root != root || database.pageCount != pageCount {
+		t.Errorf("Expected root %d and %d pages, got root %d and %d pages", root, pageCount, database.tree.Root, database.pageCount)
+	}
+	if database.wal.Size() != 0 {
+		t.Errorf("Expected the failed batch to be removed from the log, it holds %d bytes", database.wal.Size())
+	}
+
+	database.storage.File = file
+	readOnly.Close()
+	for i := 0; i < 200; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		if value, found, err := database.Get(key); err != nil || !found || string(value) == "changed" {
+			t.Fatalf("Expected the original value for key %s, got %q, found %v, err %v", key, value, found, err)
+		}
+	}
+	if err := database.Write(&b); err != nil {
+		t.Fatalf("Failed to write batch after writes work again: %v", err)
+	}
+}
+
+// TestBatchRecovery verifies that a logged batch is replayed after a crash
+func TestBatchRecovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	database, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to create DB: %v", err)
+	}
+
+	var b Batch
+	for i := 0; i < 500; i++ {
+		b.Put([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%d", i)))
+	}
+	for i := 0; i < 500; i += 5 {
+		b.Delete([]byte(fmt.Sprintf("key%03d", i)))
+	}
+	if err := database.Write(&b); err != nil {
+		t.Fatalf("Failed to write batch: %v", err)
+	}
+	crash(t, database)
+
+	database, err = NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer database.Close()
+
+	for i := 0; i < 500; i++ {
+		value, found, err := database.Get([]byte(fmt.Sprintf("key%03d", i)))
+		if err != nil {
+			t.Fatalf("Failed to get: %v", err)
+		}
+		if found != (i%5 != 0) || (found && string(value) != fmt.Sprintf("value%d", i)) {
+			t.Errorf("Unexpected state for key%03d: %q, found %v", i, value, found)
+		}
+	}
+}
+
+// TestBatchReopen verifies that batches overwriting and deleting the keys they
+// insert leave a file that reopens with every pair, for many random workloads
+func TestBatchReopen(t *testing.T) {
+	for seed := int64(0); seed < 100; seed++ {
+		path := filepath.Join(t.TempDir(), "test.db")
+		rng := rand.New(rand.NewSource(seed))
+		expected := make(map[string]string)
+
+		for round := 0; round < 3; round++ {
+			database, err := NewDB(path)
+			if err != nil {
+				t.Fatalf("Seed %d: Failed to open DB: %v", seed, err)
+			}
+			for i := 0; i < 5; i++ {
+				var b Batch
+				for j := 0; j < 1+rng.Intn(100); j++ {
+					key := fmt.Sprintf("key%03d", rng.Intn(300))
+					if rng.Intn(3) == 0 {
+						b.Delete([]byte(key))
+						delete(expected, key)
+					} else {
+						value := strings.Repeat("v", rng.Intn(200))
+						b.Put([]byte(key), []byte(value))
+						expected[key] = value
+					}
+				}
+				if err := database.Write(&b); err != nil {
+					t.Fatalf("Seed %d: Failed to write batch: %v", seed, err)
+				}
+			}
+			if err := database.Close(); err != nil {
+				t.Fatalf("Seed %d: Failed to close DB: %v", seed, err)
+			}
+		}
+
+		database, err := NewDB(path)
+		if err != nil {
+			t.Fatalf("Seed %d: Failed to reopen DB: %v", seed, err)
+		}
+		n := 0
+		err = database.Traverse(func(key, value []byte) {
+			n++
+			if expected[string(key)] != string(value) {
+				t.Errorf("Seed %d: Unexpected value for %s", seed, key)
+			}
+		})
+		if err != nil || n != len(expected) {
+			t.Errorf("Seed %d: Expected %d pairs, got %d, err %v", seed, len(expected), n, err)
+		}
+		database.Close()
+	}
+}
+
+// TestCorruptBatch verifies that truncated batches and unknown mutation
+// types are reported as ErrCorruptBatch
+func TestCorruptBatch(t *testing.T) {
+	var b Batch
+	b.Put([]byte("key"), []byte("value"))
+	b.Delete([]byte("other"))
+	data := b.data
+
+	for _, bad := range [][]byte{data[:len(data)-1], data[:5], append([]byte{9}, data[1:]...)} {
+		err := eachBatchOp(bad, func(typ wal.RecordType, key, value []byte) error { return nil })
+		if !errors.Is(err, ErrCorruptBatch) {
+			t.Errorf("Expected ErrCorruptBatch for %x, got %v", bad, err)
+		}
+	}
+}
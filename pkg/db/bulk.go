@@ -0,0 +1,54 @@
+package db
+
+import (
+	"build-your-own-database/pkg/btree"
+	"build-your-own-database/pkg/wal"
+	"iter"
+)
+
+// Errors returned by Import
+var (
+	ErrUnsorted = btree.ErrUnsorted     // A key is not greater than the one before
+	ErrNotEmpty = btree.ErrTreeNotEmpty // The database already holds keys
+)
+
+// Import loads pairs in strictly increasing key order into an empty database
+// Parameters:
+//   - pairs: The key-value pairs, keys and values may be reused by the iterator
+//   - fill: Share of each page to fill, 0 selects btree.DefaultFillFactor
+//
+// Returns:
+//   - int: The number of pairs loaded
+//   - error: ErrReadOnly, ErrClosed, ErrNotEmpty if the database holds keys,
+//     ErrUnsorted if a key is not greater than the one before, ErrEmptyKey,
+//     ErrKeyTooLarge or ErrValueTooLarge for a pair that cannot be stored,
+//     or any error writing
+//
+// The tree is built bottom-up with btree.BulkLoad instead of inserting the
+// pairs one by one, and its pages are written once each, in order. The pairs
+// bypass the write-ahead log, a checkpoint makes them durable before Import
+// returns. If the import fails or the process crashes during it, the
+// database stays empty.
+func (db *DB) Import(pairs iter.Seq2[[]byte, []byte], fill float64) (int, error) {
+	if db.opts.ReadOnly {
+		return 0, ErrReadOnly
+	}
+	db.lockWrite()
+	defer db.unlockWrite()
+	if db.closed.Load() {
+		return 0, ErrClosed
+	}
+
+	count, err := db.tree.BulkLoad(pairs, fill)
+	if err != nil {
+		db.free.recycle(0)
+		return 0, err
+	}
+
+	// Nothing was logged, open optimistic transactions conflict with every key
+	db.conflicts.record(db.version+1, wal.Record{Type: wal.RecordDeleteRange})
+	if err := db.commit(); err != nil {
+		return count, err
+	}
+	return count, db.checkpoint()
+}
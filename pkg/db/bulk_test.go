@@ -0,0 +1,129 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"iter"
+	"path/filepath"
+	"testing"
+)
+
+// importPairs yields n sorted pairs starting at key first
+func importPairs(first, n int) iter.Seq2[[]byte, []byte] {
+	return func(yield func(key, value []byte) bool) {
+		for i := first; i < first+n; i++ {
+			if !yield([]byte(fmt.Sprintf("key%06d", i)), []byte(fmt.Sprintf("value%d", i))) {
+				return
+			}
+		}
+	}
+}
+
+// TestImport verifies that Import
+// 1. Loads sorted pairs into an empty database
+// 2. Makes them durable without the log, so they survive a crash
+// 3. Leaves a database that accepts regular updates
+func TestImport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	database, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to create DB: %v", err)
+	}
+
+	count, err := database.Import(importPairs(0, 10000), 0)
+	if err != nil || count != 10000 {
+		t.Fatalf("Expected 10000 pairs imported, got %d, err %v", count, err)
+	}
+	if size := database.wal.Size(); size > 0 {
+		t.Errorf("Expected the import to bypass the log, it holds %d bytes", size)
+	}
+	if err := database.Put([]byte("key000100a"), []byte("new")); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+
+	crash(t, database)
+	database, err = NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer database.Close()
+
+	n := 0
+	if err := database.Traverse(func(key, value []byte) { n++ }); err != nil || n != 10001 {
+		t.Errorf("Expected 10001 pairs after reopening, got %d, err %v", n, err)
+	}
+	if value, _, _ := database.Get([]byte("key009999")); string(value) != "value9999" {
+		t.Errorf("Expected value9999, got %q", value)
+	}
+	if value, _, _ := database.Get([]byte("key000100a")); string(value) != "new" {
+		t.Errorf("Expected new, got %q", value)
+	}
+}
+
+// TestImportErrors verifies that a failed Import leaves the database empty
+// and usable, and that only an empty database can be imported into
+func TestImportErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	database, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to create DB: %v", err)
+	}
+	defer database.Close()
+
+	unsorted := func(yield func(key, value []byte) bool) {
+		for key, value := range importPairs(0, 5000) {
+			if !yield(key, value) {
+				return
+			}
+		}
+		yield([]byte("key000042"), []byte("again"))
+	}
+	before := database.pageCount
+	if _, err := database.Import(unsorted, 0); !errors.Is(err, ErrUnsorted) {
+		t.Fatalf("Expected ErrUnsorted, got %v", err)
+	}
+	if _, found, _ := database.Get([]byte("key000001")); found {
+		t.Error("Failed import left pairs behind")
+	}
+
+	// The pages written by the failed import are reused
+	failed := database.pageCount
+	if _, err := database.Import(importPairs(0, 5000), 0); err != nil {
+		t.Fatalf("Failed to import: %v", err)
+	}
+	if grown := database.pageCount - failed; grown > (failed-before)/4 {
+		t.Errorf("Expected the pages of the failed import to be reused, file grew by %d pages", grown)
+	}
+
+	if _, err := database.Import(importPairs(5000, 10), 0); !errors.Is(err, ErrNotEmpty) {
+		t.Errorf("Expected ErrNotEmpty, got %v", err)
+	}
+}
+
+// TestImportConflicts verifies that an optimistic transaction open during an
+// import fails, since the import is not recorded key by key
+func TestImportConflicts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	database, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to create DB: %v", err)
+	}
+	defer database.Close()
+
+	tx, err := database.BeginOptimistic()
+	if err != nil {
+		t.Fatalf("Failed to begin: %v", err)
+	}
+	if _, _, err := tx.Get([]byte("key000007")); err != nil {
+		t.Fatalf("Failed to get: %v", err)
+	}
+	if err := tx.Put([]byte("other"), []byte("value")); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if _, err := database.Import(importPairs(0, 100), 0); err != nil {
+		t.Fatalf("Failed to import: %v", err)
+	}
+	if err := tx.Commit(); !errors.Is(err, ErrConflict) {
+		t.Errorf("Expected ErrConflict, got %v", err)
+	}
+}
@@ -0,0 +1,335 @@
+package db
+
+import (
+	"build-your-own-database/pkg/wal"
+	"errors"
+	"fmt"
+	"time"
+)
+
+/*
+Commit Protocol:
+
+Every update is first appended to the write-ahead log and then applied to the
+B+ tree. The tree never modifies a page in place, so its new pages are written
+right away but only become durable once a meta page points at the new root.
+That happens at a checkpoint, which runs in this order:
+
+ 1. The free list is written to pages that no checkpointed tree references
+ 2. fsync, so every page the new meta page points to is on disk
+ 3. The meta page, including the LSN of the last applied log record, is
+    written to the slot not holding the current meta page
+ 4. fsync, so the new meta page is on disk
+ 5. The log is truncated, its records are reflected in the tree now
+
+A crash before step 4 completes leaves the previous meta page intact. On open
+the database continues from the newest valid meta page and replays the log
+records after its LSN, so every acknowledged update survives. Pages the last
+checkpointed tree references are not reused until the next checkpoint, pages
+an open snapshot references not until it is closed.
+
+An update that fails after it was logged, for example because the disk is
+full, leaves the tree unchanged and is removed from the log again. A failed
+checkpoint keeps the previous meta page and free list in effect.
+
+The sync mode decides when the log is fsynced:
+  - SyncAlways: on every commit, before it is acknowledged
+  - SyncInterval: from a background loop
+  - SyncNone: never, checkpoints skip the fsyncs as well
+*/
+
+// loadMeta reads the meta pages and restores the tree root from the newest one
+// A brand-new (empty) file is initialized with fresh meta pages instead
+// Parameters:
+//   - pageSize: page size requested by the options, 0 accepts the one of the file
+func (db *DB) loadMeta(pageSize int) error {
+	stat, err := db.storage.File.Stat()
+	if err != nil {
+		return err
+	}
+
+	if stat.Size() == 0 {
+		if db.opts.ReadOnly {
+			return fmt.Errorf("%w: empty file", ErrInvalidMeta)
+		}
+		if pageSize == 0 {
+			pageSize = DefaultPageSize
+		}
+		db.setPageSize(pageSize)
+		return db.initMeta()
+	}
+
+	m, err := db.readMeta()
+	if err != nil {
+		return err
+	}
+	if pageSize != 0 && int(m.pageSize) != pageSize {
+		return fmt.Errorf("%w: the database uses %d byte pages, not %d", ErrPageSize, m.pageSize, pageSize)
+	}
+	db.setPageSize(int(m.pageSize))
+	if stat.Size() < int64(m.pageCount)*int64(db.pageSize) {
+		return fmt.Errorf("%w: file holds fewer than %d pages", ErrInvalidMeta, m.pageCount)
+	}
+
+	db.tree.Root = m.root
+	db.pageCount = m.pageCount
+	db.lsn = m.lsn
+	db.seq = m.seq
+	if db.opts.ReadOnly {
+		// Nothing is allocated, and the writer may be rewriting the free list
+		return nil
+	}
+	return db.free.load(m.freeList, m.pageCount, db.pageReadChecked)
+}
+
+// readMeta returns the newest valid meta page before the page size is known
+// Slot 1 starts one page into the file, so it is looked for at every supported
+// page size, and a meta page only counts at the offset its own page size puts it.
+func (db *DB) readMeta() (meta, error) {
+	// A page that cannot be read is treated like a corrupted one
+	var first error
+	slot0, _ := db.storage.Read(0, metaSize)
+	for size := MinPageSize; size <= MaxPageSize; size *= 2 {
+		slot1, _ := db.storage.Read(int64(size), metaSize)
+		m, err := newestMeta([metaPages][]byte{slot0, slot1})
+		if err == nil && int(m.pageSize) == size {
+			return m, nil
+		}
+		if first == nil {
+			first = err
+		}
+	}
+	if first == nil {
+		first = fmt.Errorf("%w: no meta page at its page size", ErrInvalidMeta)
+	}
+	return meta{}, first
+}
+
+// initMeta writes the meta pages of an empty database
+func (db *DB) initMeta() error {
+	// Reserve the meta pages, tree nodes start right after them
+	db.pageCount = metaPages
+	db.seq = 0
+
+	// The second slot stays empty until the first checkpoint writes to it
+	if err := db.pageWrite(1, make([]byte, db.pageSize)); err != nil {
+		return err
+	}
+	if err := db.writeMeta(db.meta()); err != nil {
+		return err
+	}
+	return db.storage.Sync()
+}
+
+// meta returns the meta record describing the current state
+func (db *DB) meta() meta {
+	return meta{
+		version:   metaVersion,
+		pageSize:  uint32(db.pageSize),
+		root:      db.tree.Root,
+		pageCount: db.pageCount,
+		freeList:  db.free.head,
+		lsn:       db.lsn,
+		seq:       db.seq,
+	}
+}
+
+// writeMeta writes a meta record to its slot
+// The whole page is written with a single call
+func (db *DB) writeMeta(m meta) error {
+	page := make([]byte, db.pageSize)
+	m.encode(page)
+	return db.pageWrite(m.slot(), page)
+}
+
+// recover applies the log records that the checkpointed tree does not
+// reflect yet and checkpoints the result
+func (db *DB) recover() error {
+	var replayed int
+	err := db.wal.Replay(db.lsn, func(rec wal.Record) error {
+		var err error
+		switch rec.Type {
+		case wal.RecordPut:
+			err = db.tree.Insert(rec.Key, rec.Value)
+		case wal.RecordDelete:
+			_, err = db.tree.Delete(rec.Key)
+		case wal.RecordDeleteRange:
+			_, err = db.tree.DeleteRange(rec.Key, rec.Value)
+		case wal.RecordBatch:
+			err = db.replayBatch(rec.Value)
+		default:
+			err = fmt.Errorf("db: unknown log record type %d", rec.Type)
+		}
+		if err != nil {
+			return fmt.Errorf("db: replaying LSN %d: %w", rec.LSN, err)
+		}
+		db.lsn = rec.LSN
+		db.dirty = true
+		db.free.recycle(0)
+		replayed++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if replayed > 0 {
+		db.opts.Logger.Info("db: replayed log", "path", db.path, "records", replayed, "lsn", db.lsn)
+	}
+
+	return db.checkpoint()
+}
+
+// logRecord appends an update to the write-ahead log before it is applied
+// Must be called with db.mu held for writing
+func (db *DB) logRecord(rec wal.Record) error {
+	lsn, err := db.wal.Append(rec)
+	if err != nil {
+		return err
+	}
+	if db.opts.SyncMode == SyncAlways {
+		if err := db.wal.Sync(); err != nil {
+			return err
+		}
+	}
+
+	db.lsn = lsn
+	db.conflicts.record(db.version+1, rec)
+	return nil
+}
+
+// abort drops a logged update that could not be applied to the tree
+// The tree has already undone its changes, this removes the log record
+// and makes the pages allocated by the update reusable again.
+// Must be called with db.mu held for writing
+func (db *DB) abort(err error) error {
+	db.free.recycle(0)
+
+	if uerr := db.wal.Undo(db.lsn); uerr != nil {
+		return errors.Join(err, uerr)
+	}
+	db.lsn--
+	return err
+}
+
+// commit finishes an update that was logged and applied to the tree
+// Must be called with db.mu held for writing
+func (db *DB) commit() error {
+	db.dirty = true
+	db.version++
+	db.free.releaseHeld(db.oldestSnapshot())
+	db.free.recycle(db.holdVersion())
+
+	if err := db.syncErr; err != nil {
+		db.syncErr = nil
+		return fmt.Errorf("db: background sync failed: %w", err)
+	}
+
+	if db.wal.Size() >= db.opts.CheckpointSize {
+		return db.checkpoint()
+	}
+	return nil
+}
+
+// checkpoint records the current tree in a new meta page and truncates the log
+// Must be called with db.mu held for writing
+func (db *DB) checkpoint() error {
+	sync := db.opts.SyncMode != SyncNone
+	if err := db.flush(sync); err != nil {
+		return err
+	}
+	return db.wal.Reset(db.lsn+1, sync)
+}
+
+// Checkpoint records every commit made so far in a new meta page and
+// truncates the log
+// Returns:
+//   - error: ErrReadOnly, ErrClosed, or any error writing the checkpoint
+//
+// Checkpoints happen on their own once the log reaches Options.CheckpointSize
+// and on Close. Read-only opens in other processes only see commits up to the
+// last checkpoint, a writer calls Checkpoint to make its commits visible to them.
+func (db *DB) Checkpoint() error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	db.lockWrite()
+	defer db.unlockWrite()
+	if db.closed.Load() {
+		return ErrClosed
+	}
+
+	return db.checkpoint()
+}
+
+// flush records all updates made so far in a new meta page
+// Parameters:
+//   - sync: whether to fsync before and after writing the meta page
+//
+// Must be called with db.mu held for writing
+func (db *DB) flush(sync bool) (err error) {
+	if !db.dirty {
+		return nil
+	}
+
+	// Until the new meta page is written the old one is the valid commit,
+	// so a failure must not hand out pages that it still refers to
+	saved, pageCount := db.free.clone(), db.pageCount
+	defer func() {
+		if err != nil {
+			db.free, db.pageCount = saved, pageCount
+		}
+	}()
+
+	// Snapshots may still read the pages the checkpoint would make free
+	if hold := db.holdVersion(); hold != 0 {
+		db.free.holdPending(hold)
+	}
+	if err := db.free.commit(db.payloadSize(), db.pageAppend, db.pageWriteChecked); err != nil {
+		return err
+	}
+
+	// All pages the new meta page refers to must be durable first
+	if sync {
+		if err := db.storage.Sync(); err != nil {
+			return err
+		}
+	}
+
+	m := db.meta()
+	m.seq++
+	if err := db.writeMeta(m); err != nil {
+		return err
+	}
+
+	if sync {
+		if err := db.storage.Sync(); err != nil {
+			return err
+		}
+	}
+
+	db.seq = m.seq
+	db.dirty = false
+	return nil
+}
+
+// syncLoop fsyncs the log every SyncInterval until the database is closed
+func (db *DB) syncLoop() {
+	defer db.wg.Done()
+
+	ticker := time.NewTicker(db.opts.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.done:
+			return
+		case <-ticker.C:
+			if err := db.wal.Sync(); err != nil {
+				db.opts.Logger.Error("db: background sync failed", "path", db.path, "err", err)
+				db.mu.Lock()
+				db.syncErr = err
+				db.mu.Unlock()
+			}
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package db
+
+import (
+	"build-your-own-database/pkg/btree"
+	"build-your-own-database/pkg/cache"
+	"build-your-own-database/pkg/storage"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+/*
+Compaction:
+
+Released pages are reused through the free list, but the file never shrinks,
+and after many updates the leaves of neighbouring keys are scattered over it.
+Compact rewrites the database into a new file next to it (<path>-compact):
+
+ 1. The writer lock is taken, so no commit happens until the swap, and the
+    file is locked exclusively, so no other process is reading it
+ 2. The live pairs are read from a snapshot and bulk loaded into the new file
+    in key order, readers keep using the old file meanwhile
+ 3. The new file gets a meta page with the LSN of the last commit and is fsynced
+ 4. Once every open snapshot is closed, the new file is renamed over the old
+    one, the directory is fsynced and the database continues on the new file
+
+The write-ahead log is not touched: the new file reflects every record up to
+its LSN, just like the old one after a checkpoint. A crash before the rename
+leaves the old file in place, a stale <path>-compact is replaced by the next
+compaction.
+*/
+
+// compactSuffix is appended to the database path for the file being written by Compact
+const compactSuffix = "-compact"
+
+// Compact rewrites the database into a new file holding only live pages
+// Returns:
+//   - int64: The number of bytes the file shrank by
+//   - error: ErrReadOnly, ErrClosed, ErrLocked while a read-only open in another process
+//     has the database open, or any error that occurred while copying or
+//     swapping the files, the database keeps using the old file unless the
+//     rename succeeded
+//
+// Pairs are copied in key order with full leaves, so sequential scans read
+// neighbouring pages afterwards. Reads are served while the pairs are copied,
+// writes wait until Compact returns. Before swapping the files Compact waits
+// for open snapshots and transactions to end.
+func (db *DB) Compact() (int64, error) {
+	if db.opts.ReadOnly {
+		return 0, ErrReadOnly
+	}
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	if db.closed.Load() {
+		return 0, ErrClosed
+	}
+
+	// Read-only opens in other processes keep reading the old file, so they
+	// must be gone, and stay out until the new file is in place
+	if err := db.storage.Relock(true, db.opts.LockTimeout); err != nil {
+		return 0, err
+	}
+	defer func() {
+		// Downgrading never waits, and the new file is only locked by us
+		db.storage.Relock(false, 0)
+	}()
+
+	stat, err := db.storage.File.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	snap := db.Snapshot()
+	dst, err := db.compactCopy(db.path+compactSuffix, snap)
+	snap.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	// Snapshots read page numbers of the old file
+	db.lockWithoutSnapshots()
+	defer db.mu.Unlock()
+
+	if err := os.Rename(dst.storage.File.Name(), db.path); err != nil {
+		dst.storage.Close()
+		os.Remove(dst.storage.File.Name())
+		return 0, err
+	}
+	old := db.compactSwap(dst)
+
+	// The database is on the new file now, whatever fails from here on
+	err = syncDir(filepath.Dir(db.path))
+	if cerr := old.Close(); err == nil {
+		err = cerr
+	}
+	reclaimed := stat.Size() - db.pageOffset(db.pageCount)
+	db.opts.Logger.Info("db: compacted", "path", db.path, "pages", db.pageCount, "reclaimed", reclaimed)
+	return reclaimed, err
+}
+
+// compactCopy writes the pairs of a snapshot into a new database file
+// Returns the new database, only its storage, tree and meta fields are set
+// Must be called with db.writer held
+func (db *DB) compactCopy(path string, snap *Snapshot) (*DB, error) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	s, err := storage.Open(path, &storage.Options{Mmap: true, Perm: db.opts.FileMode})
+	if err != nil {
+		return nil, err
+	}
+
+	dst := &DB{
+		storage:  s,
+		cache:    cache.New(-1),
+		pageSize: db.pageSize,
+	}
+	dst.tree = btree.NewBTree(dst.pageGet, dst.pageNew, dst.pageDel)
+	dst.tree.Config = db.tree.Config
+
+	err = dst.initMeta()
+	if err == nil {
+		it := snap.Range(nil, nil)
+		_, err = dst.tree.BulkLoad(it.All(), 1)
+		if err == nil {
+			err = it.Err()
+		}
+	}
+	if err == nil {
+		// The new file reflects every log record the old one does
+		dst.lsn = db.lsn
+		dst.dirty = true
+		err = dst.flush(true)
+	}
+	if err != nil {
+		s.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return dst, nil
+}
+
+// compactSwap continues on the compacted file after it was renamed over
+// the database file and returns the old storage, to be closed by the caller
+// Must be called with db.mu held for writing and no open snapshots
+func (db *DB) compactSwap(dst *DB) *storage.Storage {
+	// The open file handle follows the rename, the old file is unlinked
+	old := db.storage
+	db.storage = dst.storage
+	db.tree.Root = dst.tree.Root
+	db.pageCount = dst.pageCount
+	db.seq = dst.seq
+	db.free = freeList{}
+	db.dirty = false
+	db.cache.Clear()
+	return old
+}
+
+// syncDir fsyncs a directory, making a rename in it durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,145 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestCompact verifies that Compact
+// 1. Shrinks a file that mostly holds released pages and reports the difference
+// 2. Keeps every live pair, before and after reopening
+// 3. Leaves a database that accepts regular updates
+func TestCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	database, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to create DB: %v", err)
+	}
+
+	// Most pairs are deleted again, only the keys with prefix "live" remain
+	for i := 0; i < 5000; i++ {
+		prefix := "dead"
+		if i%5 == 0 {
+			prefix = "live"
+		}
+		if err := database.Put([]byte(fmt.Sprintf("%s%05d", prefix, i)), []byte(fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	if _, err := database.DeletePrefix([]byte("dead")); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+
+	before, _ := os.Stat(path)
+	reclaimed, err := database.Compact()
+	if err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	after, _ := os.Stat(path)
+	if reclaimed <= 0 || reclaimed != before.Size()-after.Size() {
+		t.Errorf("Expected %d bytes reclaimed, got %d", before.Size()-after.Size(), reclaimed)
+	}
+	if _, err := os.Stat(path + compactSuffix); !os.IsNotExist(err) {
+		t.Errorf("Expected the compaction file to be renamed, stat returned %v", err)
+	}
+
+	if err := database.Put([]byte("live99999"), []byte("new")); err != nil {
+		t.Fatalf("Failed to put after compacting: %v", err)
+	}
+	crash(t, database)
+
+	database, err = NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer database.Close()
+
+	n := 0
+	if err := database.Traverse(func(key, value []byte) { n++ }); err != nil || n != 1001 {
+		t.Errorf("Expected 1001 pairs after reopening, got %d, err %v", n, err)
+	}
+	if value, _, _ := database.Get([]byte("live04995")); string(value) != "value4995" {
+		t.Errorf("Expected value4995, got %q", value)
+	}
+	if _, found, _ := database.Get([]byte("dead04999")); found {
+		t.Errorf("Expected dead04999 to stay deleted")
+	}
+	if value, _, _ := database.Get([]byte("live99999")); string(value) != "new" {
+		t.Errorf("Expected new, got %q", value)
+	}
+}
+
+// TestCompactServesReads verifies that readers keep going while Compact copies
+// and that Compact waits for open snapshots before swapping the files, without
+// holding up reads of the goroutine that keeps a snapshot open
+func TestCompactServesReads(t *testing.T) {
+	database := openSnapshotDB(t)
+
+	s := database.Snapshot()
+	done := make(chan error)
+	go func() {
+		_, err := database.Compact()
+		done <- err
+	}()
+
+	// Readers running concurrently with the copy see every key
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				key := fmt.Sprintf("key%03d", i)
+				if value, _, err := database.Get([]byte(key)); err != nil || string(value) != "old" {
+					t.Errorf("Expected old for %s, got %q, err %v", key, value, err)
+					return
+				}
+			}
+		}()
+	}
+
+	select {
+	case err := <-done:
+		t.Fatalf("Compact returned while a snapshot was open, err %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Compact waits for s by now, the holder of s reads on
+	read := make(chan error)
+	go func() {
+		value, _, err := database.Get([]byte("key000"))
+		if err == nil && string(value) != "old" {
+			err = fmt.Errorf("got %q", value)
+		}
+		if err == nil {
+			var tx *OptimisticTx
+			if tx, err = database.BeginOptimistic(); err == nil {
+				err = tx.Rollback()
+			}
+		}
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		if err != nil {
+			t.Errorf("Failed to read while Compact waited for a snapshot: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		s.Close()
+		t.Fatal("Reads blocked while Compact waited for a snapshot")
+	}
+	expectSnapshot(t, s, "old")
+	s.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	wg.Wait()
+
+	s = database.Snapshot()
+	expectSnapshot(t, s, "old")
+	s.Close()
+}
@@ -0,0 +1,268 @@
+package db
+
+import (
+	"build-your-own-database/pkg/btree"
+	"build-your-own-database/pkg/wal"
+	"bytes"
+	"iter"
+)
+
+// Cursor walks the key-value pairs of a database in key order
+// A cursor reads from a snapshot taken by NewCursor, so it does not see later
+// updates and writers are not blocked by it.
+type Cursor struct {
+	cur    *btree.Cursor
+	snap   *Snapshot // Snapshot owned by the cursor, nil if it belongs to the caller
+	err    error     // ErrClosed for a cursor on a closed database
+	closed bool
+}
+
+// NewCursor opens a cursor that is not positioned yet
+// Returns:
+//   - *Cursor: A cursor to position with Seek, First or Last, must be closed
+func (db *DB) NewCursor() *Cursor {
+	s := db.Snapshot()
+	c := s.NewCursor()
+	c.snap = s
+	return c
+}
+
+// Seek positions the cursor at the first key greater than or equal to key
+func (c *Cursor) Seek(key []byte) bool { return c.cur.Seek(key) }
+
+// First positions the cursor at the smallest key
+func (c *Cursor) First() bool { return c.cur.First() }
+
+// Last positions the cursor at the largest key
+func (c *Cursor) Last() bool { return c.cur.Last() }
+
+// Next moves the cursor to the following key
+func (c *Cursor) Next() bool { return c.cur.Next() }
+
+// Prev moves the cursor to the preceding key
+func (c *Cursor) Prev() bool { return c.cur.Prev() }
+
+// Valid reports whether the cursor is positioned at a key
+func (c *Cursor) Valid() bool { return c.cur.Valid() }
+
+// Key returns the key at the cursor position, valid until the cursor moves
+func (c *Cursor) Key() []byte { return c.cur.Key() }
+
+// Value returns the value at the cursor position, valid until the cursor moves
+func (c *Cursor) Value() []byte { return c.cur.Value() }
+
+// Err returns the error that invalidated the cursor, ErrCorruptPage if a
+// page failed verification, ErrClosed if the database was closed
+func (c *Cursor) Err() error {
+	if c.err != nil {
+		return c.err
+	}
+	return c.cur.Err()
+}
+
+// All returns an iterator over the pairs from the cursor position onwards
+func (c *Cursor) All() iter.Seq2[[]byte, []byte] { return c.cur.All() }
+
+// Backward returns an iterator over the pairs from the cursor position back to the first one
+func (c *Cursor) Backward() iter.Seq2[[]byte, []byte] { return c.cur.Backward() }
+
+// Close releases the cursor and its snapshot, closing a cursor twice is harmless
+func (c *Cursor) Close() {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.cur.Close()
+	if c.snap != nil {
+		c.snap.Close()
+	}
+}
+
+// Scan calls visit for every key-value pair with start <= key < end in key order
+// Parameters:
+//   - start: The first key to visit, nil or empty starts at the smallest key
+//   - end: The key to stop before, nil or empty runs to the largest key
+//   - visit: Called for each pair, returning false stops the scan
+//
+// Returns:
+//   - error: Any error that occurred while reading, the scan stops at it
+//
+// The slices passed to visit are only valid during the call and must not be modified.
+func (db *DB) Scan(start, end []byte, visit func(key, value []byte) bool) error {
+	return db.Range(start, end).scan(visit)
+}
+
+// ScanReverse calls visit for every key-value pair with start <= key < end
+// in descending key order
+// Parameters:
+//   - start: The last key to visit, nil or empty runs to the smallest key
+//   - end: The key to start before, nil or empty starts at the largest key
+//   - visit: Called for each pair, returning false stops the scan
+//
+// Returns:
+//   - error: Any error that occurred while reading, the scan stops at it
+//
+// The slices passed to visit are only valid during the call and must not be modified.
+func (db *DB) ScanReverse(start, end []byte, visit func(key, value []byte) bool) error {
+	it := db.Range(start, end)
+	for key, value := range it.Backward() {
+		if !visit(key, value) {
+			break
+		}
+	}
+	return it.Err()
+}
+
+// ScanPrefix calls visit for every key-value pair whose key starts with prefix
+// Parameters:
+//   - prefix: The prefix to match, an empty prefix matches every key
+//   - visit: Called for each pair in key order, returning false stops the scan
+//
+// Returns:
+//   - error: Any error that occurred while reading, the scan stops at it
+//
+// The scan seeks straight to the first matching key and stops after the last one.
+// The slices passed to visit are only valid during the call and must not be modified.
+func (db *DB) ScanPrefix(prefix []byte, visit func(key, value []byte) bool) error {
+	return db.Scan(prefix, prefixEnd(prefix), visit)
+}
+
+// DeletePrefix removes every key-value pair whose key starts with prefix
+// Parameters:
+//   - prefix: The prefix to match, an empty prefix removes every key
+//
+// Returns:
+//   - int: The number of keys removed
+//   - error: Any error that occurred during the operation, ErrReadOnly,
+//     ErrClosed, ErrCorruptPage if a page in the range fails verification
+//
+// The removal is logged as a single record and applied as one update. Subtrees
+// holding only matching keys are released without being rewritten. If the
+// update cannot be applied the database is left unchanged.
+func (db *DB) DeletePrefix(prefix []byte) (int, error) {
+	if db.opts.ReadOnly {
+		return 0, ErrReadOnly
+	}
+	db.lockWrite()
+	defer db.unlockWrite()
+	if db.closed.Load() {
+		return 0, ErrClosed
+	}
+
+	end := prefixEnd(prefix)
+	if err := db.logRecord(wal.Record{Type: wal.RecordDeleteRange, Key: prefix, Value: end}); err != nil {
+		return 0, err
+	}
+
+	count, err := db.tree.DeleteRange(prefix, end)
+	if err != nil {
+		return 0, db.abort(err)
+	}
+	return count, db.commit()
+}
+
+// prefixEnd returns the smallest key greater than every key starting with
+// prefix, or nil if there is none because the prefix is all 0xFF bytes
+func prefixEnd(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xFF {
+			end := bytes.Clone(prefix[:i+1])
+			end[i]++
+			return end
+		}
+	}
+	return nil
+}
+
+// Iterator ranges over the key-value pairs of a key range, see DB.Range
+type Iterator struct {
+	db    *DB
+	snap  *Snapshot // Snapshot to read from, nil takes a new one for every loop
+	start []byte    // First key of the range, nil or empty for the smallest key
+	end   []byte    // Key the range stops before, nil or empty for no limit
+	err   error     // Error that stopped the last iteration
+}
+
+// Range returns an iterator over the pairs with start <= key < end
+// Parameters:
+//   - start: The first key of the range, nil or empty starts at the smallest key
+//   - end: The key to stop before, nil or empty runs to the largest key
+//
+// Returns:
+//   - *Iterator: Use All in a for-range loop and check Err afterwards
+func (db *DB) Range(start, end []byte) *Iterator {
+	return &Iterator{db: db, start: start, end: end}
+}
+
+// All returns an iterator over the pairs of the range in key order
+// Each loop reads from a snapshot, updates made by the loop body are not
+// seen by it. The slices are only valid during one iteration.
+func (it *Iterator) All() iter.Seq2[[]byte, []byte] {
+	return func(yield func(key, value []byte) bool) {
+		c := it.cursor()
+		defer c.Close()
+
+		for ok := c.Seek(it.start); ok; ok = c.Next() {
+			if len(it.end) > 0 && bytes.Compare(c.Key(), it.end) >= 0 {
+				break
+			}
+			value := c.Value()
+			if c.Err() != nil || !yield(c.Key(), value) {
+				break
+			}
+		}
+		it.err = c.Err()
+	}
+}
+
+// Backward returns an iterator over the pairs of the range in descending key order
+// The same rules as for All apply.
+func (it *Iterator) Backward() iter.Seq2[[]byte, []byte] {
+	return func(yield func(key, value []byte) bool) {
+		c := it.cursor()
+		defer c.Close()
+
+		// Start at the last key before end, which is the key before
+		// the first one greater than or equal to it
+		var ok bool
+		if len(it.end) > 0 && c.Seek(it.end) {
+			ok = c.Prev()
+		} else {
+			ok = c.Last()
+		}
+		for ; ok; ok = c.Prev() {
+			if len(it.start) > 0 && bytes.Compare(c.Key(), it.start) < 0 {
+				break
+			}
+			value := c.Value()
+			if c.Err() != nil || !yield(c.Key(), value) {
+				break
+			}
+		}
+		it.err = c.Err()
+	}
+}
+
+// cursor opens a cursor on the snapshot of the iterator, or on a new one
+func (it *Iterator) cursor() *Cursor {
+	if it.snap != nil {
+		return it.snap.NewCursor()
+	}
+	return it.db.NewCursor()
+}
+
+// scan calls visit for the pairs of the range in key order until it returns false
+func (it *Iterator) scan(visit func(key, value []byte) bool) error {
+	for key, value := range it.All() {
+		if !visit(key, value) {
+			break
+		}
+	}
+	return it.Err()
+}
+
+// Err returns the error that stopped the last loop over All or Backward, if any
+// ErrCorruptPage is reported if a page failed verification
+func (it *Iterator) Err() error {
+	return it.err
+}
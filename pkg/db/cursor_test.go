@@ -0,0 +1,289 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// openScanDB creates a database holding key000 to key099 with matching values
+func openScanDB(t *testing.T) *DB {
+	t.Helper()
+	database, err := NewDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to create DB: %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		if err := database.Put(key, []byte(fmt.Sprintf("value%03d", i))); err != nil {
+			t.Fatalf("Failed to put key %s: %v", key, err)
+		}
+	}
+	return database
+}
+
+// bound returns the range bound of a test table, "" stands for an open
+// bound, passed as nil or as an empty key
+func bound(s string, empty bool) []byte {
+	if s == "" && !empty {
+		return nil
+	}
+	return []byte(s)
+}
+
+// TestCursor verifies that a database cursor
+// 1. Seeks and moves in both directions
+// 2. Releases its snapshot on Close, closing it twice is harmless
+func TestCursor(t *testing.T) {
+	database := openScanDB(t)
+
+	c := database.NewCursor()
+	if !c.Seek([]byte("key050a")) || string(c.Key()) != "key051" || string(c.Value()) != "value051" {
+		t.Fatalf("Expected cursor at key051, err %v", c.Err())
+	}
+	if !c.Prev() || !c.Prev() || string(c.Key()) != "key049" {
+		t.Errorf("Expected key049 two steps back")
+	}
+	if !c.Last() || string(c.Key()) != "key099" || c.Next() {
+		t.Errorf("Expected key099 to be the last key")
+	}
+	c.Close()
+	c.Close()
+
+	if err := database.Put([]byte("key100"), []byte("value100")); err != nil {
+		t.Fatalf("Failed to put after closing the cursor: %v", err)
+	}
+}
+
+// TestScanAndRange verifies that Scan and Range
+// 1. Visit exactly the keys in [start, end)
+// 2. Treat nil and empty bounds as open
+// 3. Stop early when asked to
+func TestScanAndRange(t *testing.T) {
+	database := openScanDB(t)
+
+	tests := []struct {
+		start, end  string
+		first, last int
+	}{
+		{"key010", "key020", 10, 19},
+		{"key0105", "key013", 11, 12},
+		{"", "key003", 0, 2},
+		{"key097", "", 97, 99},
+		{"", "", 0, 99},
+		{"key050", "key050", 0, -1},
+		{"z", "", 0, -1},
+	}
+	for _, tt := range tests {
+		for _, empty := range []bool{false, true} {
+			var keys []string
+			err := database.Scan(bound(tt.start, empty), bound(tt.end, empty), func(key, value []byte) bool {
+				keys = append(keys, string(key))
+				return true
+			})
+			if err != nil {
+				t.Fatalf("Failed to scan: %v", err)
+			}
+			if len(keys) != tt.last-tt.first+1 {
+				t.Errorf("Scan(%q, %q): expected %d keys, got %v", tt.start, tt.end, tt.last-tt.first+1, keys)
+				continue
+			}
+			for i, key := range keys {
+				if expected := fmt.Sprintf("key%03d", tt.first+i); key != expected {
+					t.Errorf("Scan(%q, %q): expected %s, got %s", tt.start, tt.end, expected, key)
+				}
+			}
+		}
+	}
+
+	it := database.Range([]byte("key020"), nil)
+	count := 0
+	for key, value := range it.All() {
+		if string(value) != "value"+string(key[3:]) {
+			t.Errorf("Wrong value %s for key %s", value, key)
+		}
+		if count++; count == 5 {
+			break
+		}
+	}
+	if count != 5 || it.Err() != nil {
+		t.Errorf("Expected the loop to stop after 5 pairs, got %d, err %v", count, it.Err())
+	}
+
+	// The snapshot is released after breaking out of the loop
+	if err := database.Delete([]byte("key020")); err != nil {
+		t.Fatalf("Failed to delete after the loop: %v", err)
+	}
+
+	// Transactions treat an empty end as open too
+	countScan := func(scan func(start, end []byte, visit func(key, value []byte) bool) error) int {
+		count := 0
+		if err := scan([]byte("key090"), []byte{}, func(key, value []byte) bool { count++; return true }); err != nil {
+			t.Fatalf("Failed to scan: %v", err)
+		}
+		return count
+	}
+	tx, err := database.Begin(false)
+	if err != nil {
+		t.Fatalf("Failed to begin: %v", err)
+	}
+	defer tx.Rollback()
+	otx, err := database.BeginOptimistic()
+	if err != nil {
+		t.Fatalf("Failed to begin: %v", err)
+	}
+	defer otx.Rollback()
+	if tc, oc := countScan(tx.Scan), countScan(otx.Scan); tc != 10 || oc != 10 {
+		t.Errorf("Expected 10 keys from transaction scans with an empty end, got %d and %d", tc, oc)
+	}
+}
+
+// TestScanReverse verifies that ScanReverse and Backward
+// 1. Visit exactly the keys in [start, end) in descending order
+// 2. Treat nil and empty bounds as open
+// 3. Stop after the requested number of pairs, as in a "latest N" query
+func TestScanReverse(t *testing.T) {
+	database := openScanDB(t)
+
+	tests := []struct {
+		start, end  string
+		first, last int // visited from last down to first
+	}{
+		{"key010", "key020", 10, 19},
+		{"key0105", "key013", 11, 12},
+		{"", "key003", 0, 2},
+		{"key097", "", 97, 99},
+		{"", "", 0, 99},
+		{"key050", "key050", 0, -1},
+		{"", "a", 0, -1},
+		{"z", "", 0, -1},
+	}
+	for _, tt := range tests {
+		for _, empty := range []bool{false, true} {
+			var keys []string
+			err := database.ScanReverse(bound(tt.start, empty), bound(tt.end, empty), func(key, value []byte) bool {
+				keys = append(keys, string(key))
+				return true
+			})
+			if err != nil {
+				t.Fatalf("Failed to scan: %v", err)
+			}
+			if len(keys) != tt.last-tt.first+1 {
+				t.Errorf("ScanReverse(%q, %q): expected %d keys, got %v", tt.start, tt.end, tt.last-tt.first+1, keys)
+				continue
+			}
+			for i, key := range keys {
+				if expected := fmt.Sprintf("key%03d", tt.last-i); key != expected {
+					t.Errorf("ScanReverse(%q, %q): expected %s, got %s", tt.start, tt.end, expected, key)
+				}
+			}
+		}
+	}
+
+	it := database.Range(nil, []byte("key050"))
+	var latest []string
+	for key, value := range it.Backward() {
+		if string(value) != "value"+string(key[3:]) {
+			t.Errorf("Wrong value %s for key %s", value, key)
+		}
+		if latest = append(latest, string(key)); len(latest) == 3 {
+			break
+		}
+	}
+	if fmt.Sprint(latest) != "[key049 key048 key047]" || it.Err() != nil {
+		t.Errorf("Unexpected latest keys %v, err %v", latest, it.Err())
+	}
+}
+
+// TestPrefixScanAndDelete verifies that ScanPrefix and DeletePrefix
+// 1. Only touch keys starting with the prefix
+// 2. Handle prefixes ending in 0xFF bytes
+// 3. Are replayed from the log after a crash
+func TestPrefixScanAndDelete(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	database, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to create DB: %v", err)
+	}
+
+	keys := []string{"user:1:name", "user:12:name", "user:2:a", "user:2:b", "user:20:a", "user:3", "users", "\xff\xffa", "\xff\xff\xff"}
+	for i := 0; i < 500; i++ {
+		keys = append(keys, fmt.Sprintf("user:2:item%03d", i), fmt.Sprintf("user:4:item%03d", i))
+	}
+	for _, key := range keys {
+		if err := database.Put([]byte(key), []byte("v:"+key)); err != nil {
+			t.Fatalf("Failed to put key %s: %v", key, err)
+		}
+	}
+
+	prefixCount := func(prefix string) int {
+		n := 0
+		err := database.ScanPrefix([]byte(prefix), func(key, value []byte) bool {
+			if !strings.HasPrefix(string(key), prefix) || string(value) != "v:"+string(key) {
+				t.Errorf("ScanPrefix(%q) returned %s=%s", prefix, key, value)
+			}
+			n++
+			return true
+		})
+		if err != nil {
+			t.Fatalf("Failed to scan prefix %q: %v", prefix, err)
+		}
+		return n
+	}
+	for prefix, expected := range map[string]int{"user:2:": 502, "user:1": 2, "user:": 1006, "\xff\xff": 2, "\xff\xff\xff": 1, "": len(keys), "x": 0} {
+		if n := prefixCount(prefix); n != expected {
+			t.Errorf("ScanPrefix(%q): expected %d keys, got %d", prefix, expected, n)
+		}
+	}
+
+	if count, err := database.DeletePrefix([]byte("user:2:")); err != nil || count != 502 {
+		t.Fatalf("Expected 502 keys deleted, got %d, err %v", count, err)
+	}
+	if count, err := database.DeletePrefix([]byte("\xff\xff")); err != nil || count != 2 {
+		t.Fatalf("Expected 2 keys deleted, got %d, err %v", count, err)
+	}
+	if count, err := database.DeletePrefix([]byte("nothing")); err != nil || count != 0 {
+		t.Fatalf("Expected no keys deleted, got %d, err %v", count, err)
+	}
+	crash(t, database)
+
+	database, err = NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer database.Close()
+
+	for prefix, expected := range map[string]int{"user:2:": 0, "user:20": 1, "user:4:": 500, "user:": 504, "\xff": 0} {
+		if n := prefixCount(prefix); n != expected {
+			t.Errorf("After recovery, ScanPrefix(%q): expected %d keys, got %d", prefix, expected, n)
+		}
+	}
+}
+
+// TestScanReportsCorruptPage verifies that a damaged page stops a scan with ErrCorruptPage
+func TestScanReportsCorruptPage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	writeTestDB(t, path)
+
+	database, err := Open(path, &Options{CreateIfMissing: true, CacheBytes: -1})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer database.Close()
+
+	if _, err := database.storage.File.WriteAt([]byte{0xFF}, database.pageOffset(database.tree.Root)+100); err != nil {
+		t.Fatalf("Failed to damage page: %v", err)
+	}
+
+	err = database.Scan(nil, nil, func(key, value []byte) bool { return true })
+	if !errors.Is(err, ErrCorruptPage) {
+		t.Errorf("Expected ErrCorruptPage from Scan, got %v", err)
+	}
+	err = database.ScanReverse(nil, nil, func(key, value []byte) bool { return true })
+	if !errors.Is(err, ErrCorruptPage) {
+		t.Errorf("Expected ErrCorruptPage from ScanReverse, got %v", err)
+	}
+}
@@ -3,19 +3,61 @@ package db
 
 import (
 	"build-your-own-database/pkg/btree"
+	"build-your-own-database/pkg/cache"
 	"build-your-own-database/pkg/storage"
+	"build-your-own-database/pkg/wal"
+	"errors"
+	"fmt"
+	"os"
 	"sync"
+	"sync/atomic"
 )
 
+// Errors returned by Put, Get and Delete for keys and values the tree cannot store
+var (
+	ErrEmptyKey      = btree.ErrEmptyKey      // The key is empty
+	ErrKeyTooLarge   = btree.ErrKeyTooLarge   // The key is longer than btree.Config.MaxKeySize
+	ErrValueTooLarge = btree.ErrValueTooLarge // The value is longer than btree.Config.MaxValSize
+)
+
+// ErrClosed is returned by Close and by every read or update of a database
+// that is already closed
+var ErrClosed = errors.New("db: database is closed")
+
 // DB represents the main database structure that provides thread-safe access
 // to a persistent key-value store backed by a B+ tree
 type DB struct {
-	tree    *btree.BTree     // B+ tree for efficient key-value storage and retrieval
-	storage *storage.Storage // Handles persistent storage operations on disk
-	mu      sync.RWMutex     // Read-write mutex for thread-safe concurrent access
+	tree      *btree.BTree     // B+ tree for efficient key-value storage and retrieval
+	storage   *storage.Storage // Handles persistent storage operations on disk
+	cache     *cache.Cache     // Verified tree pages, invalidated when a page is freed or rewritten
+	wal       *wal.Log         // Write-ahead log of updates since the last checkpoint
+	logLock   *os.File         // Holds the writer lock on the log file, nil when read-only
+	metaSeen  metaImage        // Meta pages the root was read from, only set when read-only
+	mu        sync.RWMutex     // Read-write mutex for thread-safe concurrent access
+	writer    sync.Mutex       // Serializes writers, held by write transactions until they end
+	queueMu   sync.Mutex       // Guards queue
+	queue     []*writeRequest  // Writes waiting for a group commit, the head leads the next group
+	queueDone *sync.Cond       // Signalled when a group is committed
+	opts      Options          // Options the database was opened with
+	path      string           // Path of the database file
+	pageSize  int              // Size of every page in the database file
+	pageCount uint64           // Number of allocated pages including the meta pages
+	free      freeList         // Pages released by the tree and available for reuse
+	lsn       uint64           // LSN of the last log record applied to the tree
+	seq       uint64           // Sequence number of the last written meta page
+	dirty     bool             // Whether there are commits not yet recorded in a meta page
+	version   uint64           // Number of commits since the database was opened
+	snapMu    sync.Mutex       // Guards the reader table
+	snapshots map[uint64]int   // Reader table, number of open snapshots per version
+	snapDone  *sync.Cond       // Signalled when a snapshot is closed
+	conflicts conflictLog      // Keys written by recent commits, for optimistic transactions
+	syncErr   error            // Error from the background sync loop, reported by the next write
+	done      chan struct{}    // Closed to stop the background sync loop
+	closed    atomic.Bool      // Set by the first call to Close
+	wg        sync.WaitGroup   // Waits for the background sync loop to exit
 }
 
-// NewDB creates and initializes a new database instance
+// NewDB creates and initializes a new database instance with default options
 // Parameters:
 //   - path: The filesystem path where the database file will be stored
 //
@@ -23,51 +65,109 @@ type DB struct {
 //   - *DB: A pointer to the initialized database
 //   - error: Any error that occurred during initialization
 func NewDB(path string) (*DB, error) {
-	s, err := storage.NewStorage(path)
+	return Open(path, nil)
+}
+
+// Open creates or opens a database file with the given options
+// Parameters:
+//   - path: The filesystem path where the database file will be stored,
+//     the write-ahead log is kept next to it with a "-wal" suffix
+//   - opts: Options to open the database with, nil selects DefaultOptions
+//
+// Returns:
+//   - *DB: A pointer to the initialized database
+//   - error: Any error that occurred during initialization, fs.ErrNotExist
+//     for a missing database that is not created, fs.ErrExist for an
+//     existing one with Options.ErrorIfExists, ErrLocked if another process
+//     has the database open for writing, or is compacting it
+//
+// Any number of processes may open the database with Options.ReadOnly while
+// one process has it open for writing. They see the commits of the writer up
+// to its last checkpoint, see Multi-Process Readers and Checkpoint.
+func Open(path string, opts *Options) (*DB, error) {
+	o := opts.withDefaults()
+	if o.PageSize != 0 && !validPageSize(o.PageSize) {
+		return nil, fmt.Errorf("%w: %d is not a power of two from %d to %d", ErrPageSize, o.PageSize, MinPageSize, MaxPageSize)
+	}
+	if o.ReadOnly && o.ErrorIfExists {
+		return nil, errors.New("db: ErrorIfExists cannot be combined with ReadOnly")
+	}
+
+	// Every process takes a shared lock on the file, the writer lock keeps
+	// writers apart. Readers in other processes copy and verify every node
+	// they read, because the writer may reuse a page under them.
+	s, err := storage.Open(path, &storage.Options{
+		Mmap:        !o.ReadOnly,
+		ReadOnly:    o.ReadOnly,
+		MustExist:   !o.CreateIfMissing,
+		Exclusive:   o.ErrorIfExists,
+		Perm:        o.FileMode,
+		SharedLock:  true,
+		LockTimeout: o.LockTimeout,
+	})
 	if err != nil {
 		return nil, err
 	}
+	if o.ReadOnly {
+		// Cached nodes would go stale when the writer reuses their pages
+		o.CacheBytes = -1
+	}
 
 	db := &DB{
-		storage: s,
+		storage:   s,
+		cache:     cache.New(o.CacheBytes),
+		opts:      o,
+		path:      path,
+		snapshots: make(map[uint64]int),
+		done:      make(chan struct{}),
 	}
+	db.snapDone = sync.NewCond(&db.snapMu)
+	db.queueDone = sync.NewCond(&db.queueMu)
 
 	// Initialize the B+ tree with storage callbacks for persistence
-	db.tree = btree.NewBTree(
-		// Get callback: Reads a node from disk using its page pointer
-		func(ptr uint64) []byte {
-			data, err := s.Read(int64(ptr), int(btree.DefaultConfig.PageSize))
-			if err != nil {
-				panic(err)
-			}
-			return data
-		},
-
-		// New callback: Allocates space for a new node and writes it to disk
-		func(node []byte) uint64 {
-			// Get the current file size to use as the offset for new data
-			stat, err := s.File.Stat()
-			if err != nil {
-				panic(err)
-			}
-			offset := stat.Size()
-
-			// Write the node to disk at the calculated offset
-			if err := s.Write(offset, node); err != nil {
-				panic(err)
-			}
-
-			return uint64(offset)
-		},
-
-		// Del callback: Handles deletion of nodes
-		// Currently implements a simple strategy where deleted space is not reclaimed
-		func(ptr uint64) {
-			// In this simple implementation, we don't actually delete data
-			// We just mark the space as free for reuse
-		},
-	)
+	// Its nodes are sized once the page size is known
+	db.tree = btree.NewBTree(db.pageGet, db.pageNew, db.pageDel)
+	db.tree.Config.CheckedPages = true
 
+	if !o.ReadOnly {
+		// Taken before the file is touched, another writer may be initializing it
+		db.logLock, err = lockLog(path+"-wal", o)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	if err := db.loadMeta(o.PageSize); err != nil {
+		db.closeFiles()
+		return nil, err
+	}
+	if o.ReadOnly {
+		// Nothing is written, so the log cannot be replayed into the tree
+		if err := db.refresh(); err != nil {
+			db.closeFiles()
+			return nil, err
+		}
+		o.Logger.Debug("db: opened read-only", "path", path, "pageSize", db.pageSize, "pages", db.pageCount)
+		return db, nil
+	}
+
+	// Bring the tree up to date with updates logged after the last checkpoint
+	db.wal, err = wal.OpenFile(path+"-wal", o.FileMode)
+	if err != nil {
+		db.closeFiles()
+		return nil, err
+	}
+	if err := db.recover(); err != nil {
+		db.closeFiles()
+		return nil, err
+	}
+
+	if db.opts.SyncMode == SyncInterval {
+		db.wg.Add(1)
+		go db.syncLoop()
+	}
+
+	o.Logger.Debug("db: opened", "path", path, "pageSize", db.pageSize, "pages", db.pageCount)
 	return db, nil
 }
 
@@ -77,13 +177,23 @@ func NewDB(path string) (*DB, error) {
 //   - value: The value to associate with the key
 //
 // Returns:
-//   - error: Any error that occurred during the operation
+//   - error: Any error that occurred during the operation, ErrReadOnly,
+//     ErrClosed, ErrEmptyKey, ErrKeyTooLarge or ErrValueTooLarge for a pair
+//     that cannot be stored, ErrCorruptPage if a page on the path to the key fails verification
+//
+// If the update cannot be applied the database is left unchanged. Concurrent
+// calls are committed together, see Group Commit.
 func (db *DB) Put(key, value []byte) error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	// Reject invalid pairs before they reach the log
+	if err := db.tree.Config.Validate(key, value); err != nil {
+		return err
+	}
 
-	db.tree.Insert(key, value)
-	return nil
+	return db.submit(&writeRequest{typ: wal.RecordPut, key: key, value: value})
 }
 
 // Get retrieves a value from the database by its key
@@ -93,11 +203,20 @@ func (db *DB) Put(key, value []byte) error {
 // Returns:
 //   - []byte: The value associated with the key
 //   - bool: true if the key was found, false otherwise
-func (db *DB) Get(key []byte) ([]byte, bool) {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
-
-	return db.tree.Search(key)
+//   - error: Any error that occurred while reading, ErrClosed, ErrEmptyKey for
+//     an empty key, ErrCorruptPage if a page on the path to the key fails verification
+//
+// The lookup runs on a snapshot, so it does not wait for the lock while reading.
+// In a read-only database a lookup the writer overtook is retried.
+func (db *DB) Get(key []byte) ([]byte, bool, error) {
+	for {
+		s := db.Snapshot()
+		value, found, err := s.Get(key)
+		s.Close()
+		if !errors.Is(err, ErrSnapshotExpired) {
+			return value, found, err
+		}
+	}
 }
 
 // Delete removes a key-value pair from the database
@@ -105,33 +224,120 @@ func (db *DB) Get(key []byte) ([]byte, bool) {
 //   - key: The key to remove
 //
 // Returns:
-//   - error: Any error that occurred during the operation
+//   - error: Any error that occurred during the operation, ErrReadOnly,
+//     ErrClosed, ErrEmptyKey for an empty key, ErrCorruptPage if a page on the path to
+//     the key fails verification
+//
+// If the update cannot be applied the database is left unchanged. Concurrent
+// calls are committed together, see Group Commit.
 func (db *DB) Delete(key []byte) error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+
+	return db.submit(&writeRequest{typ: wal.RecordDelete, key: key})
+}
+
+// lockWrite waits for other writers and readers and locks the database for an update
+func (db *DB) lockWrite() {
+	db.writer.Lock()
 	db.mu.Lock()
-	defer db.mu.Unlock()
+}
+
+// unlockWrite releases the locks taken by lockWrite
+func (db *DB) unlockWrite() {
+	db.mu.Unlock()
+	db.writer.Unlock()
+}
 
-	db.tree.Delete(key)
-	return nil
+// Sync forces all commits made so far to stable storage
+// This is only needed in SyncInterval or SyncNone mode, where commits
+// are not fsynced individually
+//
+// Returns:
+//   - error: Any error that occurred while syncing, ErrClosed
+func (db *DB) Sync() error {
+	if db.opts.ReadOnly {
+		return nil
+	}
+	if db.closed.Load() {
+		return ErrClosed
+	}
+	return db.wal.Sync()
 }
 
 // Close safely shuts down the database, ensuring all data is properly saved
 // Returns:
-//   - error: Any error that occurred during shutdown
+//   - error: Any error that occurred during shutdown, ErrClosed if the
+//     database was closed before
 func (db *DB) Close() error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
+	if !db.closed.CompareAndSwap(false, true) {
+		return ErrClosed
+	}
+
+	// Stop the background sync loop first, it needs the lock to exit
+	close(db.done)
+	db.wg.Wait()
+
+	// Wait for open transactions and snapshots to end, they read from the mapping
+	db.lockWrite()
+	defer db.unlockWrite()
+	db.waitSnapshots()
+
+	var err error
+	if !db.opts.ReadOnly {
+		err = db.checkpoint()
+	}
+	if cerr := db.closeFiles(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// closeFiles closes the log, the writer lock and the database file,
+// whichever of them are open
+func (db *DB) closeFiles() error {
+	// Cached pages point into the memory mapping, which is unmapped below
+	db.cache.Clear()
 
-	return db.storage.Close()
+	var err error
+	if db.wal != nil {
+		err = db.wal.Close()
+	}
+	if db.logLock != nil {
+		if cerr := db.logLock.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if cerr := db.storage.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// CacheStats reports hit and miss counters and the usage of the page cache
+// Returns:
+//   - cache.Stats: Counters since the database was opened
+func (db *DB) CacheStats() cache.Stats {
+	return db.cache.Stats()
 }
 
 // Traverse walks through all key-value pairs in the database in order
 // Parameters:
 //   - visit: A callback function that will be called for each key-value pair
 //
-// The callback function receives each key-value pair in sorted order by key
-func (db *DB) Traverse(visit func(key, value []byte)) {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
+// Returns:
+//   - error: Any error that occurred while reading, the traversal stops at it
+//
+// The callback function receives each key-value pair in sorted order by key.
+// The slices passed to it are only valid during the call and must not be modified.
+// The traversal runs on a snapshot, writers are not blocked by it.
+func (db *DB) Traverse(visit func(key, value []byte)) error {
+	s := db.Snapshot()
+	defer s.Close()
 
-	db.tree.Traverse(visit)
+	return s.Traverse(visit)
 }
@@ -2,10 +2,15 @@ package db
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io/fs"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestNewDB(t *testing.T) {
@@ -44,7 +49,10 @@ func TestPutAndGet(t *testing.T) {
 	}
 
 	// Get value
-	got, found := database.Get(key)
+	got, found, err := database.Get(key)
+	if err != nil {
+		t.Fatalf("Failed to get key: %v", err)
+	}
 	if !found {
 		t.Error("Failed to get value")
 	}
@@ -76,7 +84,7 @@ func TestDelete(t *testing.T) {
 	}
 
 	// Verify deletion
-	if _, found := database.Get(key); found {
+	if _, found, err := database.Get(key); err != nil || found {
 		t.Error("Deleted key still exists")
 	}
 }
@@ -108,9 +116,12 @@ func TestTraverse(t *testing.T) {
 
 	// Collect data during traversal
 	found := make(map[string]string)
-	database.Traverse(func(key, value []byte) {
+	err = database.Traverse(func(key, value []byte) {
 		found[string(key)] = string(value)
 	})
+	if err != nil {
+		t.Fatalf("Failed to traverse: %v", err)
+	}
 
 	// Verify all pairs were found
 	if len(found) != len(pairs) {
@@ -148,7 +159,10 @@ func TestUpdateExistingKey(t *testing.T) {
 	}
 
 	// Verify update
-	got, found := database.Get(key)
+	got, found, err := database.Get(key)
+	if err != nil {
+		t.Fatalf("Failed to get key: %v", err)
+	}
 	if !found {
 		t.Error("Failed to get updated value")
 	}
@@ -181,7 +195,10 @@ func TestLargeDataset(t *testing.T) {
 	for i := 0; i < numPairs; i++ {
 		key := []byte(fmt.Sprintf("key%d", i))
 		expectedValue := []byte(fmt.Sprintf("value%d", i))
-		got, found := database.Get(key)
+		got, found, err := database.Get(key)
+		if err != nil {
+			t.Fatalf("Failed to get key: %v", err)
+		}
 		if !found {
 			t.Errorf("Failed to find key %s", key)
 		}
@@ -201,14 +218,15 @@ func TestEdgeCases(t *testing.T) {
 	}
 	defer database.Close()
 
-	// Test empty key
-	if err := database.Put([]byte{}, []byte("empty")); err != nil {
-		t.Fatalf("Failed to put empty key: %v", err)
+	// Test empty key, it is reserved by the tree
+	if err := database.Put([]byte{}, []byte("empty")); !errors.Is(err, ErrEmptyKey) {
+		t.Errorf("Expected ErrEmptyKey from Put, got %v", err)
 	}
-	if val, found := database.Get([]byte{}); !found {
-		t.Error("Failed to find empty key")
-	} else if !bytes.Equal(val, []byte("empty")) {
-		t.Error("Wrong value for empty key")
+	if _, _, err := database.Get([]byte{}); !errors.Is(err, ErrEmptyKey) {
+		t.Errorf("Expected ErrEmptyKey from Get, got %v", err)
+	}
+	if err := database.Delete([]byte{}); !errors.Is(err, ErrEmptyKey) {
+		t.Errorf("Expected ErrEmptyKey from Delete, got %v", err)
 	}
 
 	// Test very long key
@@ -217,20 +235,713 @@ func TestEdgeCases(t *testing.T) {
 	if err := database.Put(longKey, longValue); err != nil {
 		t.Fatalf("Failed to put long key: %v", err)
 	}
-	if val, found := database.Get(longKey); !found {
+	if val, found, err := database.Get(longKey); err != nil || !found {
 		t.Error("Failed to find long key")
 	} else if !bytes.Equal(val, longValue) {
 		t.Error("Wrong value for long key")
 	}
 
+	// Test keys and values over the limits, they must not reach the log
+	logSize := database.wal.Size()
+	if err := database.Put(append(longKey, 'x'), []byte("value")); !errors.Is(err, ErrKeyTooLarge) {
+		t.Errorf("Expected ErrKeyTooLarge, got %v", err)
+	}
+	hugeValue := make([]byte, database.tree.Config.MaxValSize+1)
+	if err := database.Put([]byte("key"), hugeValue); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("Expected ErrValueTooLarge, got %v", err)
+	}
+	if database.wal.Size() != logSize {
+		t.Error("Rejected put was written to the log")
+	}
+
 	// Test special characters in key
 	specialKey := []byte("!@#$%^&*()")
 	if err := database.Put(specialKey, []byte("special")); err != nil {
 		t.Fatalf("Failed to put special key: %v", err)
 	}
-	if val, found := database.Get(specialKey); !found {
+	if val, found, err := database.Get(specialKey); err != nil || !found {
 		t.Error("Failed to find special key")
 	} else if !bytes.Equal(val, []byte("special")) {
 		t.Error("Wrong value for special key")
 	}
 }
+
+func TestReopen(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := filepath.Join(tmpDir, "test.db")
+
+	database, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+
+	// Insert enough data to grow the tree beyond a single page
+	const numPairs = 500
+	for i := 0; i < numPairs; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		value := []byte(fmt.Sprintf("value%d", i))
+		if err := database.Put(key, value); err != nil {
+			t.Fatalf("Failed to put value: %v", err)
+		}
+	}
+	if err := database.Delete([]byte("key0")); err != nil {
+		t.Fatalf("Failed to delete key: %v", err)
+	}
+	if err := database.Close(); err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+	if err := database.Close(); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from a second Close, got %v", err)
+	}
+
+	// Reopen and verify that everything written before is still reachable
+	database, err = NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer database.Close()
+
+	if _, found, err := database.Get([]byte("key0")); err != nil || found {
+		t.Error("Deleted key exists after reopen")
+	}
+	for i := 1; i < numPairs; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		expectedValue := []byte(fmt.Sprintf("value%d", i))
+		got, found, err := database.Get(key)
+		if err != nil {
+			t.Fatalf("Failed to get key: %v", err)
+		}
+		if !found {
+			t.Errorf("Failed to find key %s after reopen", key)
+		} else if !bytes.Equal(got, expectedValue) {
+			t.Errorf("Expected value %s for key %s, got %s", expectedValue, key, got)
+		}
+	}
+}
+
+// TestUseAfterClose verifies that every read and update of a closed database
+// fails with ErrClosed, also for keys whose pages were in the page cache
+func TestUseAfterClose(t *testing.T) {
+	database, err := NewDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	for i := 0; i < 500; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		if err := database.Put(key, key); err != nil {
+			t.Fatalf("Failed to put value: %v", err)
+		}
+	}
+	if _, _, err := database.Get([]byte("key000")); err != nil {
+		t.Fatalf("Failed to get key: %v", err)
+	}
+	if err := database.Close(); err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+
+	if _, _, err := database.Get([]byte("key000")); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from Get, got %v", err)
+	}
+	s := database.Snapshot()
+	if _, _, err := s.Get([]byte("key000")); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from a snapshot, got %v", err)
+	}
+	s.Close()
+	if err := database.Scan(nil, nil, func(key, value []byte) bool { return true }); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from Scan, got %v", err)
+	}
+	if err := database.Traverse(func(key, value []byte) {}); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from Traverse, got %v", err)
+	}
+	for _, writable := range []bool{false, true} {
+		if _, err := database.Begin(writable); !errors.Is(err, ErrClosed) {
+			t.Errorf("Expected ErrClosed from Begin(%v), got %v", writable, err)
+		}
+	}
+	if _, err := database.BeginOptimistic(); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from BeginOptimistic, got %v", err)
+	}
+
+	if err := database.Put([]byte("key"), []byte("value")); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from Put, got %v", err)
+	}
+	if err := database.Delete([]byte("key000")); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from Delete, got %v", err)
+	}
+	var b Batch
+	b.Put([]byte("key"), []byte("value"))
+	if err := database.Write(&b); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from Write, got %v", err)
+	}
+	if _, err := database.DeletePrefix([]byte("key")); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from DeletePrefix, got %v", err)
+	}
+	if _, err := database.Import(func(yield func(key, value []byte) bool) {}, 0); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from Import, got %v", err)
+	}
+	if _, err := database.Compact(); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from Compact, got %v", err)
+	}
+	if err := database.Checkpoint(); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from Checkpoint, got %v", err)
+	}
+}
+
+func TestOpenInvalidFile(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := filepath.Join(tmpDir, "test.db")
+
+	// A non-empty file without a valid meta page must be rejected
+	if err := os.WriteFile(path, bytes.Repeat([]byte("x"), 4096), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	if _, err := NewDB(path); !errors.Is(err, ErrInvalidMeta) {
+		t.Errorf("Expected ErrInvalidMeta, got %v", err)
+	}
+}
+
+// TestPageSize verifies that the page size
+// 1. Is taken from the options for a new database and recorded in its meta pages
+// 2. Is read back from the file when reopening, even with a damaged first meta page
+// 3. Cannot be changed for an existing file, and must be a supported size
+func TestPageSize(t *testing.T) {
+	if _, err := Open(filepath.Join(t.TempDir(), "test.db"), &Options{PageSize: 5000}); !errors.Is(err, ErrPageSize) {
+		t.Errorf("Expected ErrPageSize for 5000 byte pages, got %v", err)
+	}
+
+	for _, size := range []int{8 << 10, MaxPageSize} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.db")
+			database, err := Open(path, &Options{CreateIfMissing: true, PageSize: size})
+			if err != nil {
+				t.Fatalf("Failed to create DB: %v", err)
+			}
+			large := bytes.Repeat([]byte("v"), 100000)
+			for i := 0; i < 2000; i++ {
+				value := []byte(fmt.Sprintf("value%d", i))
+				if i%100 == 0 {
+					value = large
+				}
+				if err := database.Put([]byte(fmt.Sprintf("key%05d", i)), value); err != nil {
+					t.Fatalf("Failed to put: %v", err)
+				}
+			}
+			if err := database.Close(); err != nil {
+				t.Fatalf("Failed to close DB: %v", err)
+			}
+
+			if _, err := Open(path, &Options{PageSize: DefaultPageSize}); !errors.Is(err, ErrPageSize) {
+				t.Errorf("Expected ErrPageSize when opening with 4096 byte pages, got %v", err)
+			}
+
+			// The first meta page is damaged, the second one sits one page into the file
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("Failed to read file: %v", err)
+			}
+			if len(data)%size != 0 {
+				t.Errorf("File size %d is not a multiple of %d", len(data), size)
+			}
+			data[20] ^= 0xFF
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				t.Fatalf("Failed to write file: %v", err)
+			}
+
+			database, err = NewDB(path)
+			if err != nil {
+				t.Fatalf("Failed to reopen DB: %v", err)
+			}
+			defer database.Close()
+			if database.pageSize != size {
+				t.Errorf("Expected %d byte pages, got %d", size, database.pageSize)
+			}
+			if value, _, err := database.Get([]byte("key01900")); err != nil || !bytes.Equal(value, large) {
+				t.Errorf("Expected the large value, got %d bytes, err %v", len(value), err)
+			}
+			if value, _, err := database.Get([]byte("key01999")); err != nil || string(value) != "value1999" {
+				t.Errorf("Expected value1999, got %q, err %v", value, err)
+			}
+		})
+	}
+}
+
+// TestOpenOptions verifies that Open
+// 1. Only creates a missing database with CreateIfMissing
+// 2. Fails for an existing database with ErrorIfExists
+// 3. Creates the files with FileMode and reports recovery to the Logger
+func TestOpenOptions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	if _, err := Open(path, &Options{}); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected fs.ErrNotExist, got %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected no file to be created, stat returned %v", err)
+	}
+
+	database, err := Open(path, &Options{CreateIfMissing: true, ErrorIfExists: true, FileMode: 0600})
+	if err != nil {
+		t.Fatalf("Failed to create DB: %v", err)
+	}
+	if err := database.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	crash(t, database)
+
+	for _, name := range []string{path, path + "-wal"} {
+		if stat, err := os.Stat(name); err != nil || stat.Mode().Perm() != 0600 {
+			t.Errorf("Expected permissions 0600 for %s, got %v, err %v", name, stat.Mode().Perm(), err)
+		}
+	}
+	if _, err := Open(path, &Options{CreateIfMissing: true, ErrorIfExists: true}); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("Expected fs.ErrExist, got %v", err)
+	}
+
+	var logs bytes.Buffer
+	database, err = Open(path, &Options{Logger: slog.New(slog.NewTextHandler(&logs, nil))})
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer database.Close()
+	if !strings.Contains(logs.String(), "replayed log") {
+		t.Errorf("Expected the replay to be logged, got %q", logs.String())
+	}
+	if value, _, err := database.Get([]byte("key")); err != nil || string(value) != "value" {
+		t.Errorf("Expected value, got %q, err %v", value, err)
+	}
+}
+
+// TestReadOnly verifies that a read-only database can be read, rejects every
+// update with ErrReadOnly and leaves the file untouched
+func TestReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	if _, err := Open(path, &Options{ReadOnly: true, CreateIfMissing: true}); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected fs.ErrNotExist for a missing read-only database, got %v", err)
+	}
+
+	database, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to create DB: %v", err)
+	}
+	if err := database.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if err := database.Close(); err != nil {
+		t.Fatalf("Failed to close DB: %v", err)
+	}
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+
+	database, err = Open(path, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Failed to open DB read-only: %v", err)
+	}
+	if value, _, err := database.Get([]byte("key")); err != nil || string(value) != "value" {
+		t.Errorf("Expected value, got %q, err %v", value, err)
+	}
+
+	var b Batch
+	b.Put([]byte("a"), []byte("b"))
+	_, beginErr := database.Begin(true)
+	_, prefixErr := database.DeletePrefix([]byte("k"))
+	_, importErr := database.Import(importPairs(0, 1), 0)
+	_, compactErr := database.Compact()
+	for name, err := range map[string]error{
+		"Put":          database.Put([]byte("key"), []byte("new")),
+		"Delete":       database.Delete([]byte("key")),
+		"Write":        database.Write(&b),
+		"Begin":        beginErr,
+		"DeletePrefix": prefixErr,
+		"Import":       importErr,
+		"Compact":      compactErr,
+	} {
+		if !errors.Is(err, ErrReadOnly) {
+			t.Errorf("Expected ErrReadOnly from %s, got %v", name, err)
+		}
+	}
+	if err := database.Close(); err != nil {
+		t.Fatalf("Failed to close DB: %v", err)
+	}
+
+	if after, _ := os.ReadFile(path); !bytes.Equal(before, after) {
+		t.Error("The read-only database changed the file")
+	}
+}
+
+// TestLocked verifies that a database cannot be opened twice for writing
+func TestLocked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	database, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to create DB: %v", err)
+	}
+
+	if _, err := NewDB(path); !errors.Is(err, ErrLocked) {
+		t.Errorf("Expected ErrLocked for a second writer, got %v", err)
+	}
+
+	// The lock is released on close
+	go func(database *DB) {
+		time.Sleep(50 * time.Millisecond)
+		database.Close()
+	}(database)
+	database, err = Open(path, &Options{LockTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("Failed to wait for the lock: %v", err)
+	}
+	database.Close()
+}
+
+func TestPagesAreReused(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := filepath.Join(tmpDir, "test.db")
+
+	database, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+
+	for i := 0; i < 200; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		if err := database.Put(key, []byte("value")); err != nil {
+			t.Fatalf("Failed to put value: %v", err)
+		}
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Failed to stat file: %v", err)
+	}
+	size := stat.Size()
+
+	// Rewriting existing keys frees as many pages as it allocates,
+	// so the file must stay the same size however often it happens
+	for round := 0; round < 20; round++ {
+		for i := 0; i < 200; i++ {
+			key := []byte(fmt.Sprintf("key%d", i))
+			value := []byte(fmt.Sprintf("value%d", round))
+			if err := database.Put(key, value); err != nil {
+				t.Fatalf("Failed to put value: %v", err)
+			}
+		}
+	}
+	if err := database.Close(); err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+
+	stat, err = os.Stat(path)
+	if err != nil {
+		t.Fatalf("Failed to stat file: %v", err)
+	}
+	if stat.Size() > 2*size {
+		t.Errorf("File grew from %d to %d bytes while rewriting the same keys", size, stat.Size())
+	}
+
+	// The free list must survive a reopen
+	database, err = NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer database.Close()
+
+	if len(database.free.free) == 0 {
+		t.Error("Free list is empty after reopen")
+	}
+	for i := 0; i < 200; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		if got, found, err := database.Get(key); err != nil || !found || string(got) != "value19" {
+			t.Errorf("Expected value19 for key %s, got %s", key, got)
+		}
+	}
+}
+
+// TestLargeValues verifies that values far larger than a page
+// 1. Are stored and read back intact, also after a reopen
+// 2. Give their overflow pages back when they are replaced
+func TestLargeValues(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := filepath.Join(tmpDir, "test.db")
+
+	database, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+
+	values := make([][]byte, 3)
+	for i := range values {
+		values[i] = bytes.Repeat([]byte(fmt.Sprintf("value%d-", i)), (8<<20)/7)
+		if err := database.Put([]byte(fmt.Sprintf("key%d", i)), values[i]); err != nil {
+			t.Fatalf("Failed to put large value: %v", err)
+		}
+	}
+	pageCount := database.pageCount
+
+	// Rewriting a value reuses the pages of old chains. The chain of the
+	// last checkpoint is kept until the next one, so at most one extra
+	// chain (a third of the file here) may be needed.
+	for round := 0; round < 5; round++ {
+		if err := database.Put([]byte("key0"), values[0]); err != nil {
+			t.Fatalf("Failed to rewrite large value: %v", err)
+		}
+	}
+	if database.pageCount > pageCount+pageCount/2 {
+		t.Errorf("File grew from %d to %d pages while rewriting a value", pageCount, database.pageCount)
+	}
+	if err := database.Close(); err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+
+	database, err = NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer database.Close()
+
+	for i, expected := range values {
+		got, found, err := database.Get([]byte(fmt.Sprintf("key%d", i)))
+		if err != nil || !found {
+			t.Fatalf("Failed to find key%d: found %v, err %v", i, found, err)
+		}
+		if !bytes.Equal(got, expected) {
+			t.Errorf("Wrong value for key%d: got %d bytes, expected %d", i, len(got), len(expected))
+		}
+	}
+}
+
+// TestGetReturnsCopy verifies that values returned by Get stay intact when
+// the pages they were read from are reused by later updates
+func TestGetReturnsCopy(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := filepath.Join(tmpDir, "test.db")
+
+	database, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer database.Close()
+
+	if err := database.Put([]byte("key"), []byte("original")); err != nil {
+		t.Fatalf("Failed to put value: %v", err)
+	}
+	got, found, err := database.Get([]byte("key"))
+	if err != nil || !found {
+		t.Fatalf("Failed to get value: found %v, err %v", found, err)
+	}
+
+	for i := 0; i < 100; i++ {
+		if err := database.Put([]byte("key"), []byte(fmt.Sprintf("updated%d", i))); err != nil {
+			t.Fatalf("Failed to put value: %v", err)
+		}
+	}
+	if string(got) != "original" {
+		t.Errorf("Value returned by Get changed to %s", got)
+	}
+}
+
+// readMetaFromFile decodes the newest meta page directly from the file
+func readMetaFromFile(t *testing.T, path string) (meta, []byte) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+	const pageSize = 4096
+	m, err := newestMeta([metaPages][]byte{data[:pageSize], data[pageSize : 2*pageSize]})
+	if err != nil {
+		t.Fatalf("Failed to decode meta pages: %v", err)
+	}
+	return m, data
+}
+
+func TestTornMetaFallsBackToPreviousCommit(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := filepath.Join(tmpDir, "test.db")
+
+	// Each close checkpoints, so the two keys end up in two meta pages
+	for _, key := range []string{"first", "second"} {
+		database, err := NewDB(path)
+		if err != nil {
+			t.Fatalf("Failed to open database: %v", err)
+		}
+		if err := database.Put([]byte(key), []byte(key)); err != nil {
+			t.Fatalf("Failed to put value: %v", err)
+		}
+		if err := database.Close(); err != nil {
+			t.Fatalf("Failed to close database: %v", err)
+		}
+	}
+
+	// Simulate a torn write of the last meta page
+	m, data := readMetaFromFile(t, path)
+	data[int(m.slot())*4096+20] ^= 0xFF
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	database, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer database.Close()
+
+	if got, found, err := database.Get([]byte("first")); err != nil || !found || string(got) != "first" {
+		t.Errorf("Expected first -> first from the previous commit, got %s (found=%v)", got, found)
+	}
+	if _, found, err := database.Get([]byte("second")); err != nil || found {
+		t.Error("Found key from the torn commit")
+	}
+}
+
+func TestSyncModes(t *testing.T) {
+	modes := map[string]SyncMode{
+		"always":   SyncAlways,
+		"interval": SyncInterval,
+		"none":     SyncNone,
+	}
+
+	for name, mode := range modes {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.db")
+			opts := &Options{CreateIfMissing: true, SyncMode: mode, SyncInterval: time.Hour}
+
+			database, err := Open(path, opts)
+			if err != nil {
+				t.Fatalf("Failed to create database: %v", err)
+			}
+			for i := 0; i < 100; i++ {
+				key := []byte(fmt.Sprintf("key%d", i))
+				if err := database.Put(key, []byte("value")); err != nil {
+					t.Fatalf("Failed to put value: %v", err)
+				}
+			}
+			if err := database.Close(); err != nil {
+				t.Fatalf("Failed to close database: %v", err)
+			}
+
+			// Close must record everything regardless of the mode
+			database, err = Open(path, opts)
+			if err != nil {
+				t.Fatalf("Failed to reopen database: %v", err)
+			}
+			defer database.Close()
+			for i := 0; i < 100; i++ {
+				key := []byte(fmt.Sprintf("key%d", i))
+				if _, found, err := database.Get(key); err != nil || !found {
+					t.Errorf("Failed to find key %s after reopen", key)
+				}
+			}
+		})
+	}
+}
+
+// crash closes the files of a database without checkpointing, the way
+// they are left behind when the process dies
+func crash(t *testing.T, database *DB) {
+	t.Helper()
+	close(database.done)
+	database.wg.Wait()
+	database.closeFiles()
+}
+
+func TestRecoverFromLog(t *testing.T) {
+	modes := map[string]SyncMode{
+		"always":   SyncAlways,
+		"interval": SyncInterval,
+		"none":     SyncNone,
+	}
+
+	for name, mode := range modes {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.db")
+			opts := &Options{CreateIfMissing: true, SyncMode: mode}
+
+			database, err := Open(path, opts)
+			if err != nil {
+				t.Fatalf("Failed to create database: %v", err)
+			}
+			for i := 0; i < 300; i++ {
+				key := []byte(fmt.Sprintf("key%d", i))
+				if err := database.Put(key, []byte(fmt.Sprintf("value%d", i))); err != nil {
+					t.Fatalf("Failed to put value: %v", err)
+				}
+			}
+			for i := 0; i < 300; i += 2 {
+				if err := database.Delete([]byte(fmt.Sprintf("key%d", i))); err != nil {
+					t.Fatalf("Failed to delete key: %v", err)
+				}
+			}
+			crash(t, database)
+
+			// Nothing was checkpointed, the updates only exist in the log
+			if m, _ := readMetaFromFile(t, path); m.root != 0 {
+				t.Fatalf("Expected no checkpoint before the crash, got root %d", m.root)
+			}
+
+			database, err = Open(path, opts)
+			if err != nil {
+				t.Fatalf("Failed to reopen database: %v", err)
+			}
+			defer database.Close()
+
+			for i := 0; i < 300; i++ {
+				key := []byte(fmt.Sprintf("key%d", i))
+				got, found, err := database.Get(key)
+				if err != nil {
+					t.Fatalf("Failed to get key: %v", err)
+				}
+				if i%2 == 0 && found {
+					t.Errorf("Deleted key %s exists after recovery", key)
+				}
+				if i%2 == 1 && (!found || string(got) != fmt.Sprintf("value%d", i)) {
+					t.Errorf("Expected value%d for key %s after recovery, got %s", i, key, got)
+				}
+			}
+
+			// Recovery checkpoints, so the log starts over
+			if size := database.wal.Size(); size != 0 {
+				t.Errorf("Expected an empty log after recovery, got %d bytes", size)
+			}
+		})
+	}
+}
+
+func TestCheckpointTruncatesLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	opts := &Options{CreateIfMissing: true, CheckpointSize: 4096}
+
+	database, err := Open(path, opts)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		if err := database.Put(key, []byte(fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatalf("Failed to put value: %v", err)
+		}
+		if size := database.wal.Size(); size >= opts.CheckpointSize {
+			t.Fatalf("Log grew to %d bytes past the checkpoint size", size)
+		}
+	}
+
+	// Checkpoints happened along the way, the rest is recovered from the log
+	m, _ := readMetaFromFile(t, path)
+	if m.root == 0 || m.lsn == 0 {
+		t.Fatalf("Expected a checkpoint, got meta %+v", m)
+	}
+	crash(t, database)
+
+	database, err = Open(path, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer database.Close()
+
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		if got, found, err := database.Get(key); err != nil || !found || string(got) != fmt.Sprintf("value%d", i) {
+			t.Errorf("Expected value%d for key %s, got %s", i, key, got)
+		}
+	}
+}
@@ -0,0 +1,346 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+/*
+Free List Layout:
+
+Pages released by the B+ tree are recorded in a linked list of free list pages.
+The meta page points at the first page of the chain:
+
++----------------+----------------+----------------+----------------+-----+
+| Next (8B)      | Count (4B)     | Reserved (4B)  | Ptr 1 (8B)     | ... |
++----------------+----------------+----------------+----------------+-----+
+
+  - Next: page number of the next free list page (0 for the last one)
+  - Count: number of page pointers stored in this page
+  - Ptr: page numbers that can be reused for new nodes
+
+The list is rewritten on every checkpoint. Its own pages are taken from the
+pages that were already free, and the pages of the previous chain are released,
+so the list does not grow the file in a steady state.
+*/
+
+const (
+	freeListHeaderSize = 16 // Size of free list page header (8B next + 4B count + 4B reserved)
+)
+
+// ErrCorruptFreeList is returned when the on-disk free list cannot be decoded
+var ErrCorruptFreeList = errors.New("db: corrupt free list")
+
+// freeList keeps track of pages that are no longer referenced by the tree
+//
+// A released page stays in pending while the last checkpointed tree may still
+// reference it, because that is the tree a crash recovers from. Pages that were
+// allocated after the last checkpoint are not part of that tree, so they become
+// reusable as soon as the update releasing them is finished.
+//
+// Pages that an open snapshot may still read are held instead, tagged with the
+// version of the commit that released them, until every older snapshot is closed.
+// On disk held pages are free, a reopened database has no snapshots.
+type freeList struct {
+	head    uint64              // First page of the checkpointed on-disk list
+	free    []uint64            // Pages that can be handed out right now
+	pending []uint64            // Pages released but still part of the checkpointed tree
+	held    []heldPage          // Pages released but still visible to a snapshot
+	chain   []uint64            // Pages holding the checkpointed on-disk list
+	fresh   map[uint64]struct{} // Pages allocated since the last checkpoint
+	dirty   bool                // Whether the list changed since the last checkpoint
+
+	// Changes made by the write transaction in progress, see begin
+	recording bool     // Whether changes are recorded
+	undo      []undoOp // Recorded changes, reverted in reverse order by rollback
+	wasDirty  bool     // dirty when the transaction began
+}
+
+// Kinds of recorded changes, named after the method making them
+const (
+	undoPop = iota
+	undoPush
+	undoAllocate
+	undoRelease
+	undoForget
+)
+
+// undoOp is a change to the list made by a write transaction
+type undoOp struct {
+	kind  int    // One of the undo constants
+	ptr   uint64 // Page number the change was made for
+	index int    // Position of a forgotten page in free
+	fresh bool   // Whether a forgotten page was fresh
+}
+
+// heldPage is a released page that snapshots older than version may still read
+type heldPage struct {
+	ptr     uint64 // Page number
+	version uint64 // Version of the commit that released the page
+}
+
+// freeListCapacity returns how many page pointers fit into one list page
+func freeListCapacity(pageSize int) int {
+	return (pageSize - freeListHeaderSize) / 8
+}
+
+// load reads the on-disk list starting at head
+// Parameters:
+//   - head: page number of the first list page (0 for an empty list)
+//   - pageCount: number of pages in the file, used to validate pointers
+//   - get: reads a page by its number
+func (fl *freeList) load(head uint64, pageCount uint64, get func(uint64) ([]byte, error)) error {
+	*fl = freeList{head: head}
+
+	for ptr := head; ptr != 0; {
+		if ptr < metaPages || ptr >= pageCount || len(fl.chain) >= int(pageCount) {
+			return fmt.Errorf("%w: bad list page %d", ErrCorruptFreeList, ptr)
+		}
+
+		page, err := get(ptr)
+		if err != nil {
+			return err
+		}
+
+		count := int(binary.LittleEndian.Uint32(page[8:12]))
+		if count > freeListCapacity(len(page)) {
+			return fmt.Errorf("%w: page %d holds %d pointers", ErrCorruptFreeList, ptr, count)
+		}
+
+		for i := 0; i < count; i++ {
+			free := binary.LittleEndian.Uint64(page[freeListHeaderSize+8*i:])
+			if free < metaPages || free >= pageCount {
+				return fmt.Errorf("%w: bad free page %d", ErrCorruptFreeList, free)
+			}
+			fl.free = append(fl.free, free)
+		}
+
+		fl.chain = append(fl.chain, ptr)
+		ptr = binary.LittleEndian.Uint64(page[0:8])
+	}
+
+	return nil
+}
+
+// pop removes and returns a reusable page, if there is one
+func (fl *freeList) pop() (uint64, bool) {
+	if len(fl.free) == 0 {
+		return 0, false
+	}
+	ptr := fl.free[len(fl.free)-1]
+	fl.free = fl.free[:len(fl.free)-1]
+	fl.dirty = true
+	fl.record(undoOp{kind: undoPop, ptr: ptr})
+	return ptr, true
+}
+
+// push hands a page obtained from pop back
+func (fl *freeList) push(ptr uint64) {
+	fl.free = append(fl.free, ptr)
+	fl.record(undoOp{kind: undoPush, ptr: ptr})
+}
+
+// forget drops a page handed back with push that is given up entirely,
+// because it lies past the end of the file
+func (fl *freeList) forget(ptr uint64) {
+	op := undoOp{kind: undoForget, ptr: ptr, index: slices.Index(fl.free, ptr)}
+	if op.index >= 0 {
+		fl.free = slices.Delete(fl.free, op.index, op.index+1)
+	}
+	_, op.fresh = fl.fresh[ptr]
+	delete(fl.fresh, ptr)
+	fl.record(op)
+}
+
+// allocate records that a page is in use by the tree now
+func (fl *freeList) allocate(ptr uint64) {
+	if fl.fresh == nil {
+		fl.fresh = make(map[uint64]struct{})
+	}
+	if _, ok := fl.fresh[ptr]; !ok {
+		fl.fresh[ptr] = struct{}{}
+		fl.record(undoOp{kind: undoAllocate, ptr: ptr})
+	}
+}
+
+// release records a page that is no longer referenced by the tree
+// The page becomes reusable after recycle or the next checkpoint
+func (fl *freeList) release(ptr uint64) {
+	fl.pending = append(fl.pending, ptr)
+	fl.dirty = true
+	fl.record(undoOp{kind: undoRelease, ptr: ptr})
+}
+
+// begin starts recording the changes of a write transaction, so that
+// rollback can revert them without copying the whole list up front
+func (fl *freeList) begin() {
+	fl.recording = true
+	fl.undo = fl.undo[:0]
+	fl.wasDirty = fl.dirty
+}
+
+// end stops recording and keeps the changes of the write transaction
+func (fl *freeList) end() {
+	fl.recording = false
+	fl.undo = fl.undo[:0]
+}
+
+// rollback reverts the changes recorded since begin and stops recording
+func (fl *freeList) rollback() {
+	for i := len(fl.undo) - 1; i >= 0; i-- {
+		op := fl.undo[i]
+		switch op.kind {
+		case undoPop:
+			fl.free = append(fl.free, op.ptr)
+		case undoPush:
+			fl.free = fl.free[:len(fl.free)-1]
+		case undoAllocate:
+			delete(fl.fresh, op.ptr)
+		case undoRelease:
+			fl.pending = fl.pending[:len(fl.pending)-1]
+		case undoForget:
+			if op.index >= 0 {
+				fl.free = slices.Insert(fl.free, op.index, op.ptr)
+			}
+			if op.fresh {
+				fl.fresh[op.ptr] = struct{}{}
+			}
+		}
+	}
+	fl.dirty = fl.wasDirty
+	fl.end()
+}
+
+// record remembers a change while a write transaction is recording
+func (fl *freeList) record(op undoOp) {
+	if fl.recording {
+		fl.undo = append(fl.undo, op)
+	}
+}
+
+// recycle makes pending pages reusable that were allocated after the last
+// checkpoint. It must only be called once the update releasing them is finished.
+// Parameters:
+//   - hold: version of the finished update if open snapshots may still read
+//     the pages, which are held until they are closed, or 0 if none can
+func (fl *freeList) recycle(hold uint64) {
+	kept := fl.pending[:0]
+	for _, ptr := range fl.pending {
+		if _, ok := fl.fresh[ptr]; !ok {
+			kept = append(kept, ptr)
+			continue
+		}
+		delete(fl.fresh, ptr)
+		if hold != 0 {
+			fl.held = append(fl.held, heldPage{ptr: ptr, version: hold})
+		} else {
+			fl.free = append(fl.free, ptr)
+		}
+	}
+	fl.pending = kept
+}
+
+// holdPending holds all pending pages for open snapshots before a checkpoint
+// would make them reusable
+func (fl *freeList) holdPending(version uint64) {
+	for _, ptr := range fl.pending {
+		fl.held = append(fl.held, heldPage{ptr: ptr, version: version})
+	}
+	fl.pending = nil
+}
+
+// releaseHeld makes held pages reusable that no open snapshot can read anymore
+// Parameters:
+//   - oldest: version of the oldest open snapshot, math.MaxUint64 if there is none
+func (fl *freeList) releaseHeld(oldest uint64) {
+	kept := fl.held[:0]
+	for _, page := range fl.held {
+		if page.version <= oldest {
+			fl.free = append(fl.free, page.ptr)
+		} else {
+			kept = append(kept, page)
+		}
+	}
+	fl.held = kept
+}
+
+// clone returns a deep copy of the list, used to undo a failed checkpoint
+func (fl *freeList) clone() freeList {
+	c := *fl
+	c.free = slices.Clone(fl.free)
+	c.pending = slices.Clone(fl.pending)
+	c.held = slices.Clone(fl.held)
+	c.chain = slices.Clone(fl.chain)
+	c.fresh = maps.Clone(fl.fresh)
+	return c
+}
+
+// commit writes the list to disk as part of a checkpoint and makes the
+// pending pages reusable
+// Parameters:
+//   - pageSize: size of each list page
+//   - alloc: allocates a page at the end of the file
+//   - write: writes a page by its number
+//
+// The caller is expected to record the new head in the meta page afterwards.
+func (fl *freeList) commit(pageSize int, alloc func() uint64, write func(uint64, []byte) error) error {
+	if !fl.dirty {
+		return nil // nothing changed since the last commit
+	}
+
+	// Everything in the new list: pages held for snapshots, pages released by
+	// this update, the pages holding the old list, and the pages that were
+	// already free. Held pages come first, they are not handed out afterwards.
+	entries := make([]uint64, 0, len(fl.held)+len(fl.pending)+len(fl.chain)+len(fl.free))
+	for _, page := range fl.held {
+		entries = append(entries, page.ptr)
+	}
+	entries = append(entries, fl.pending...)
+	entries = append(entries, fl.chain...)
+	entries = append(entries, fl.free...)
+
+	// Take the pages for the new list from the already free ones, which are
+	// at the end of entries. Only fall back to growing the file when needed.
+	capacity := freeListCapacity(pageSize)
+	var chain []uint64
+	for len(chain)*capacity < len(entries) {
+		if len(fl.free) > 0 {
+			ptr, _ := fl.pop()
+			entries = entries[:len(entries)-1]
+			chain = append(chain, ptr)
+		} else {
+			chain = append(chain, alloc())
+		}
+	}
+
+	for i, ptr := range chain {
+		page := make([]byte, pageSize)
+		if i+1 < len(chain) {
+			binary.LittleEndian.PutUint64(page[0:8], chain[i+1])
+		}
+
+		batch := entries[i*capacity : min((i+1)*capacity, len(entries))]
+		binary.LittleEndian.PutUint32(page[8:12], uint32(len(batch)))
+		for j, free := range batch {
+			binary.LittleEndian.PutUint64(page[freeListHeaderSize+8*j:], free)
+		}
+
+		if err := write(ptr, page); err != nil {
+			return err
+		}
+	}
+
+	fl.head = 0
+	if len(chain) > 0 {
+		fl.head = chain[0]
+	}
+	fl.free = entries[len(fl.held):]
+	fl.pending = nil
+	fl.chain = chain
+	fl.fresh = nil
+	fl.dirty = false
+	return nil
+}
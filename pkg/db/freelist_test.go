@@ -0,0 +1,226 @@
+package db
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"sort"
+	"testing"
+)
+
+// memPages is a minimal in-memory page store for free list tests
+type memPages struct {
+	pages map[uint64][]byte
+	count uint64
+}
+
+func newMemPages() *memPages {
+	return &memPages{pages: make(map[uint64][]byte), count: 1}
+}
+
+func (m *memPages) alloc() uint64 {
+	ptr := m.count
+	m.count++
+	return ptr
+}
+
+func (m *memPages) write(ptr uint64, page []byte) error {
+	m.pages[ptr] = append([]byte(nil), page...)
+	return nil
+}
+
+func (m *memPages) read(ptr uint64) ([]byte, error) {
+	return m.pages[ptr], nil
+}
+
+func sorted(ptrs []uint64) []uint64 {
+	out := append([]uint64(nil), ptrs...)
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
+
+func TestFreeListPendingNotReusable(t *testing.T) {
+	var fl freeList
+	fl.release(5)
+
+	// Released pages must not be handed out before the update is committed
+	if _, ok := fl.pop(); ok {
+		t.Fatal("Pending page was reused before commit")
+	}
+
+	m := newMemPages()
+	m.count = 10
+	if err := fl.commit(64, m.alloc, m.write); err != nil {
+		t.Fatalf("Failed to commit free list: %v", err)
+	}
+
+	if ptr, ok := fl.pop(); !ok || ptr != 5 {
+		t.Errorf("Expected to reuse page 5, got %d (ok=%v)", ptr, ok)
+	}
+}
+
+func TestFreeListCommitAndLoad(t *testing.T) {
+	const pageSize = 64 // (64 - 16) / 8 = 6 pointers per page
+	m := newMemPages()
+	m.count = 100
+
+	var fl freeList
+	var released []uint64
+	for ptr := uint64(20); ptr < 40; ptr++ {
+		fl.release(ptr)
+		released = append(released, ptr)
+	}
+	if err := fl.commit(pageSize, m.alloc, m.write); err != nil {
+		t.Fatalf("Failed to commit free list: %v", err)
+	}
+	if fl.head == 0 {
+		t.Fatal("Expected a non-empty on-disk list")
+	}
+
+	// Nothing was free before, so the list pages had to be appended
+	if len(fl.chain) != 4 {
+		t.Errorf("Expected 4 list pages for 20 entries, got %d", len(fl.chain))
+	}
+
+	var loaded freeList
+	if err := loaded.load(fl.head, m.count, m.read); err != nil {
+		t.Fatalf("Failed to load free list: %v", err)
+	}
+
+	got := sorted(loaded.free)
+	want := sorted(released)
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d free pages, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Expected free page %d, got %d", want[i], got[i])
+		}
+	}
+}
+
+func TestFreeListSteadyState(t *testing.T) {
+	const pageSize = 64
+	m := newMemPages()
+	m.count = 100
+
+	var fl freeList
+	for ptr := uint64(20); ptr < 40; ptr++ {
+		fl.release(ptr)
+	}
+	if err := fl.commit(pageSize, m.alloc, m.write); err != nil {
+		t.Fatalf("Failed to commit free list: %v", err)
+	}
+
+	// Each round reuses a page and releases another one, like an update
+	// of a single node would. The list must not keep growing the file.
+	count := m.count
+	for i := 0; i < 100; i++ {
+		ptr, ok := fl.pop()
+		if !ok {
+			t.Fatal("Free list ran out of pages")
+		}
+		fl.release(ptr)
+		if err := fl.commit(pageSize, m.alloc, m.write); err != nil {
+			t.Fatalf("Failed to commit free list: %v", err)
+		}
+	}
+
+	if m.count != count {
+		t.Errorf("Free list grew the file from %d to %d pages", count, m.count)
+	}
+}
+
+func TestFreeListHeldPages(t *testing.T) {
+	const pageSize = 64
+	m := newMemPages()
+	m.count = 100
+
+	// Page 10 was allocated after the checkpoint, page 20 is part of it.
+	// Both were released by the commit of version 3 while a snapshot was open.
+	var fl freeList
+	fl.allocate(10)
+	fl.release(10)
+	fl.release(20)
+	fl.recycle(3)
+	fl.holdPending(3)
+	if err := fl.commit(pageSize, m.alloc, m.write); err != nil {
+		t.Fatalf("Failed to commit free list: %v", err)
+	}
+	if ptr, ok := fl.pop(); ok {
+		t.Fatalf("Held page %d was handed out", ptr)
+	}
+
+	// On disk the held pages are free, a reopened database has no snapshots
+	var loaded freeList
+	if err := loaded.load(fl.head, m.count, m.read); err != nil {
+		t.Fatalf("Failed to load free list: %v", err)
+	}
+	if got := sorted(loaded.free); len(got) != 2 || got[0] != 10 || got[1] != 20 {
+		t.Errorf("Expected pages 10 and 20 on disk, got %v", got)
+	}
+
+	// A snapshot of version 2 still sees the pages, one of version 3 does not
+	fl.releaseHeld(2)
+	if _, ok := fl.pop(); ok {
+		t.Fatal("Held page was released while an older snapshot is open")
+	}
+	fl.releaseHeld(3)
+	if got := sorted(fl.free); len(got) != 2 || got[0] != 10 || got[1] != 20 {
+		t.Errorf("Expected pages 10 and 20 to be free, got %v", got)
+	}
+}
+
+// TestFreeListRollback verifies that rollback reverts every change made since
+// begin, and that changes after end are kept
+func TestFreeListRollback(t *testing.T) {
+	var fl freeList
+	fl.free = []uint64{5, 6, 7}
+	fl.allocate(30)
+	before := fl.clone()
+
+	fl.begin()
+	ptr, _ := fl.pop()
+	fl.allocate(ptr)
+	fl.allocate(30)
+	fl.release(40)
+	fl.push(ptr)
+	fl.forget(6)
+	fl.rollback()
+
+	if !slices.Equal(fl.free, before.free) || !slices.Equal(fl.pending, before.pending) ||
+		!maps.Equal(fl.fresh, before.fresh) || fl.dirty != before.dirty {
+		t.Errorf("Expected the list as before the transaction, got free %v, pending %v, fresh %v, dirty %v",
+			fl.free, fl.pending, fl.fresh, fl.dirty)
+	}
+
+	fl.begin()
+	fl.pop()
+	fl.end()
+	fl.rollback()
+	if len(fl.free) != 2 {
+		t.Errorf("Expected the ended transaction to be kept, got free %v", fl.free)
+	}
+}
+
+func TestFreeListLoadCorrupt(t *testing.T) {
+	m := newMemPages()
+	m.count = 10
+
+	page := make([]byte, 64)
+	page[8] = 200 // more pointers than fit into the page
+	m.write(3, page)
+
+	var fl freeList
+	if err := fl.load(3, m.count, m.read); !errors.Is(err, ErrCorruptFreeList) {
+		t.Errorf("Expected ErrCorruptFreeList, got %v", err)
+	}
+
+	// A list page pointing at itself must not loop forever
+	page = make([]byte, 64)
+	page[0] = 3
+	m.write(3, page)
+	if err := fl.load(3, m.count, m.read); !errors.Is(err, ErrCorruptFreeList) {
+		t.Errorf("Expected ErrCorruptFreeList, got %v", err)
+	}
+}
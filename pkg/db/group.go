@@ -0,0 +1,89 @@
+package db
+
+import "build-your-own-database/pkg/wal"
+
+/*
+Group Commit:
+
+Put and Delete do not commit on their own. Each call queues its write, and
+the caller at the head of the queue becomes the leader of a group: once it
+has the writer lock it takes every write queued so far, applies them in queue order to one write
+transaction and commits it, so the whole group shares one log record, one
+fsync and one write of every tree page it touches. Writes queued while a group
+commits wait for it to finish and form the next group, led by the first of them.
+
+Each write gets its own result. A write the tree rejects fails alone and the
+rest of the group goes ahead, an error while committing fails every write of
+the group. When the group is committed the leader wakes all waiters at once.
+*/
+
+// writeRequest is a Put or Delete waiting to be committed with a group
+type writeRequest struct {
+	typ   wal.RecordType // wal.RecordPut or wal.RecordDelete
+	key   []byte
+	value []byte
+	err   error // Result, set by the leader of the group
+	done  bool  // Whether the request was committed, guarded by db.queueMu
+}
+
+// submit queues a write and waits until a group including it is committed
+// Returns the result of the write
+func (db *DB) submit(req *writeRequest) error {
+	db.queueMu.Lock()
+	db.queue = append(db.queue, req)
+	for !req.done && db.queue[0] != req {
+		db.queueDone.Wait()
+	}
+	done := req.done
+	db.queueMu.Unlock()
+	if done {
+		return req.err
+	}
+
+	// The request is at the head of the queue, lead a group with everything
+	// queued once the writer lock is free. The head only changes when the
+	// group is removed, so there is one leader at a time.
+	db.writer.Lock()
+	db.queueMu.Lock()
+	group := db.queue
+	db.queueMu.Unlock()
+	db.commitGroup(group)
+	db.writer.Unlock()
+
+	db.queueMu.Lock()
+	for _, r := range group {
+		r.done = true
+	}
+	db.queue = db.queue[len(group):]
+	db.queueDone.Broadcast()
+	db.queueMu.Unlock()
+	return req.err
+}
+
+// commitGroup applies a group of writes as one write transaction and
+// records the result of each of them
+// Must be called with db.writer held
+func (db *DB) commitGroup(group []*writeRequest) {
+	if db.closed.Load() {
+		for _, req := range group {
+			req.err = ErrClosed
+		}
+		return
+	}
+
+	tx := db.newWriteTx()
+	for _, req := range group {
+		if req.typ == wal.RecordPut {
+			req.err = tx.Put(req.key, req.value)
+		} else {
+			req.err = tx.Delete(req.key)
+		}
+	}
+
+	err := tx.commit()
+	for _, req := range group {
+		if req.err == nil {
+			req.err = err
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package db
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitQueued blocks until n writes are queued for the next group commit
+func waitQueued(t *testing.T, database *DB, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		database.queueMu.Lock()
+		queued := len(database.queue)
+		database.queueMu.Unlock()
+		if queued == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d queued writes, got %d", n, queued)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestGroupCommit verifies that concurrent writes
+// 1. Are committed as one log record in the order they were queued
+// 2. Each get their own result
+// 3. Survive a crash
+func TestGroupCommit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	database, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to create DB: %v", err)
+	}
+
+	// Keep the writer lock so the writes pile up in the queue
+	database.writer.Lock()
+	lsn := database.lsn
+
+	const writers = 20
+	var wg sync.WaitGroup
+	errs := make([]error, writers+2)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = database.Put([]byte(fmt.Sprintf("key%02d", i)), []byte(fmt.Sprintf("value%d", i)))
+		}(i)
+	}
+	waitQueued(t, database, writers)
+
+	// Queued after the Put of the same key, so the key ends up deleted
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		errs[writers] = database.Delete([]byte("key05"))
+	}()
+	waitQueued(t, database, writers+1)
+	go func() {
+		defer wg.Done()
+		errs[writers+1] = database.Delete([]byte("missing"))
+	}()
+	waitQueued(t, database, writers+2)
+
+	database.writer.Unlock()
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("Write %d failed: %v", i, err)
+		}
+	}
+	if database.lsn != lsn+1 {
+		t.Errorf("Expected the group to be logged as one record, LSN went from %d to %d", lsn, database.lsn)
+	}
+
+	crash(t, database)
+	database, err = NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer database.Close()
+	for i := 0; i < writers; i++ {
+		value, found, err := database.Get([]byte(fmt.Sprintf("key%02d", i)))
+		if err != nil {
+			t.Fatalf("Failed to get: %v", err)
+		}
+		if i == 5 {
+			if found {
+				t.Error("Expected key05 to be deleted")
+			}
+		} else if string(value) != fmt.Sprintf("value%d", i) {
+			t.Errorf("Expected value%d, got %q", i, value)
+		}
+	}
+}
+
+// BenchmarkParallelPut measures durable writes from many goroutines, which
+// share fsyncs through group commit
+func BenchmarkParallelPut(b *testing.B) {
+	database, err := NewDB(filepath.Join(b.TempDir(), "bench.db"))
+	if err != nil {
+		b.Fatalf("Failed to create DB: %v", err)
+	}
+	defer database.Close()
+
+	var n atomic.Int64
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			key := []byte(fmt.Sprintf("key%08d", n.Add(1)))
+			if err := database.Put(key, []byte("value")); err != nil {
+				b.Errorf("Failed to put: %v", err)
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,143 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+/*
+Meta Page Layout:
+
+The first two pages of the database file are reserved for meta pages.
+Each of them records everything needed to find the B+ tree again after a restart:
+
++----------------+----------------+----------------+----------------+----------------+
+| Magic (8B)     | Version (4B)   | Page Size (4B) | Root (8B)      | Page Count (8B)|
++----------------+----------------+----------------+----------------+----------------+
+| Free List (8B) | Log LSN (8B)   | Sequence (8B)  | Checksum (4B)  |
++----------------+----------------+----------------+----------------+
+
+  - Magic: identifies the file as a database file
+  - Version: on-disk format version
+  - Page Size: size of every page in the file, chosen when the file is created
+  - Root: page number of the B+ tree root (0 for an empty tree)
+  - Page Count: number of pages in use, including the meta pages
+  - Free List: page number of the first free list page (0 if there is none)
+  - Log LSN: LSN of the last write-ahead log record reflected in the tree
+  - Sequence: incremented on every checkpoint
+  - Checksum: CRC32-C of all preceding fields
+
+Checkpoints alternate between the two meta pages (sequence % 2), so a torn write
+can only damage the page that is being written. On open the valid meta page
+with the highest sequence number wins.
+
+Page numbers are converted to file offsets by multiplying with the page size,
+so pages 0 and 1 are always meta pages and tree nodes start at page 2.
+*/
+
+const (
+	metaMagic   = "BYODB\x00\x00\x00" // Identifies a database file
+	metaVersion = 5                   // Current on-disk format version
+	metaPages   = 2                   // Number of meta pages at the start of the file
+	metaSize    = 60                  // Number of meaningful bytes in a meta page
+)
+
+// ErrInvalidMeta is returned when the meta page is missing or malformed
+var ErrInvalidMeta = errors.New("db: invalid meta page")
+
+// castagnoli is the CRC32-C table used for all checksums in the file
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// meta is the decoded form of the meta page
+type meta struct {
+	version   uint32 // On-disk format version
+	pageSize  uint32 // Size of each page in bytes
+	root      uint64 // Page number of the B+ tree root
+	pageCount uint64 // Number of allocated pages including the meta pages
+	freeList  uint64 // Page number of the first free list page
+	lsn       uint64 // LSN of the last log record reflected in the tree
+	seq       uint64 // Checkpoint sequence number
+}
+
+// slot returns the page number this meta record is written to
+func (m *meta) slot() uint64 {
+	return m.seq % metaPages
+}
+
+// encode serializes the meta record into the beginning of a page
+func (m *meta) encode(page []byte) {
+	copy(page[0:8], metaMagic)
+	binary.LittleEndian.PutUint32(page[8:12], m.version)
+	binary.LittleEndian.PutUint32(page[12:16], m.pageSize)
+	binary.LittleEndian.PutUint64(page[16:24], m.root)
+	binary.LittleEndian.PutUint64(page[24:32], m.pageCount)
+	binary.LittleEndian.PutUint64(page[32:40], m.freeList)
+	binary.LittleEndian.PutUint64(page[40:48], m.lsn)
+	binary.LittleEndian.PutUint64(page[48:56], m.seq)
+	binary.LittleEndian.PutUint32(page[56:60], crc32.Checksum(page[:56], castagnoli))
+}
+
+// decodeMeta parses and validates a meta page
+func decodeMeta(page []byte) (meta, error) {
+	if len(page) < metaSize || string(page[0:8]) != metaMagic {
+		return meta{}, fmt.Errorf("%w: bad magic", ErrInvalidMeta)
+	}
+	if crc32.Checksum(page[:56], castagnoli) != binary.LittleEndian.Uint32(page[56:60]) {
+		return meta{}, fmt.Errorf("%w: checksum mismatch", ErrInvalidMeta)
+	}
+
+	m := meta{
+		version:   binary.LittleEndian.Uint32(page[8:12]),
+		pageSize:  binary.LittleEndian.Uint32(page[12:16]),
+		root:      binary.LittleEndian.Uint64(page[16:24]),
+		pageCount: binary.LittleEndian.Uint64(page[24:32]),
+		freeList:  binary.LittleEndian.Uint64(page[32:40]),
+		lsn:       binary.LittleEndian.Uint64(page[40:48]),
+		seq:       binary.LittleEndian.Uint64(page[48:56]),
+	}
+
+	if m.version != metaVersion {
+		return meta{}, fmt.Errorf("%w: unsupported version %d", ErrInvalidMeta, m.version)
+	}
+	if !validPageSize(int(m.pageSize)) {
+		return meta{}, fmt.Errorf("%w: unsupported page size %d", ErrInvalidMeta, m.pageSize)
+	}
+	if m.pageCount < metaPages || m.root >= m.pageCount {
+		return meta{}, fmt.Errorf("%w: root %d outside of %d pages", ErrInvalidMeta, m.root, m.pageCount)
+	}
+	if m.freeList >= m.pageCount {
+		return meta{}, fmt.Errorf("%w: free list %d outside of %d pages", ErrInvalidMeta, m.freeList, m.pageCount)
+	}
+
+	return m, nil
+}
+
+// newestMeta decodes both meta pages and returns the valid one with the
+// highest sequence number
+func newestMeta(pages [metaPages][]byte) (meta, error) {
+	var best meta
+	var found bool
+	var errs []error
+
+	for slot, page := range pages {
+		m, err := decodeMeta(page)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("meta page %d: %w", slot, err))
+			continue
+		}
+		if m.slot() != uint64(slot) {
+			errs = append(errs, fmt.Errorf("meta page %d: %w: sequence %d in wrong slot", slot, ErrInvalidMeta, m.seq))
+			continue
+		}
+		if !found || m.seq > best.seq {
+			best, found = m, true
+		}
+	}
+
+	if !found {
+		return meta{}, errors.Join(errs...)
+	}
+	return best, nil
+}
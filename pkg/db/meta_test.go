@@ -0,0 +1,107 @@
+package db
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMetaEncodeDecode(t *testing.T) {
+	m := meta{
+		version:   metaVersion,
+		pageSize:  4096,
+		root:      7,
+		pageCount: 12,
+		freeList:  9,
+		lsn:       1234,
+		seq:       42,
+	}
+
+	page := make([]byte, 4096)
+	m.encode(page)
+
+	got, err := decodeMeta(page)
+	if err != nil {
+		t.Fatalf("Failed to decode meta: %v", err)
+	}
+	if got != m {
+		t.Errorf("Expected meta %+v, got %+v", m, got)
+	}
+}
+
+func TestMetaDecodeErrors(t *testing.T) {
+	valid := meta{version: metaVersion, pageSize: 4096, root: 2, pageCount: 4, freeList: 3}
+
+	tests := []struct {
+		name   string
+		mutate func(page []byte)
+	}{
+		{"bad magic", func(page []byte) { page[0] = 'X' }},
+		{"bad checksum", func(page []byte) { page[16]++ }},
+		{"bad version", func(page []byte) {
+			m := valid
+			m.version = metaVersion + 1
+			m.encode(page)
+		}},
+		{"root out of range", func(page []byte) {
+			m := valid
+			m.root = m.pageCount
+			m.encode(page)
+		}},
+		{"free list out of range", func(page []byte) {
+			m := valid
+			m.freeList = m.pageCount
+			m.encode(page)
+		}},
+		{"short page", func(page []byte) {}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page := make([]byte, 4096)
+			valid.encode(page)
+			tt.mutate(page)
+			if tt.name == "short page" {
+				page = page[:metaSize-1]
+			}
+
+			if _, err := decodeMeta(page); !errors.Is(err, ErrInvalidMeta) {
+				t.Errorf("Expected ErrInvalidMeta, got %v", err)
+			}
+		})
+	}
+}
+
+func TestNewestMeta(t *testing.T) {
+	encode := func(m meta) []byte {
+		page := make([]byte, 4096)
+		m.encode(page)
+		return page
+	}
+	older := meta{version: metaVersion, pageSize: 4096, root: 2, pageCount: 4, seq: 6}
+	newer := meta{version: metaVersion, pageSize: 4096, root: 3, pageCount: 4, seq: 7}
+
+	// The valid page with the highest sequence number wins
+	got, err := newestMeta([metaPages][]byte{encode(older), encode(newer)})
+	if err != nil || got != newer {
+		t.Errorf("Expected %+v, got %+v (err=%v)", newer, got, err)
+	}
+
+	// A torn write of the newer page falls back to the older one
+	torn := encode(newer)
+	torn[20]++
+	got, err = newestMeta([metaPages][]byte{encode(older), torn})
+	if err != nil || got != older {
+		t.Errorf("Expected %+v, got %+v (err=%v)", older, got, err)
+	}
+
+	// A meta page in the wrong slot is ignored
+	got, err = newestMeta([metaPages][]byte{encode(older), encode(older)})
+	if err != nil || got != older {
+		t.Errorf("Expected %+v, got %+v (err=%v)", older, got, err)
+	}
+
+	// Without any valid page the database cannot be opened
+	if _, err := newestMeta([metaPages][]byte{torn, nil}); !errors.Is(err, ErrInvalidMeta) {
+		t.Errorf("Expected ErrInvalidMeta, got %v", err)
+	}
+}
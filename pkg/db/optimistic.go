@@ -0,0 +1,368 @@
+package db
+
+import (
+	"build-your-own-database/pkg/wal"
+	"bytes"
+	"errors"
+	"math"
+	"slices"
+	"sync"
+)
+
+/*
+Optimistic Transactions:
+
+An optimistic transaction reads from a snapshot and buffers its writes in
+memory, so any number of them run in parallel without taking a lock. It
+records what it depends on:
+
+  - Read set: every key read with Get and every range read with Scan
+  - Write set: every key written with Put or Delete
+
+While optimistic transactions are open, the database remembers the keys each
+commit writes in the conflict log. On Commit the transaction takes the writer
+lock and checks the log for commits newer than its snapshot. If one of them
+wrote a key in the read or write set, the transaction fails with ErrConflict
+and nothing is applied, otherwise its writes are applied to the current tree
+as one batch. Commits are short, only validation and applying the batch are
+serialized.
+*/
+
+// ErrConflict is returned by OptimisticTx.Commit when a key the transaction
+// read or wrote was changed by another commit since it began. The transaction
+// can be retried.
+var ErrConflict = errors.New("db: transaction conflicts with a concurrent commit")
+
+// OptimisticTx is a read-write transaction that is validated on commit
+// See Optimistic Transactions. A transaction must be ended with Commit or
+// Rollback and is not safe for concurrent use.
+type OptimisticTx struct {
+	db     *DB
+	snap   *Snapshot                  // State the transaction reads from
+	writes map[string]optimisticWrite // Buffered writes by key
+	reads  []keyRange                 // Keys and ranges read from the snapshot
+	done   bool
+}
+
+// optimisticWrite is a buffered Put or Delete of an optimistic transaction
+type optimisticWrite struct {
+	value   []byte
+	deleted bool
+}
+
+// BeginOptimistic starts an optimistic read-write transaction
+// Returns:
+//   - *OptimisticTx: The transaction, to be ended with Commit or Rollback
+//   - error: Any error that occurred while starting the transaction, ErrClosed
+func (db *DB) BeginOptimistic() (*OptimisticTx, error) {
+	if db.opts.ReadOnly {
+		db.refresh()
+	}
+
+	// Register with the conflict log under the same lock as the snapshot,
+	// so every commit after the snapshot is recorded
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	s := db.snapshot()
+	if s.err != nil {
+		return nil, s.err
+	}
+	db.conflicts.begin(s.version)
+	return &OptimisticTx{db: db, snap: s, writes: make(map[string]optimisticWrite)}, nil
+}
+
+// Get retrieves a value by its key, including changes made by the transaction
+// Returns:
+//   - []byte: The value associated with the key
+//   - bool: true if the key was found, false otherwise
+//   - error: ErrTxDone after the transaction ended, or any error reading
+func (tx *OptimisticTx) Get(key []byte) ([]byte, bool, error) {
+	if tx.done {
+		return nil, false, ErrTxDone
+	}
+	if w, ok := tx.writes[string(key)]; ok {
+		return w.value, !w.deleted, nil
+	}
+
+	value, found, err := tx.snap.Get(key)
+	if err != nil {
+		return nil, false, err
+	}
+	tx.reads = append(tx.reads, pointRange(key))
+	return value, found, nil
+}
+
+// Put inserts or updates a key-value pair within the transaction
+// Returns:
+//   - error: ErrTxDone, ErrEmptyKey, ErrKeyTooLarge or ErrValueTooLarge
+func (tx *OptimisticTx) Put(key, value []byte) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if err := tx.db.tree.Config.Validate(key, value); err != nil {
+		return err
+	}
+	tx.writes[string(key)] = optimisticWrite{value: bytes.Clone(value)}
+	return nil
+}
+
+// Delete removes a key within the transaction
+// Returns:
+//   - error: ErrTxDone or ErrEmptyKey
+func (tx *OptimisticTx) Delete(key []byte) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	tx.writes[string(key)] = optimisticWrite{deleted: true}
+	return nil
+}
+
+// Scan calls visit for every key-value pair with start <= key < end in key order,
+// including changes made by the transaction
+// Parameters:
+//   - start: The first key to visit, nil or empty starts at the smallest key
+//   - end: The key to stop before, nil or empty runs to the largest key
+//   - visit: Called for each pair, returning false stops the scan
+//
+// Returns:
+//   - error: ErrTxDone, or any error that occurred while reading
+//
+// The whole range is added to the read set, even if visit stops early. The
+// slices passed to visit are only valid during the call and must not be modified.
+func (tx *OptimisticTx) Scan(start, end []byte, visit func(key, value []byte) bool) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.reads = append(tx.reads, keyRange{start: bytes.Clone(start), end: bytes.Clone(end)})
+
+	// Buffered writes in the range, merged into the snapshot in key order
+	var keys []string
+	for key := range tx.writes {
+		if (keyRange{start: start, end: end}).contains([]byte(key)) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+
+	c := tx.snap.NewCursor()
+	defer c.Close()
+	ok := c.Seek(start)
+	for {
+		if ok && len(end) > 0 && bytes.Compare(c.Key(), end) >= 0 {
+			ok = false
+		}
+		if !ok && len(keys) == 0 {
+			break
+		}
+
+		if len(keys) > 0 && (!ok || keys[0] <= string(c.Key())) {
+			key, w := keys[0], tx.writes[keys[0]]
+			keys = keys[1:]
+			if ok && key == string(c.Key()) {
+				ok = c.Next() // the buffered write replaces the stored pair
+			}
+			if !w.deleted && !visit([]byte(key), w.value) {
+				break
+			}
+			continue
+		}
+
+		value := c.Value()
+		if c.Err() != nil || !visit(c.Key(), value) {
+			break
+		}
+		ok = c.Next()
+	}
+	return c.Err()
+}
+
+// Commit validates the transaction and applies its writes
+// Returns:
+//   - error: ErrTxDone, ErrConflict if a commit since the transaction began
+//     wrote a key it read or wrote, ErrReadOnly for writes to a read-only
+//     database, or any error that occurred while
+//     committing. In every case the transaction has ended, and on error none
+//     of its writes are applied.
+func (tx *OptimisticTx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	defer tx.end()
+	if len(tx.writes) == 0 {
+		// A read-only transaction saw a consistent snapshot
+		return nil
+	}
+
+	keys := make([]string, 0, len(tx.writes))
+	for key := range tx.writes {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	var b Batch
+	deps := tx.reads
+	for _, key := range keys {
+		if w := tx.writes[key]; w.deleted {
+			b.Delete([]byte(key))
+		} else {
+			b.Put([]byte(key), w.value)
+		}
+		deps = append(deps, pointRange([]byte(key)))
+	}
+
+	// The writer lock keeps other commits out until the batch is applied.
+	// Nothing is read from the snapshot anymore, release it first so waiting
+	// for the lock does not hold up Close or Compact.
+	tx.snap.Close()
+	wtx, err := tx.db.Begin(true)
+	if err != nil {
+		return err
+	}
+	if tx.db.conflicts.conflicts(tx.snap.version, deps) {
+		wtx.Rollback()
+		return ErrConflict
+	}
+	if err := wtx.apply(b.data); err != nil {
+		wtx.Rollback()
+		return err
+	}
+	return wtx.Commit()
+}
+
+// Rollback ends the transaction, discarding its writes
+// Returns:
+//   - error: ErrTxDone if the transaction already ended
+func (tx *OptimisticTx) Rollback() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.end()
+	return nil
+}
+
+// end releases the snapshot and the registration with the conflict log
+func (tx *OptimisticTx) end() {
+	tx.done = true
+	tx.db.conflicts.end(tx.snap.version)
+	tx.snap.Close()
+	tx.writes, tx.reads = nil, nil
+}
+
+// keyRange is the key range [start, end), a nil or empty end is open
+type keyRange struct {
+	start []byte
+	end   []byte
+}
+
+// pointRange returns the range holding only key, the key is copied
+func pointRange(key []byte) keyRange {
+	end := append(bytes.Clone(key), 0)
+	return keyRange{start: end[:len(key)], end: end}
+}
+
+// contains reports whether key lies in the range
+func (r keyRange) contains(key []byte) bool {
+	return bytes.Compare(key, r.start) >= 0 && (len(r.end) == 0 || bytes.Compare(key, r.end) < 0)
+}
+
+// overlaps reports whether two ranges have a key in common
+func (r keyRange) overlaps(o keyRange) bool {
+	return (len(o.end) == 0 || bytes.Compare(r.start, o.end) < 0) &&
+		(len(r.end) == 0 || bytes.Compare(o.start, r.end) < 0)
+}
+
+// conflictLog remembers the keys written by commits while optimistic
+// transactions are open, so they can be validated on commit
+type conflictLog struct {
+	mu      sync.Mutex
+	active  map[uint64]int // Open optimistic transactions per snapshot version
+	entries []conflictEntry
+}
+
+// conflictEntry is a key range written by the commit of a version
+type conflictEntry struct {
+	version uint64
+	keys    keyRange
+}
+
+// begin registers an optimistic transaction reading the given version
+func (cl *conflictLog) begin(version uint64) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if cl.active == nil {
+		cl.active = make(map[uint64]int)
+	}
+	cl.active[version]++
+}
+
+// end unregisters a transaction and forgets the entries no open
+// transaction needs anymore
+func (cl *conflictLog) end(version uint64) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if cl.active[version]--; cl.active[version] == 0 {
+		delete(cl.active, version)
+	}
+	if len(cl.active) == 0 {
+		cl.entries = nil
+		return
+	}
+	oldest := uint64(math.MaxUint64)
+	for v := range cl.active {
+		oldest = min(oldest, v)
+	}
+	cl.entries = slices.DeleteFunc(cl.entries, func(e conflictEntry) bool {
+		return e.version <= oldest
+	})
+}
+
+// record adds the keys a logged update writes, if any transaction may need them
+// Parameters:
+//   - version: Version the update commits as
+//   - rec: The logged update
+func (cl *conflictLog) record(version uint64, rec wal.Record) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if len(cl.active) == 0 {
+		return
+	}
+	add := func(keys keyRange) {
+		cl.entries = append(cl.entries, conflictEntry{version: version, keys: keys})
+	}
+	switch rec.Type {
+	case wal.RecordPut, wal.RecordDelete:
+		add(pointRange(rec.Key))
+	case wal.RecordDeleteRange:
+		add(keyRange{start: bytes.Clone(rec.Key), end: bytes.Clone(rec.Value)})
+	case wal.RecordBatch:
+		eachBatchOp(rec.Value, func(typ wal.RecordType, key, value []byte) error {
+			add(pointRange(key))
+			return nil
+		})
+	}
+}
+
+// conflicts reports whether a commit newer than version wrote into any of the ranges
+func (cl *conflictLog) conflicts(version uint64, ranges []keyRange) bool {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	for _, e := range cl.entries {
+		if e.version <= version {
+			continue
+		}
+		for _, r := range ranges {
+			if e.keys.overlaps(r) {
+				return true
+			}
+		}
+	}
+	return false
+}
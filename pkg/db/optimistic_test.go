@@ -0,0 +1,211 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// TestOptimisticTx verifies that an optimistic transaction
+// 1. Sees its own writes through Get and Scan
+// 2. Hides them from other readers until Commit
+// 3. Applies them on Commit
+func TestOptimisticTx(t *testing.T) {
+	database := openScanDB(t)
+
+	tx, err := database.BeginOptimistic()
+	if err != nil {
+		t.Fatalf("Failed to begin: %v", err)
+	}
+	if err := tx.Put([]byte("key010a"), []byte("new")); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if err := tx.Put([]byte("key011"), []byte("changed")); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if err := tx.Delete([]byte("key012")); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	if err := tx.Put(nil, []byte("value")); !errors.Is(err, ErrEmptyKey) {
+		t.Errorf("Expected ErrEmptyKey, got %v", err)
+	}
+
+	if value, found, err := tx.Get([]byte("key011")); err != nil || !found || string(value) != "changed" {
+		t.Errorf("Expected changed, got %q, found %v, err %v", value, found, err)
+	}
+	if _, found, err := tx.Get([]byte("key012")); err != nil || found {
+		t.Errorf("Expected key012 to be deleted, found %v, err %v", found, err)
+	}
+	var got []string
+	err = tx.Scan([]byte("key010"), []byte("key014"), func(key, value []byte) bool {
+		got = append(got, string(key)+"="+string(value))
+		return true
+	})
+	want := []string{"key010=value010", "key010a=new", "key011=changed", "key013=value013"}
+	if err != nil || fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Expected %v, got %v, err %v", want, got, err)
+	}
+
+	if _, found, _ := database.Get([]byte("key010a")); found {
+		t.Error("Uncommitted write is visible")
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	if value, _, _ := database.Get([]byte("key011")); string(value) != "changed" {
+		t.Errorf("Expected changed after commit, got %q", value)
+	}
+	if _, found, _ := database.Get([]byte("key012")); found {
+		t.Error("Expected key012 to be deleted after commit")
+	}
+	if err := tx.Rollback(); !errors.Is(err, ErrTxDone) {
+		t.Errorf("Expected ErrTxDone, got %v", err)
+	}
+}
+
+// TestOptimisticConflicts verifies which concurrent commits make Commit fail
+// with ErrConflict, and that a failed transaction applies nothing
+func TestOptimisticConflicts(t *testing.T) {
+	database := openScanDB(t)
+
+	tests := []struct {
+		name     string
+		tx       func(tx *OptimisticTx)
+		other    func() error
+		conflict bool
+	}{
+		{
+			name:     "read key written",
+			tx:       func(tx *OptimisticTx) { tx.Get([]byte("key001")) },
+			other:    func() error { return database.Put([]byte("key001"), []byte("other")) },
+			conflict: true,
+		},
+		{
+			name:     "written key written",
+			tx:       func(tx *OptimisticTx) { tx.Put([]byte("key002"), []byte("mine")) },
+			other:    func() error { return database.Delete([]byte("key002")) },
+			conflict: true,
+		},
+		{
+			name: "scanned range written",
+			tx: func(tx *OptimisticTx) {
+				tx.Scan([]byte("key020"), []byte("key030"), func(key, value []byte) bool { return false })
+			},
+			other:    func() error { return database.Put([]byte("key025a"), []byte("other")) },
+			conflict: true,
+		},
+		{
+			name:     "read key deleted by prefix",
+			tx:       func(tx *OptimisticTx) { tx.Get([]byte("key095")) },
+			other:    func() error { _, err := database.DeletePrefix([]byte("key09")); return err },
+			conflict: true,
+		},
+		{
+			name: "other keys written",
+			tx:   func(tx *OptimisticTx) { tx.Get([]byte("key040")) },
+			other: func() error {
+				var b Batch
+				b.Put([]byte("key041"), []byte("other"))
+				b.Delete([]byte("key039"))
+				return database.Write(&b)
+			},
+			conflict: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx, err := database.BeginOptimistic()
+			if err != nil {
+				t.Fatalf("Failed to begin: %v", err)
+			}
+			tt.tx(tx)
+			if err := tx.Put([]byte("marker-"+tt.name), []byte("x")); err != nil {
+				t.Fatalf("Failed to put: %v", err)
+			}
+			if err := tt.other(); err != nil {
+				t.Fatalf("Failed to write concurrently: %v", err)
+			}
+
+			err = tx.Commit()
+			_, applied, _ := database.Get([]byte("marker-" + tt.name))
+			if tt.conflict && (!errors.Is(err, ErrConflict) || applied) {
+				t.Errorf("Expected ErrConflict and nothing applied, got %v, applied %v", err, applied)
+			}
+			if !tt.conflict && (err != nil || !applied) {
+				t.Errorf("Expected the commit to succeed, got %v, applied %v", err, applied)
+			}
+		})
+	}
+
+	// With no open transaction the conflict log is empty again
+	if n := len(database.conflicts.entries); n != 0 {
+		t.Errorf("Expected an empty conflict log, got %d entries", n)
+	}
+}
+
+// TestOptimisticParallel verifies that transactions on disjoint keys commit
+// without conflicts, and that retrying on ErrConflict keeps contended
+// read-modify-write updates correct
+func TestOptimisticParallel(t *testing.T) {
+	database := openScanDB(t)
+
+	increment := func(key string) (retries int, err error) {
+		for {
+			tx, err := database.BeginOptimistic()
+			if err != nil {
+				return retries, err
+			}
+			value, _, err := tx.Get([]byte(key))
+			if err != nil {
+				tx.Rollback()
+				return retries, err
+			}
+			var n uint64
+			if len(value) == 8 {
+				n = binary.LittleEndian.Uint64(value)
+			}
+			if err := tx.Put([]byte(key), binary.LittleEndian.AppendUint64(nil, n+1)); err != nil {
+				tx.Rollback()
+				return retries, err
+			}
+			err = tx.Commit()
+			if !errors.Is(err, ErrConflict) {
+				return retries, err
+			}
+			retries++
+		}
+	}
+
+	const workers, rounds = 8, 50
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				// Every worker owns one counter and shares another one
+				if retries, err := increment(fmt.Sprintf("own%d", w)); err != nil || retries != 0 {
+					t.Errorf("Own counter: %d retries, err %v", retries, err)
+				}
+				if _, err := increment("shared"); err != nil {
+					t.Errorf("Shared counter: %v", err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for _, key := range []string{"own0", "own7", "shared"} {
+		want := uint64(rounds)
+		if key == "shared" {
+			want = workers * rounds
+		}
+		value, _, err := database.Get([]byte(key))
+		if err != nil || binary.LittleEndian.Uint64(value) != want {
+			t.Errorf("Expected %s to be %d, got %v, err %v", key, want, value, err)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package db
+
+import (
+	"build-your-own-database/pkg/storage"
+	"errors"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// SyncMode controls when committed data is forced to stable storage
+type SyncMode int
+
+const (
+	// SyncAlways fsyncs the write-ahead log on every commit, so a successful
+	// Put or Delete survives a power loss
+	SyncAlways SyncMode = iota
+
+	// SyncInterval fsyncs the write-ahead log in the background every
+	// Options.SyncInterval. A crash loses at most the commits of the last
+	// interval, but the file always stays consistent.
+	SyncInterval
+
+	// SyncNone never fsyncs and leaves flushing to the operating system.
+	// A process crash loses nothing, a power loss may corrupt the file.
+	SyncNone
+)
+
+const (
+	// DefaultSyncInterval is used when SyncInterval mode is selected without an interval
+	DefaultSyncInterval = time.Second
+
+	// DefaultCheckpointSize is the log size that triggers a checkpoint by default
+	DefaultCheckpointSize = 4 << 20
+
+	// DefaultCacheBytes is the size of the page cache by default
+	DefaultCacheBytes = 8 << 20
+
+	// DefaultFileMode is the permission of new database and log files by default
+	DefaultFileMode = os.FileMode(0644)
+
+	// DefaultPageSize is the page size of a new database by default
+	DefaultPageSize = 4096
+
+	// MinPageSize and MaxPageSize bound the page size, which is a power of two
+	MinPageSize = 4 << 10
+	MaxPageSize = 64 << 10
+)
+
+var (
+	// ErrPageSize is returned for an unsupported Options.PageSize, or one that
+	// does not match the page size of an existing database
+	ErrPageSize = errors.New("db: invalid page size")
+
+	// ErrReadOnly is returned for updates to a database opened with Options.ReadOnly
+	ErrReadOnly = errors.New("db: database is opened read-only")
+
+	// ErrLocked is returned by Open when another process has the database open
+	// for writing, and by Compact while read-only opens in other processes exist
+	ErrLocked = storage.ErrLocked
+)
+
+// Options configures how a database is opened
+// The zero value does not create a missing database, start from
+// DefaultOptions to get the settings NewDB uses.
+type Options struct {
+	ReadOnly        bool          // Open for reading only, also next to a writer process, updates fail with ErrReadOnly
+	CreateIfMissing bool          // Create the database if it does not exist
+	ErrorIfExists   bool          // Fail with fs.ErrExist if the database already exists
+	FileMode        os.FileMode   // Permissions of new database and log files (default DefaultFileMode)
+	SyncMode        SyncMode      // When commits are fsynced (default SyncAlways)
+	SyncInterval    time.Duration // How often to fsync in SyncInterval mode
+	CheckpointSize  int64         // Log size in bytes after which the tree is checkpointed
+	CacheBytes      int64         // Size of the page cache in bytes, negative disables it, ReadOnly always does
+	LockTimeout     time.Duration // How long to wait for another process to close the database, 0 fails right away
+	Logger          *slog.Logger  // Receives messages about recovery and maintenance, nil discards them
+
+	// PageSize is the size of every page of a new database, a power of two
+	// from MinPageSize to MaxPageSize (default DefaultPageSize). An existing
+	// database keeps the page size recorded in its meta pages, opening it with
+	// a different nonzero value fails with ErrPageSize.
+	PageSize int
+}
+
+// DefaultOptions returns the options NewDB opens a database with
+// The database is created if it is missing, everything else has its default.
+func DefaultOptions() *Options {
+	return &Options{CreateIfMissing: true}
+}
+
+// withDefaults returns a copy of the options with zero values filled in
+// nil stands for DefaultOptions
+func (opts *Options) withDefaults() Options {
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+	o := *opts
+	if o.FileMode == 0 {
+		o.FileMode = DefaultFileMode
+	}
+	if o.Logger == nil {
+		o.Logger = slog.New(slog.DiscardHandler)
+	}
+	if o.SyncInterval <= 0 {
+		o.SyncInterval = DefaultSyncInterval
+	}
+	if o.CheckpointSize <= 0 {
+		o.CheckpointSize = DefaultCheckpointSize
+	}
+	if o.CacheBytes == 0 {
+		o.CacheBytes = DefaultCacheBytes
+	}
+	return o
+}
+
+// validPageSize reports whether size is a supported page size
+func validPageSize(size int) bool {
+	return size >= MinPageSize && size <= MaxPageSize && size&(size-1) == 0
+}
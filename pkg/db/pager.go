@@ -0,0 +1,168 @@
+package db
+
+import (
+	"build-your-own-database/pkg/btree"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+/*
+Page Trailer Layout:
+
+Every tree node and free list page ends with a trailer that is verified on
+each read, so corruption is reported instead of being decoded as a node:
+
++----------------------------+----------------+----------------+----------------+
+| Payload (pageSize - 16B)   | Page No (8B)   | Reserved (4B)  | Checksum (4B)  |
++----------------------------+----------------+----------------+----------------+
+
+  - Payload: the node or free list page as seen by its users
+  - Page No: page number the page was written to, catches misdirected writes
+  - Checksum: CRC32-C of the payload, the page number and the reserved field
+
+Meta pages carry their own checksum and do not use the trailer.
+*/
+
+const (
+	pageTrailerSize = 16 // Size of the page trailer (8B page number + 4B reserved + 4B checksum)
+)
+
+// ErrCorruptPage is matched by every *CorruptPageError, use errors.Is to test for it
+var ErrCorruptPage = errors.New("db: corrupt page")
+
+// CorruptPageError is returned when a page fails verification on read
+type CorruptPageError struct {
+	Page   uint64 // Page number that was requested
+	Offset int64  // File offset of the page
+	Reason string // What did not match
+}
+
+func (e *CorruptPageError) Error() string {
+	return fmt.Sprintf("db: corrupt page %d at offset %d: %s", e.Page, e.Offset, e.Reason)
+}
+
+// Is makes errors.Is(err, ErrCorruptPage) report true
+func (e *CorruptPageError) Is(target error) bool {
+	return target == ErrCorruptPage
+}
+
+// setPageSize sets the size of every page and sizes the tree nodes to fit
+// Nodes leave room for the page trailer, and are limited to what the tree
+// can address, which is less than the payload of the largest pages
+func (db *DB) setPageSize(size int) {
+	db.pageSize = size
+	db.tree.Config.PageSize = uint16(min(db.payloadSize(), db.tree.Config.MaxPageSize()))
+}
+
+// payloadSize returns the number of usable bytes in a checksummed page
+func (db *DB) payloadSize() int {
+	return db.pageSize - pageTrailerSize
+}
+
+// pageOffset converts a page number to a file offset
+func (db *DB) pageOffset(ptr uint64) int64 {
+	return int64(ptr) * int64(db.pageSize)
+}
+
+// pageRead reads a raw page from disk using its page number
+func (db *DB) pageRead(ptr uint64) ([]byte, error) {
+	return db.storage.Read(db.pageOffset(ptr), db.pageSize)
+}
+
+// pageWrite writes a raw page to disk at the position of its page number
+func (db *DB) pageWrite(ptr uint64, page []byte) error {
+	return db.storage.Write(db.pageOffset(ptr), page)
+}
+
+// pageReadChecked reads a page and verifies its trailer
+// Returns the payload, or a *CorruptPageError if the page does not match
+func (db *DB) pageReadChecked(ptr uint64) ([]byte, error) {
+	page, err := db.pageRead(ptr)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := db.payloadSize()
+	trailer := page[payload:]
+	if crc32.Checksum(page[:db.pageSize-4], castagnoli) != binary.LittleEndian.Uint32(trailer[12:16]) {
+		return nil, &CorruptPageError{Page: ptr, Offset: db.pageOffset(ptr), Reason: "checksum mismatch"}
+	}
+	if stored := binary.LittleEndian.Uint64(trailer[0:8]); stored != ptr {
+		reason := fmt.Sprintf("page holds page number %d", stored)
+		return nil, &CorruptPageError{Page: ptr, Offset: db.pageOffset(ptr), Reason: reason}
+	}
+	return page[:payload], nil
+}
+
+// pageWriteChecked writes a payload followed by its trailer
+// The payload may be shorter than payloadSize, the rest is zero filled
+func (db *DB) pageWriteChecked(ptr uint64, data []byte) error {
+	if len(data) > db.payloadSize() {
+		return fmt.Errorf("db: payload of %d bytes does not fit into a page", len(data))
+	}
+
+	page := make([]byte, db.pageSize)
+	copy(page, data)
+	trailer := page[db.payloadSize():]
+	binary.LittleEndian.PutUint64(trailer[0:8], ptr)
+	binary.LittleEndian.PutUint32(trailer[12:16], crc32.Checksum(page[:db.pageSize-4], castagnoli))
+
+	// The cached copy is stale from here on, even if the write fails
+	db.cache.Invalidate(ptr)
+	return db.pageWrite(ptr, page)
+}
+
+// pageAppend reserves a new page at the end of the file
+func (db *DB) pageAppend() uint64 {
+	ptr := db.pageCount
+	db.pageCount++
+	return ptr
+}
+
+// pageGet reads a node using its page number
+// Verified pages are kept in the page cache, so hot nodes skip the disk. A
+// page is verified once when it is read, with its checksum and btree.CheckPage.
+func (db *DB) pageGet(ptr uint64) ([]byte, error) {
+	if node, ok := db.cache.Get(ptr); ok {
+		return node, nil
+	}
+	node, err := db.pageReadChecked(ptr)
+	if err != nil {
+		return nil, err
+	}
+	if err := btree.CheckPage(node); err != nil {
+		return nil, err
+	}
+	db.cache.Put(ptr, node)
+	return node, nil
+}
+
+// pageNew writes a node to a free page, or to the end of the file if
+// there is none, and returns its page number
+func (db *DB) pageNew(node []byte) (uint64, error) {
+	ptr, reused := db.free.pop()
+	if !reused {
+		ptr = db.pageAppend()
+	}
+	if err := db.pageWriteChecked(ptr, node); err != nil {
+		// Nothing refers to the page yet, hand it back
+		if reused {
+			db.free.push(ptr)
+		} else {
+			db.pageCount--
+		}
+		return 0, err
+	}
+	db.free.allocate(ptr)
+	return ptr, nil
+}
+
+// pageDel releases a node that is no longer referenced by the tree
+// The page is reused only after the current update is finished
+func (db *DB) pageDel(ptr uint64) error {
+	db.cache.Invalidate(ptr)
+	db.free.release(ptr)
+	return nil
+}
@@ -0,0 +1,279 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestDB creates a database with enough keys to span several pages and closes it
+func writeTestDB(t *testing.T, path string) {
+	t.Helper()
+	database, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to create DB: %v", err)
+	}
+	for i := 0; i < 200; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		value := []byte(fmt.Sprintf("value%03d-%0100d", i, i))
+		if err := database.Put(key, value); err != nil {
+			t.Fatalf("Failed to put key %s: %v", key, err)
+		}
+	}
+	if err := database.Close(); err != nil {
+		t.Fatalf("Failed to close DB: %v", err)
+	}
+}
+
+// expectCorruptPage checks that err reports the given page as corrupt
+func expectCorruptPage(t *testing.T, err error, ptr uint64) {
+	t.Helper()
+	if !errors.Is(err, ErrCorruptPage) {
+		t.Fatalf("Expected ErrCorruptPage, got %v", err)
+	}
+	var cerr *CorruptPageError
+	if !errors.As(err, &cerr) {
+		t.Fatalf("Expected a *CorruptPageError, got %T", err)
+	}
+	if cerr.Page != ptr || cerr.Offset != int64(ptr)*4096 {
+		t.Errorf("Expected page %d at offset %d, got page %d at offset %d", ptr, ptr*4096, cerr.Page, cerr.Offset)
+	}
+}
+
+// TestPageChecksumRoundTrip verifies that checked pages
+// 1. Return the written payload
+// 2. Detect a flipped byte in the payload
+// 3. Detect a page that was written to the wrong position
+func TestPageChecksumRoundTrip(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := filepath.Join(tmpDir, "test.db")
+
+	database, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to create DB: %v", err)
+	}
+	defer database.Close()
+
+	ptr := database.pageAppend()
+	if err := database.pageWriteChecked(ptr, []byte("payload")); err != nil {
+		t.Fatalf("Failed to write page: %v", err)
+	}
+	data, err := database.pageReadChecked(ptr)
+	if err != nil {
+		t.Fatalf("Failed to read page: %v", err)
+	}
+	if len(data) != 4096-pageTrailerSize || string(data[:7]) != "payload" {
+		t.Errorf("Expected the payload back, got %d bytes starting with %q", len(data), data[:7])
+	}
+
+	// Flip a byte in the payload
+	// Pages returned by pageRead may be read-only, modify a copy
+	page, err := database.pageRead(ptr)
+	if err != nil {
+		t.Fatalf("Failed to read page: %v", err)
+	}
+	page = bytes.Clone(page)
+	page[3] ^= 0xFF
+	if err := database.pageWrite(ptr, page); err != nil {
+		t.Fatalf("Failed to write page: %v", err)
+	}
+	_, err = database.pageReadChecked(ptr)
+	expectCorruptPage(t, err, ptr)
+
+	// Copy a valid page to another position
+	other := database.pageAppend()
+	if err := database.pageWriteChecked(ptr, []byte("payload")); err != nil {
+		t.Fatalf("Failed to write page: %v", err)
+	}
+	page, err = database.pageRead(ptr)
+	if err != nil {
+		t.Fatalf("Failed to read page: %v", err)
+	}
+	if err := database.pageWrite(other, page); err != nil {
+		t.Fatalf("Failed to write page: %v", err)
+	}
+	_, err = database.pageReadChecked(other)
+	expectCorruptPage(t, err, other)
+}
+
+// TestCorruptNodeIsReported verifies that a damaged tree node on disk makes
+// Put, Get, Delete and Traverse return ErrCorruptPage instead of decoding garbage
+func TestCorruptNodeIsReported(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := filepath.Join(tmpDir, "test.db")
+	writeTestDB(t, path)
+
+	// Damage the root node, every lookup passes through it
+	m, data := readMetaFromFile(t, path)
+	data[int(m.root)*4096+10] ^= 0xFF
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	database, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer database.Close()
+
+	expectCorruptPage(t, database.Put([]byte("key"), []byte("value")), m.root)
+	expectCorruptPage(t, database.Delete([]byte("key001")), m.root)
+	_, _, err = database.Get([]byte("key001"))
+	expectCorruptPage(t, err, m.root)
+	expectCorruptPage(t, database.Traverse(func(key, value []byte) {}), m.root)
+}
+
+// TestCorruptNodeFailsRecovery verifies that replaying the log into a damaged
+// tree makes Open fail with ErrCorruptPage
+func TestCorruptNodeFailsRecovery(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := filepath.Join(tmpDir, "test.db")
+	writeTestDB(t, path)
+
+	database, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	if err := database.Put([]byte("key001"), []byte("updated")); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	crash(t, database)
+
+	m, data := readMetaFromFile(t, path)
+	data[int(m.root)*4096+10] ^= 0xFF
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	if _, err := NewDB(path); !errors.Is(err, ErrCorruptPage) {
+		t.Fatalf("Expected ErrCorruptPage from Open, got %v", err)
+	}
+}
+
+// TestFailedWriteLeavesDatabaseUnchanged verifies that when writing a page fails
+// 1. Put and Delete return the error
+// 2. The failed updates are neither visible nor replayed after a reopen
+// 3. Later updates succeed once writes work again
+func TestFailedWriteLeavesDatabaseUnchanged(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := filepath.Join(tmpDir, "test.db")
+	writeTestDB(t, path)
+
+	database, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+
+	// Swap in a read-only handle, so every page write fails
+	file := database.storage.File
+	readOnly, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	database.storage.File = readOnly
+	root, pageCount := database.tree.Root, database.pageCount
+
+	if err := database.Put([]byte("new"), []byte("value")); err == nil {
+		t.Error("Expected put to fail")
+	}
+	if err := database.Delete([]byte("key001")); err == nil {
+		t.Error("Expected delete to fail")
+	}
+	if database.tree.Root != root || database.pageCount != pageCount {
+		t.Errorf("Expected root %d and %d pages, got root %d and %d pages", root, pageCount, database.tree.Root, database.pageCount)
+	}
+	if database.wal.Size() != 0 {
+		t.Errorf("Expected the failed updates to be removed from the log, it holds %d bytes", database.wal.Size())
+	}
+
+	database.storage.File = file
+	readOnly.Close()
+	if err := database.Put([]byte("after"), []byte("value")); err != nil {
+		t.Fatalf("Failed to put after writes work again: %v", err)
+	}
+	if err := database.Close(); err != nil {
+		t.Fatalf("Failed to close DB: %v", err)
+	}
+
+	database, err = NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer database.Close()
+
+	if _, found, err := database.Get([]byte("new")); err != nil || found {
+		t.Errorf("Failed put is visible: found %v, err %v", found, err)
+	}
+	if _, found, err := database.Get([]byte("key001")); err != nil || !found {
+		t.Errorf("Failed delete removed the key: found %v, err %v", found, err)
+	}
+	if _, found, err := database.Get([]byte("after")); err != nil || !found {
+		t.Errorf("Put after the failure is missing: found %v, err %v", found, err)
+	}
+}
+
+// TestPageCache verifies that the page cache
+// 1. Answers repeated lookups without reading the pages again
+// 2. Drops pages when they are freed, so reused pages are read fresh
+// 3. Stays empty when it is disabled
+func TestPageCache(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := filepath.Join(tmpDir, "test.db")
+	writeTestDB(t, path)
+
+	database, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer database.Close()
+
+	for i := 0; i < 10; i++ {
+		if _, found, err := database.Get([]byte("key100")); err != nil || !found {
+			t.Fatalf("Failed to get key: found %v, err %v", found, err)
+		}
+	}
+	stats := database.CacheStats()
+	if stats.Misses == 0 || stats.Hits < 9*stats.Misses {
+		t.Errorf("Expected repeated lookups to hit the cache: %+v", stats)
+	}
+
+	// Every update frees the path to the key and reuses pages freed earlier
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 200; i++ {
+			key := []byte(fmt.Sprintf("key%03d", i))
+			if err := database.Put(key, []byte(fmt.Sprintf("round%d-%d", round, i))); err != nil {
+				t.Fatalf("Failed to put key %s: %v", key, err)
+			}
+		}
+		for i := 0; i < 200; i++ {
+			key := []byte(fmt.Sprintf("key%03d", i))
+			value, found, err := database.Get(key)
+			if err != nil || !found || string(value) != fmt.Sprintf("round%d-%d", round, i) {
+				t.Fatalf("Wrong value for key %s in round %d: %q, found %v, err %v", key, round, value, found, err)
+			}
+		}
+	}
+	for _, ptr := range append(database.free.pending, database.free.free...) {
+		if _, ok := database.cache.Get(ptr); ok {
+			t.Errorf("Freed page %d is still cached", ptr)
+		}
+	}
+
+	disabled, err := Open(filepath.Join(tmpDir, "nocache.db"), &Options{CreateIfMissing: true, CacheBytes: -1})
+	if err != nil {
+		t.Fatalf("Failed to create DB: %v", err)
+	}
+	defer disabled.Close()
+	if err := disabled.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if _, _, err := disabled.Get([]byte("key")); err != nil {
+		t.Fatalf("Failed to get: %v", err)
+	}
+	if stats := disabled.CacheStats(); stats.Hits != 0 || stats.Pages != 0 {
+		t.Errorf("Expected a disabled cache to stay empty: %+v", stats)
+	}
+}
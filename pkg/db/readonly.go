@@ -0,0 +1,115 @@
+package db
+
+import (
+	"build-your-own-database/pkg/storage"
+	"bytes"
+	"errors"
+	"os"
+)
+
+/*
+Multi-Process Readers:
+
+Any number of processes may open a database with Options.ReadOnly while one
+process has it open for writing. Every process holds a shared lock on the
+database file. Writers additionally take the writer lock, an exclusive lock on
+the log file, which read-only opens never touch. Compact converts the shared
+lock of the writer into an exclusive one, so it waits for readers to leave.
+
+A reader does not replay the log, it sees the tree of the newest meta page.
+Every new snapshot first re-reads the meta pages and moves to the newest
+checkpoint. Commits of the writer therefore only become visible to readers
+once they are checkpointed, which happens when the log reaches
+Options.CheckpointSize, on Close, or when the writer calls DB.Checkpoint.
+
+The writer only reuses a page of the tree of checkpoint k after the meta page
+of checkpoint k+1 is written. A snapshot remembers both meta pages as it read
+them, and reads every node like a seqlock:
+
+ 1. The page is copied from the file and its checksum verified, there is no
+    memory mapping or page cache that the writer could change underneath
+ 2. Both meta pages are read again, if either differs from the remembered one
+    the writer wrote a meta page since, the node may come from a reused page
+    and the read fails with ErrSnapshotExpired
+
+A node read while both meta pages were unchanged was still intact. A meta page
+that is torn or still empty counts as unchanged for as long as it stays that
+way. DB.Get retries an expired lookup on a new snapshot, other reads return
+the error.
+*/
+
+// ErrSnapshotExpired is returned by reads of a read-only database whose writer
+// process checkpointed after the snapshot was taken, and may have reused its
+// pages. Retrying on a new snapshot reads the newest checkpoint.
+var ErrSnapshotExpired = errors.New("db: snapshot expired, the writer reused its pages")
+
+// metaImage holds the meaningful bytes of both meta pages as a reader read them
+type metaImage [metaPages][]byte
+
+// lockLog takes the writer lock, an exclusive lock on the log file
+// Returns the open log file holding the lock, closing it releases the lock
+func lockLog(path string, o Options) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, o.FileMode)
+	if err != nil {
+		return nil, err
+	}
+	if err := storage.LockFile(file, true, o.LockTimeout); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// refresh moves a read-only database to the newest checkpoint of the writer
+// and remembers the meta pages it was read from
+func (db *DB) refresh() error {
+	pages, err := db.readMetaPages()
+	if err != nil {
+		return err
+	}
+	m, err := newestMeta(pages)
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if m.seq > db.seq {
+		db.tree.Root = m.root
+		db.pageCount = m.pageCount
+		db.lsn = m.lsn
+		db.seq = m.seq
+		db.version++
+	}
+	db.metaSeen = pages
+	return nil
+}
+
+// readMetaPages reads the meaningful bytes of both meta pages
+func (db *DB) readMetaPages() (metaImage, error) {
+	var pages metaImage
+	for slot := range pages {
+		page, err := db.storage.Read(db.pageOffset(uint64(slot)), metaSize)
+		if err != nil {
+			return pages, err
+		}
+		pages[slot] = page
+	}
+	return pages, nil
+}
+
+// metaChanged reports whether the writer wrote a meta page since seen was read,
+// the pages of the tree seen describes may be reused from then on
+func (db *DB) metaChanged(seen metaImage) (bool, error) {
+	pages, err := db.readMetaPages()
+	if err != nil {
+		return false, err
+	}
+	for slot := range pages {
+		if !bytes.Equal(pages[slot], seen[slot]) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,226 @@
+package db
+
+import (
+	"build-your-own-database/pkg/storage"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestReadersNextToWriter verifies that
+// 1. Several read-only opens share the database with a writer
+// 2. Readers see commits of the writer once they are checkpointed, without reopening
+// 3. A snapshot taken before such a checkpoint expires
+// 4. Compact fails while readers are open and keeps the file locked meanwhile
+// 5. Compact lets readers in again afterwards
+func TestReadersNextToWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	writer, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to create DB: %v", err)
+	}
+	defer writer.Close()
+	if err := writer.Put([]byte("key"), []byte("v1")); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if err := writer.Checkpoint(); err != nil {
+		t.Fatalf("Failed to checkpoint: %v", err)
+	}
+
+	var readers []*DB
+	for i := 0; i < 2; i++ {
+		reader, err := Open(path, &Options{ReadOnly: true})
+		if err != nil {
+			t.Fatalf("Failed to open read-only next to the writer: %v", err)
+		}
+		readers = append(readers, reader)
+	}
+	if err := readers[0].Put([]byte("key"), []byte("v")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected ErrReadOnly, got %v", err)
+	}
+	if err := readers[0].Checkpoint(); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected ErrReadOnly from Checkpoint, got %v", err)
+	}
+
+	s := readers[0].Snapshot()
+	if value, _, err := s.Get([]byte("key")); err != nil || string(value) != "v1" {
+		t.Errorf("Expected v1, got %q, err %v", value, err)
+	}
+	if err := writer.Put([]byte("key"), []byte("v2")); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	// The commit is only in the log so far
+	if value, _, err := readers[0].Get([]byte("key")); err != nil || string(value) != "v1" {
+		t.Errorf("Expected v1 before the checkpoint, got %q, err %v", value, err)
+	}
+	if err := writer.Checkpoint(); err != nil {
+		t.Fatalf("Failed to checkpoint: %v", err)
+	}
+	for i, reader := range readers {
+		if value, _, err := reader.Get([]byte("key")); err != nil || string(value) != "v2" {
+			t.Errorf("Expected reader %d to see v2, got %q, err %v", i, value, err)
+		}
+	}
+	if _, _, err := s.Get([]byte("key")); !errors.Is(err, ErrSnapshotExpired) {
+		t.Errorf("Expected ErrSnapshotExpired from a snapshot older than the checkpoint, got %v", err)
+	}
+	s.Close()
+
+	if _, err := writer.Compact(); !errors.Is(err, ErrLocked) {
+		t.Errorf("Expected ErrLocked from Compact while readers are open, got %v", err)
+	}
+	for _, reader := range readers {
+		reader.Close()
+	}
+	// The writer still holds its shared lock after the failed Compact
+	if _, err := storage.NewStorage(path); !errors.Is(err, ErrLocked) {
+		t.Errorf("Expected ErrLocked for an exclusive open after a failed Compact, got %v", err)
+	}
+	if _, err := writer.Compact(); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+
+	reader, err := Open(path, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Failed to open read-only after compacting: %v", err)
+	}
+	defer reader.Close()
+	if value, _, err := reader.Get([]byte("key")); err != nil || string(value) != "v2" {
+		t.Errorf("Expected v2 after compacting, got %q, err %v", value, err)
+	}
+}
+
+// TestReadersDuringWrites verifies that lookups of a read-only database never
+// return a pair from a page the writer reused. The writer checkpoints after
+// every commit, so it recycles the pages of older checkpoints all the time.
+func TestReadersDuringWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	writer, err := Open(path, &Options{CreateIfMissing: true, SyncMode: SyncNone, CheckpointSize: 1})
+	if err != nil {
+		t.Fatalf("Failed to create DB: %v", err)
+	}
+	defer writer.Close()
+
+	const keys, rounds = 100, 20
+	value := func(key string, round int) []byte {
+		return []byte(fmt.Sprintf("%s/%04d/%s", key, round, strings.Repeat("x", 100)))
+	}
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		if err := writer.Put([]byte(key), value(key, 0)); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+
+	reader, err := Open(path, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Failed to open read-only: %v", err)
+	}
+	defer reader.Close()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// The round seen for a key never goes back
+			seen := make([]int, keys)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for i := 0; i < keys; i++ {
+					key := fmt.Sprintf("key%03d", i)
+					got, found, err := reader.Get([]byte(key))
+					var round int
+					if err == nil && found {
+						_, err = fmt.Sscanf(string(got), key+"/%04d/", &round)
+					}
+					if err != nil || !found || round < seen[i] {
+						t.Errorf("Expected round %d or later for %s, got %q, found %v, err %v", seen[i], key, got, found, err)
+						return
+					}
+					seen[i] = round
+				}
+			}
+		}()
+	}
+
+	for round := 1; round <= rounds; round++ {
+		for i := 0; i < keys; i++ {
+			key := fmt.Sprintf("key%03d", i)
+			if err := writer.Put([]byte(key), value(key, round)); err != nil {
+				t.Fatalf("Failed to put: %v", err)
+			}
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	got, _, err := reader.Get([]byte("key000"))
+	if err != nil || string(got) != string(value("key000", rounds)) {
+		t.Errorf("Expected the last round, got %q, err %v", got, err)
+	}
+}
+
+// TestReaderMetaChanges verifies that a snapshot of a read-only database
+// 1. Expires when the writer damages a meta page, as a torn write would
+// 2. Expires when the writer checkpointed twice since it was taken
+// and that lookups keep working while a meta page stays torn
+func TestReaderMetaChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	writer, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to create DB: %v", err)
+	}
+	defer writer.Close()
+	if err := writer.Put([]byte("key"), []byte("v1")); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if err := writer.Checkpoint(); err != nil {
+		t.Fatalf("Failed to checkpoint: %v", err)
+	}
+
+	reader, err := Open(path, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Failed to open read-only: %v", err)
+	}
+	defer reader.Close()
+
+	// A torn write of the next checkpoint's meta page
+	s := reader.Snapshot()
+	next := (writer.seq + 1) % metaPages
+	if err := writer.storage.Write(writer.pageOffset(next)+8, []byte("torn")); err != nil {
+		t.Fatalf("Failed to damage the meta page: %v", err)
+	}
+	if _, _, err := s.Get([]byte("key")); !errors.Is(err, ErrSnapshotExpired) {
+		t.Errorf("Expected ErrSnapshotExpired after a torn meta page, got %v", err)
+	}
+	s.Close()
+	if value, _, err := reader.Get([]byte("key")); err != nil || string(value) != "v1" {
+		t.Errorf("Expected v1 while the meta page stays torn, got %q, err %v", value, err)
+	}
+
+	s = reader.Snapshot()
+	for _, value := range []string{"v2", "v3"} {
+		if err := writer.Put([]byte("key"), []byte(value)); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+		if err := writer.Checkpoint(); err != nil {
+			t.Fatalf("Failed to checkpoint: %v", err)
+		}
+	}
+	if _, _, err := s.Get([]byte("key")); !errors.Is(err, ErrSnapshotExpired) {
+		t.Errorf("Expected ErrSnapshotExpired two checkpoints later, got %v", err)
+	}
+	s.Close()
+	if value, _, err := reader.Get([]byte("key")); err != nil || string(value) != "v3" {
+		t.Errorf("Expected v3, got %q, err %v", value, err)
+	}
+}
@@ -0,0 +1,199 @@
+package db
+
+import (
+	"build-your-own-database/pkg/btree"
+	"math"
+)
+
+/*
+Snapshots:
+
+Every commit increments the version of the database. A snapshot pins the root
+of one version and reads from it without holding any lock, so readers never
+block writers and writers never change what a snapshot sees.
+
+The tree is copy-on-write, so the pages of an old root stay intact until they
+are reused. The reader table counts the open snapshots per version. Pages
+released by the commit of version c are held in the free list while a
+snapshot older than c is open, and become reusable at the first commit after
+the last such snapshot was closed.
+*/
+
+// Snapshot is a read-only view of the database as of one commit
+// A snapshot is safe for concurrent use and must be closed, pages it may
+// read are not reused until then. Close waits for all snapshots to be closed.
+type Snapshot struct {
+	db      *DB
+	tree    *btree.BTree // Read-only tree pinned to the root of the snapshot
+	version uint64       // Version of the database the snapshot sees
+	meta    metaImage    // Meta pages the root was read from in a read-only database
+	err     error        // ErrClosed if the database was closed, returned by every read
+	closed  bool         // Guarded by db.snapMu
+}
+
+// Snapshot returns a read-only view of the current state of the database
+// Returns:
+//   - *Snapshot: The snapshot, to be released with Close
+//
+// A read-only database moves to the newest checkpoint of the writer first.
+// Reads from a snapshot of a closed database fail with ErrClosed.
+func (db *DB) Snapshot() *Snapshot {
+	if db.opts.ReadOnly {
+		// On failure the snapshot sees the current root, and expires as soon
+		// as the meta pages change
+		db.refresh()
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.snapshot()
+}
+
+// snapshot registers a snapshot of the current root
+// Must be called with db.mu held
+func (db *DB) snapshot() *Snapshot {
+	if db.closed.Load() {
+		// Close holds db.mu until the files are closed, nothing may be read
+		return &Snapshot{db: db, err: ErrClosed, closed: true}
+	}
+
+	s := &Snapshot{db: db, version: db.version, meta: db.metaSeen}
+	get := db.pageGet
+	if db.opts.ReadOnly {
+		get = s.pageGet
+	}
+	s.tree = btree.NewBTree(get, nil, nil)
+	s.tree.Config = db.tree.Config
+	s.tree.Root = db.tree.Root
+
+	db.snapMu.Lock()
+	db.snapshots[s.version]++
+	db.snapMu.Unlock()
+	return s
+}
+
+// pageGet reads a node for a snapshot of a read-only database
+// The node only counts if the writer wrote no meta page between taking the
+// snapshot and reading it, see Multi-Process Readers
+func (s *Snapshot) pageGet(ptr uint64) ([]byte, error) {
+	node, err := s.db.pageGet(ptr)
+	expired, merr := s.db.metaChanged(s.meta)
+	switch {
+	case merr != nil:
+		return nil, merr
+	case expired:
+		return nil, ErrSnapshotExpired
+	}
+	return node, err
+}
+
+// Get retrieves a value by its key as of the snapshot
+// Returns:
+//   - []byte: The value associated with the key
+//   - bool: true if the key was found, false otherwise
+//   - error: Any error that occurred while reading, ErrEmptyKey for an empty key,
+//     ErrCorruptPage if a page on the path to the key fails verification,
+//     ErrSnapshotExpired in a read-only database the writer checkpointed since,
+//     ErrClosed if the database was closed when the snapshot was taken
+func (s *Snapshot) Get(key []byte) ([]byte, bool, error) {
+	if s.err != nil {
+		return nil, false, s.err
+	}
+	return s.tree.Search(key)
+}
+
+// Traverse walks through all key-value pairs of the snapshot in order
+// The slices passed to visit are only valid during the call and must not be modified.
+func (s *Snapshot) Traverse(visit func(key, value []byte)) error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.tree.Traverse(visit)
+}
+
+// NewCursor opens a cursor on the snapshot that is not positioned yet
+// The cursor must be closed before the snapshot.
+func (s *Snapshot) NewCursor() *Cursor {
+	if s.err != nil {
+		// A cursor on an empty tree, it never finds a key
+		return &Cursor{cur: btree.NewBTree(nil, nil, nil).NewCursor(), err: s.err}
+	}
+	return &Cursor{cur: s.tree.NewCursor()}
+}
+
+// Range returns an iterator over the pairs of the snapshot with start <= key < end
+// See DB.Range, the iterator must not be used after the snapshot is closed.
+func (s *Snapshot) Range(start, end []byte) *Iterator {
+	return &Iterator{db: s.db, snap: s, start: start, end: end}
+}
+
+// Scan calls visit for every key-value pair of the snapshot with start <= key < end
+// in key order, see DB.Scan
+func (s *Snapshot) Scan(start, end []byte, visit func(key, value []byte) bool) error {
+	return s.Range(start, end).scan(visit)
+}
+
+// Close releases the snapshot, closing a snapshot twice is harmless
+// Pages only the snapshot still referenced are reclaimed by the next commit.
+func (s *Snapshot) Close() {
+	db := s.db
+	db.snapMu.Lock()
+	defer db.snapMu.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+	if db.snapshots[s.version]--; db.snapshots[s.version] == 0 {
+		delete(db.snapshots, s.version)
+	}
+	db.snapDone.Broadcast()
+}
+
+// oldestSnapshot returns the version of the oldest open snapshot,
+// math.MaxUint64 if there is none
+func (db *DB) oldestSnapshot() uint64 {
+	db.snapMu.Lock()
+	defer db.snapMu.Unlock()
+
+	oldest := uint64(math.MaxUint64)
+	for version := range db.snapshots {
+		oldest = min(oldest, version)
+	}
+	return oldest
+}
+
+// holdVersion returns the version to hold released pages with, 0 if no open
+// snapshot is older than the current version and the pages can be reused
+// Must be called with db.mu held for writing
+func (db *DB) holdVersion() uint64 {
+	if db.oldestSnapshot() < db.version {
+		return db.version
+	}
+	return 0
+}
+
+// waitSnapshots blocks until every snapshot has been closed
+func (db *DB) waitSnapshots() {
+	db.snapMu.Lock()
+	defer db.snapMu.Unlock()
+
+	for len(db.snapshots) > 0 {
+		db.snapDone.Wait()
+	}
+}
+
+// lockWithoutSnapshots locks db.mu for writing once no snapshot is open
+// It waits without holding db.mu, so new snapshots can be taken meanwhile
+// and a goroutine holding a snapshot can still read, and tries again if
+// one was taken before the lock.
+func (db *DB) lockWithoutSnapshots() {
+	for {
+		db.waitSnapshots()
+		db.mu.Lock()
+		if db.oldestSnapshot() == math.MaxUint64 {
+			return
+		}
+		db.mu.Unlock()
+	}
+}
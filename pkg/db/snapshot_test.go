@@ -0,0 +1,209 @@
+package db
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// openSnapshotDB creates a database that reads every page from disk and
+// checkpoints often, so pages are reused quickly
+func openSnapshotDB(t *testing.T) *DB {
+	path := filepath.Join(t.TempDir(), "test.db")
+	database, err := Open(path, &Options{CreateIfMissing: true, CheckpointSize: 4096, CacheBytes: -1})
+	if err != nil {
+		t.Fatalf("Failed to create DB: %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+
+	for i := 0; i < 200; i++ {
+		if err := database.Put([]byte(fmt.Sprintf("key%03d", i)), []byte("old")); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	return database
+}
+
+// expectSnapshot checks that a snapshot sees exactly the 200 keys with the given value
+func expectSnapshot(t *testing.T, s *Snapshot, want string) {
+	t.Helper()
+	count := 0
+	err := s.Scan(nil, nil, func(key, value []byte) bool {
+		if string(value) != want {
+			t.Errorf("Expected %s for %s, got %s", want, key, value)
+			return false
+		}
+		count++
+		return true
+	})
+	if err != nil {
+		t.Fatalf("Failed to scan snapshot: %v", err)
+	}
+	if count != 200 {
+		t.Errorf("Expected 200 keys in the snapshot, got %d", count)
+	}
+}
+
+// TestSnapshotIsolation verifies that a snapshot
+//  1. Keeps seeing the state it was taken at while updates and checkpoints
+//     rewrite every page of the tree
+//  2. Can be read through Get, Scan, Range and a cursor
+//  3. Does not affect a snapshot taken later
+func TestSnapshotIsolation(t *testing.T) {
+	database := openSnapshotDB(t)
+
+	s := database.Snapshot()
+	defer s.Close()
+
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 200; i++ {
+			value := []byte(fmt.Sprintf("new%d", round))
+			if err := database.Put([]byte(fmt.Sprintf("key%03d", i)), value); err != nil {
+				t.Fatalf("Failed to put: %v", err)
+			}
+		}
+	}
+	if _, err := database.DeletePrefix([]byte("key1")); err != nil {
+		t.Fatalf("Failed to delete prefix: %v", err)
+	}
+
+	expectSnapshot(t, s, "old")
+	if value, found, err := s.Get([]byte("key150")); err != nil || !found || string(value) != "old" {
+		t.Errorf("Expected old for key150, got %q, found %v, err %v", value, found, err)
+	}
+	count := 0
+	for range s.Range([]byte("key100"), []byte("key200")).All() {
+		count++
+	}
+	if count != 100 {
+		t.Errorf("Expected 100 keys in the range, got %d", count)
+	}
+	c := s.NewCursor()
+	if !c.Last() || string(c.Key()) != "key199" {
+		t.Errorf("Expected key199 to be the last key, err %v", c.Err())
+	}
+	c.Close()
+
+	later := database.Snapshot()
+	defer later.Close()
+	if value, _, _ := later.Get([]byte("key050")); string(value) != "new4" {
+		t.Errorf("Expected new4 in the later snapshot, got %q", value)
+	}
+	if _, found, _ := later.Get([]byte("key150")); found {
+		t.Error("Expected key150 to be deleted in the later snapshot")
+	}
+}
+
+// TestSnapshotDefersPageReuse verifies that pages released while a snapshot
+// is open are held until it is closed, and reclaimed by the next commit
+func TestSnapshotDefersPageReuse(t *testing.T) {
+	database := openSnapshotDB(t)
+
+	s := database.Snapshot()
+	for i := 0; i < 200; i++ {
+		if err := database.Put([]byte(fmt.Sprintf("key%03d", i)), []byte("new")); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	held := len(database.free.held)
+	if held == 0 {
+		t.Fatal("Expected pages to be held for the snapshot")
+	}
+
+	s.Close()
+	s.Close()
+	if len(database.free.held) != held {
+		t.Error("Expected closing the snapshot to leave reclaiming to the next commit")
+	}
+	if err := database.Put([]byte("key000"), []byte("newer")); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if n := len(database.free.held); n != 0 {
+		t.Errorf("Expected no held pages after the next commit, got %d", n)
+	}
+
+	// The reclaimed pages are reused instead of growing the file
+	pageCount := database.pageCount
+	for i := 0; i < 200; i++ {
+		if err := database.Put([]byte(fmt.Sprintf("key%03d", i)), []byte("newest")); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	if database.pageCount > pageCount+uint64(held) {
+		t.Errorf("File grew from %d to %d pages", pageCount, database.pageCount)
+	}
+}
+
+// TestSnapshotDoesNotBlockWriters verifies that readers scan snapshots while
+// writers keep committing, and every snapshot stays consistent
+func TestSnapshotDoesNotBlockWriters(t *testing.T) {
+	database := openSnapshotDB(t)
+
+	// A snapshot taken at the start stays open during all updates
+	s := database.Snapshot()
+	defer s.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for round := 0; round < 10; round++ {
+			for i := 0; i < 200; i++ {
+				value := []byte(fmt.Sprintf("round%d", round))
+				if err := database.Put([]byte(fmt.Sprintf("key%03d", i)), value); err != nil {
+					t.Errorf("Failed to put: %v", err)
+					return
+				}
+			}
+		}
+	}()
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				expectSnapshot(t, s, "old")
+
+				// New snapshots are taken and read while the writer runs
+				fresh := database.Snapshot()
+				if err := fresh.Traverse(func(key, value []byte) {}); err != nil {
+					t.Errorf("Failed to traverse snapshot: %v", err)
+				}
+				fresh.Close()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// TestCloseWaitsForSnapshots verifies that Close does not unmap the file
+// while a snapshot is still open
+func TestCloseWaitsForSnapshots(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	database, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to create DB: %v", err)
+	}
+	if err := database.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+
+	s := database.Snapshot()
+	closed := make(chan error)
+	go func() { closed <- database.Close() }()
+
+	select {
+	case <-closed:
+		t.Fatal("Close returned while a snapshot was open")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if value, _, err := s.Get([]byte("key")); err != nil || string(value) != "value" {
+		t.Errorf("Expected value, got %q, err %v", value, err)
+	}
+	s.Close()
+	if err := <-closed; err != nil {
+		t.Fatalf("Failed to close DB: %v", err)
+	}
+}
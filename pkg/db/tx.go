@@ -0,0 +1,313 @@
+package db
+
+import (
+	"build-your-own-database/pkg/btree"
+	"build-your-own-database/pkg/wal"
+	"bytes"
+	"errors"
+	"slices"
+)
+
+// Errors returned by transactions
+var (
+	ErrTxDone     = errors.New("db: transaction has already been committed or rolled back")
+	ErrTxReadOnly = errors.New("db: transaction is read-only")
+)
+
+// Tx is a transaction on the database
+//
+// A read-only transaction reads from a snapshot, it sees the database as it
+// was when it began and writers are not blocked by it.
+//
+// A write transaction works on a private copy-on-write tree starting at the
+// current root. Its new pages are kept in memory and its mutations are only
+// logged on Commit, which writes the pages and publishes the new root in one
+// step. Until then other readers keep seeing the last committed state, and
+// Rollback simply drops the private tree. Only one write transaction runs at
+// a time, Begin waits for the previous one to finish.
+//
+// A transaction must be ended with Commit or Rollback and is not safe for
+// concurrent use.
+type Tx struct {
+	db       *DB
+	writable bool
+	done     bool
+	tree     *btree.BTree // The tree seen by the transaction, private for write transactions
+	snap     *Snapshot    // Snapshot of a read-only transaction
+
+	// Only used by write transactions
+	batch     Batch             // Mutations to log on commit
+	buffered  map[uint64][]byte // Pages allocated by the transaction, not written yet
+	pageCount uint64            // Page count when the transaction began, restored on rollback
+}
+
+// Begin starts a transaction
+// Parameters:
+//   - writable: Whether the transaction may modify the database
+//
+// Returns:
+//   - *Tx: The transaction, to be ended with Commit or Rollback
+//   - error: Any error that occurred while starting the transaction,
+//     ErrReadOnly for a write transaction on a read-only database, ErrClosed
+func (db *DB) Begin(writable bool) (*Tx, error) {
+	if !writable {
+		s := db.Snapshot()
+		if s.err != nil {
+			return nil, s.err
+		}
+		return &Tx{db: db, tree: s.tree, snap: s}, nil
+	}
+
+	if db.opts.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	db.writer.Lock()
+	if db.closed.Load() {
+		db.writer.Unlock()
+		return nil, ErrClosed
+	}
+	return db.newWriteTx(), nil
+}
+
+// newWriteTx creates a write transaction on top of the committed tree
+// Must be called with db.writer held, or while nothing else uses the database
+func (db *DB) newWriteTx() *Tx {
+	tx := &Tx{
+		db:        db,
+		writable:  true,
+		buffered:  make(map[uint64][]byte),
+		pageCount: db.pageCount,
+	}
+	db.free.begin()
+	tx.tree = btree.NewBTree(tx.pageGet, tx.pageNew, tx.pageDel)
+	tx.tree.Config = db.tree.Config
+	tx.tree.Root = db.tree.Root
+	return tx
+}
+
+// Get retrieves a value by its key, including changes made by the transaction
+// Returns:
+//   - []byte: The value associated with the key
+//   - bool: true if the key was found, false otherwise
+//   - error: ErrTxDone after the transaction ended, or any error reading
+func (tx *Tx) Get(key []byte) ([]byte, bool, error) {
+	if tx.done {
+		return nil, false, ErrTxDone
+	}
+	return tx.tree.Search(key)
+}
+
+// Put inserts or updates a key-value pair within the transaction
+// Returns:
+//   - error: ErrTxDone, ErrTxReadOnly, ErrEmptyKey, ErrKeyTooLarge,
+//     ErrValueTooLarge, or any error that occurred during the operation.
+//     A failed Put leaves the transaction as it was.
+func (tx *Tx) Put(key, value []byte) error {
+	if err := tx.checkWritable(); err != nil {
+		return err
+	}
+	if err := tx.tree.Config.Validate(key, value); err != nil {
+		return err
+	}
+
+	if err := tx.tree.Insert(key, value); err != nil {
+		return err
+	}
+	tx.batch.Put(key, value)
+	return nil
+}
+
+// Delete removes a key within the transaction
+// Returns:
+//   - error: ErrTxDone, ErrTxReadOnly, ErrEmptyKey, or any error that occurred
+//     during the operation. A failed Delete leaves the transaction as it was.
+func (tx *Tx) Delete(key []byte) error {
+	if err := tx.checkWritable(); err != nil {
+		return err
+	}
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+
+	found, err := tx.tree.Delete(key)
+	if err != nil {
+		return err
+	}
+	if found {
+		tx.batch.Delete(key)
+	}
+	return nil
+}
+
+// Scan calls visit for every key-value pair with start <= key < end in key order,
+// including changes made by the transaction
+// Parameters:
+//   - start: The first key to visit, nil or empty starts at the smallest key
+//   - end: The key to stop before, nil or empty runs to the largest key
+//   - visit: Called for each pair, returning false stops the scan
+//
+// Returns:
+//   - error: ErrTxDone, or any error that occurred while reading
+//
+// The slices passed to visit are only valid during the call and must not be
+// modified. visit must not modify the transaction.
+func (tx *Tx) Scan(start, end []byte, visit func(key, value []byte) bool) error {
+	if tx.done {
+		return ErrTxDone
+	}
+
+	c := tx.tree.NewCursor()
+	defer c.Close()
+	for ok := c.Seek(start); ok; ok = c.Next() {
+		if len(end) > 0 && bytes.Compare(c.Key(), end) >= 0 {
+			break
+		}
+		value := c.Value()
+		if c.Err() != nil || !visit(c.Key(), value) {
+			break
+		}
+	}
+	return c.Err()
+}
+
+// Commit ends the transaction, making its changes durable and visible
+// Returns:
+//   - error: ErrTxDone, or any error that occurred while committing, in
+//     which case none of the changes are applied
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	if !tx.writable {
+		tx.snap.Close()
+		return nil
+	}
+	defer tx.db.writer.Unlock()
+	return tx.commit()
+}
+
+// commit logs and publishes a write transaction
+// Must be called with db.writer held, which stays held
+func (tx *Tx) commit() error {
+	db := tx.db
+	if tx.batch.Len() == 0 {
+		tx.rollback()
+		return nil
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.logRecord(wal.Record{Type: wal.RecordBatch, Value: tx.batch.data}); err != nil {
+		tx.rollback()
+		return err
+	}
+	if err := tx.publish(); err != nil {
+		tx.rollback()
+		return db.abort(err)
+	}
+	return db.commit()
+}
+
+// Rollback ends the transaction, discarding its changes
+// Returns:
+//   - error: ErrTxDone if the transaction already ended
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	if !tx.writable {
+		tx.snap.Close()
+		return nil
+	}
+
+	tx.rollback()
+	tx.db.writer.Unlock()
+	return nil
+}
+
+// checkWritable returns the error for a mutation that is not allowed
+func (tx *Tx) checkWritable() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+	return nil
+}
+
+// publish writes the pages of a write transaction in file order and makes
+// its tree the committed one
+// Must be called with db.mu held for writing
+func (tx *Tx) publish() error {
+	db := tx.db
+	// Pages appended for nodes the transaction dropped again are never written,
+	// the ones at the end are given back so that the file holds every page
+	for db.pageCount > tx.pageCount {
+		last := db.pageCount - 1
+		if _, ok := tx.buffered[last]; ok {
+			break
+		}
+		db.free.forget(last)
+		db.pageCount--
+	}
+
+	ptrs := make([]uint64, 0, len(tx.buffered))
+	for ptr := range tx.buffered {
+		ptrs = append(ptrs, ptr)
+	}
+	slices.Sort(ptrs)
+	for _, ptr := range ptrs {
+		if err := db.pageWriteChecked(ptr, tx.buffered[ptr]); err != nil {
+			return err
+		}
+	}
+
+	db.tree.Root = tx.tree.Root
+	db.free.end()
+	tx.buffered = nil
+	return nil
+}
+
+// rollback hands the pages used by a write transaction back
+// The committed tree was never modified, only the free list and page count are restored
+func (tx *Tx) rollback() {
+	tx.db.free.rollback()
+	tx.db.pageCount = tx.pageCount
+	tx.buffered = nil
+}
+
+// pageGet reads a node, preferring the pages buffered by the transaction
+func (tx *Tx) pageGet(ptr uint64) ([]byte, error) {
+	if node, ok := tx.buffered[ptr]; ok {
+		return node, nil
+	}
+	return tx.db.pageGet(ptr)
+}
+
+// pageNew allocates a page for a node and buffers it until commit
+func (tx *Tx) pageNew(node []byte) (uint64, error) {
+	db := tx.db
+	ptr, reused := db.free.pop()
+	if !reused {
+		ptr = db.pageAppend()
+	}
+	tx.buffered[ptr] = node
+	db.free.allocate(ptr)
+	return ptr, nil
+}
+
+// pageDel releases a node that is no longer referenced by the private tree
+// Pages the transaction allocated itself were never written and are reused
+// right away, pages of the committed tree are released as usual.
+func (tx *Tx) pageDel(ptr uint64) error {
+	if _, ok := tx.buffered[ptr]; ok {
+		delete(tx.buffered, ptr)
+		tx.db.free.push(ptr)
+		return nil
+	}
+	return tx.db.pageDel(ptr)
+}
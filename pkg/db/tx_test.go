@@ -0,0 +1,235 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// TestWriteTx verifies that a write transaction
+// 1. Sees its own changes through Get and Scan
+// 2. Hides them from other readers until Commit
+// 3. Makes them visible and durable on Commit
+func TestWriteTx(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	database, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to create DB: %v", err)
+	}
+	if err := database.Put([]byte("existing"), []byte("old")); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+
+	tx, err := database.Begin(true)
+	if err != nil {
+		t.Fatalf("Failed to begin: %v", err)
+	}
+	for i := 0; i < 300; i++ {
+		if err := tx.Put([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatalf("Failed to put in transaction: %v", err)
+		}
+	}
+	if err := tx.Delete([]byte("existing")); err != nil {
+		t.Fatalf("Failed to delete in transaction: %v", err)
+	}
+
+	if value, found, err := tx.Get([]byte("key100")); err != nil || !found || string(value) != "value100" {
+		t.Errorf("Expected the transaction to see its put, got %q, found %v, err %v", value, found, err)
+	}
+	if _, found, _ := tx.Get([]byte("existing")); found {
+		t.Errorf("Expected the transaction to see its delete")
+	}
+	count := 0
+	if err := tx.Scan([]byte("key100"), []byte("key200"), func(key, value []byte) bool {
+		count++
+		return true
+	}); err != nil || count != 100 {
+		t.Errorf("Expected 100 keys in the transaction scan, got %d, err %v", count, err)
+	}
+
+	// Other readers are not blocked and still see the committed state
+	if _, found, err := database.Get([]byte("key100")); err != nil || found {
+		t.Errorf("Uncommitted put is visible: found %v, err %v", found, err)
+	}
+	if value, _, _ := database.Get([]byte("existing")); string(value) != "old" {
+		t.Errorf("Uncommitted delete is visible, got %q", value)
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	if err := tx.Commit(); !errors.Is(err, ErrTxDone) {
+		t.Errorf("Expected ErrTxDone for a second commit, got %v", err)
+	}
+	if value, found, _ := database.Get([]byte("key100")); !found || string(value) != "value100" {
+		t.Errorf("Committed put is missing")
+	}
+
+	crash(t, database)
+	database, err = NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer database.Close()
+	if value, found, _ := database.Get([]byte("key299")); !found || string(value) != "value299" {
+		t.Errorf("Committed put was lost in the crash")
+	}
+	if _, found, _ := database.Get([]byte("existing")); found {
+		t.Errorf("Committed delete was lost in the crash")
+	}
+}
+
+// TestRollback verifies that a rolled back transaction
+// 1. Leaves no trace in the tree, the free list, the file size or the log
+// 2. Releases the writer, so the next write goes through
+func TestRollback(t *testing.T) {
+	database := openScanDB(t)
+	if err := database.checkpoint(); err != nil {
+		t.Fatalf("Failed to checkpoint: %v", err)
+	}
+	root, pageCount, free := database.tree.Root, database.pageCount, len(database.free.free)
+
+	tx, err := database.Begin(true)
+	if err != nil {
+		t.Fatalf("Failed to begin: %v", err)
+	}
+	for i := 0; i < 1000; i++ {
+		if err := tx.Put([]byte(fmt.Sprintf("new%04d", i)), []byte("value")); err != nil {
+			t.Fatalf("Failed to put in transaction: %v", err)
+		}
+	}
+	if err := tx.Delete([]byte("key010")); err != nil {
+		t.Fatalf("Failed to delete in transaction: %v", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Failed to roll back: %v", err)
+	}
+	if err := tx.Put([]byte("late"), []byte("value")); !errors.Is(err, ErrTxDone) {
+		t.Errorf("Expected ErrTxDone after rollback, got %v", err)
+	}
+
+	if database.tree.Root != root || database.pageCount != pageCount || len(database.free.free) != free {
+		t.Errorf("Rollback left changes: root %d -> %d, pages %d -> %d, free %d -> %d",
+			root, database.tree.Root, pageCount, database.pageCount, free, len(database.free.free))
+	}
+	if database.wal.Size() != 0 {
+		t.Errorf("Expected nothing to be logged, the log holds %d bytes", database.wal.Size())
+	}
+	if _, found, _ := database.Get([]byte("key010")); !found {
+		t.Errorf("Rolled back delete is visible")
+	}
+
+	if err := database.Put([]byte("after"), []byte("value")); err != nil {
+		t.Fatalf("Failed to put after rollback: %v", err)
+	}
+}
+
+// TestReadTx verifies that a read-only transaction
+// 1. Reads and scans the committed state
+// 2. Rejects mutations with ErrTxReadOnly
+// 3. Rejects use after it ended with ErrTxDone
+func TestReadTx(t *testing.T) {
+	database := openScanDB(t)
+
+	tx, err := database.Begin(false)
+	if err != nil {
+		t.Fatalf("Failed to begin: %v", err)
+	}
+	if value, found, err := tx.Get([]byte("key042")); err != nil || !found || string(value) != "value042" {
+		t.Errorf("Expected value042, got %q, found %v, err %v", value, found, err)
+	}
+	count := 0
+	if err := tx.Scan(nil, nil, func(key, value []byte) bool {
+		count++
+		return count < 10
+	}); err != nil || count != 10 {
+		t.Errorf("Expected the scan to stop after 10 keys, got %d, err %v", count, err)
+	}
+	if err := tx.Put([]byte("key"), []byte("value")); !errors.Is(err, ErrTxReadOnly) {
+		t.Errorf("Expected ErrTxReadOnly from Put, got %v", err)
+	}
+	if err := tx.Delete([]byte("key001")); !errors.Is(err, ErrTxReadOnly) {
+		t.Errorf("Expected ErrTxReadOnly from Delete, got %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Failed to end read transaction: %v", err)
+	}
+	if _, _, err := tx.Get([]byte("key001")); !errors.Is(err, ErrTxDone) {
+		t.Errorf("Expected ErrTxDone, got %v", err)
+	}
+	if err := tx.Rollback(); !errors.Is(err, ErrTxDone) {
+		t.Errorf("Expected ErrTxDone, got %v", err)
+	}
+
+	// The snapshot was released
+	if err := database.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatalf("Failed to put after the read transaction: %v", err)
+	}
+}
+
+// TestConcurrentTransactions verifies that readers keep working on the
+// committed state while write transactions run and commit one at a time
+func TestConcurrentTransactions(t *testing.T) {
+	database := openScanDB(t)
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for round := 0; round < 10; round++ {
+				tx, err := database.Begin(true)
+				if err != nil {
+					t.Errorf("Failed to begin: %v", err)
+					return
+				}
+				// Every transaction rewrites the same keys, a reader must
+				// never see a mix of two transactions
+				for i := 0; i < 20; i++ {
+					value := []byte(fmt.Sprintf("w%d-r%d", w, round))
+					if err := tx.Put([]byte(fmt.Sprintf("shared%02d", i)), value); err != nil {
+						t.Errorf("Failed to put: %v", err)
+					}
+				}
+				if round%3 == 0 {
+					err = tx.Rollback()
+				} else {
+					err = tx.Commit()
+				}
+				if err != nil {
+					t.Errorf("Failed to end transaction: %v", err)
+				}
+			}
+		}(w)
+	}
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				tx, err := database.Begin(false)
+				if err != nil {
+					t.Errorf("Failed to begin: %v", err)
+					return
+				}
+				var first string
+				err = tx.Scan([]byte("shared"), []byte("sharee"), func(key, value []byte) bool {
+					if first == "" {
+						first = string(value)
+					} else if string(value) != first {
+						t.Errorf("Saw %s and %s in one snapshot", first, value)
+						return false
+					}
+					return true
+				})
+				if err != nil {
+					t.Errorf("Failed to scan: %v", err)
+				}
+				tx.Rollback()
+			}
+		}()
+	}
+	wg.Wait()
+}
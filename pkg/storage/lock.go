@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// lockRetryInterval is how often a held lock is tried again while waiting for it
+const lockRetryInterval = 10 * time.Millisecond
+
+// ErrLocked is returned by Open when another process holds a conflicting
+// lock on the file, usually because it has the same database open
+var ErrLocked = errors.New("storage: file is locked by another process")
+
+// errWouldBlock is returned by tryLock for a lock held by someone else
+var errWouldBlock = errors.New("storage: lock would block")
+
+// LockFile locks an open file against other processes
+// Parameters:
+//   - file: The file to lock, a lock it already holds is converted
+//   - exclusive: Whether to take an exclusive lock, otherwise a shared one
+//     that only conflicts with exclusive locks
+//   - timeout: How long to wait for a conflicting lock to be released
+//
+// The lock is advisory and tied to the open file, closing it releases the
+// lock. A conflicting lock fails with ErrLocked after the timeout. On
+// platforms without file locking nothing is locked.
+func LockFile(file *os.File, exclusive bool, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := tryLock(file, exclusive)
+		if !errors.Is(err, errWouldBlock) {
+			return err
+		}
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("%w: %s", ErrLocked, file.Name())
+		}
+		time.Sleep(min(lockRetryInterval, time.Until(deadline)))
+	}
+}
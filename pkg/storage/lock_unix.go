@@ -0,0 +1,32 @@
+//go:build unix
+
+package storage
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lockSupported reports whether files can be locked against other processes
+const lockSupported = true
+
+// tryLock takes an advisory lock on the whole file without waiting
+// Returns errWouldBlock if another open file description holds a conflicting lock
+func tryLock(file *os.File, exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	for {
+		err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+		switch {
+		case err == nil:
+			return nil
+		case errors.Is(err, syscall.EWOULDBLOCK):
+			return errWouldBlock
+		case !errors.Is(err, syscall.EINTR):
+			return err
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"os"
+	"sync"
+)
+
+// mapping serves reads from read-only memory mappings of the file
+//
+// The file is mapped in fixed-size chunks, created on first access. A chunk
+// may reach past the end of the file and covers data appended later, since
+// the mapping is shared with the page cache that WriteAt goes through. Chunks
+// are only unmapped on close, so slices handed out stay valid while the file grows.
+type mapping struct {
+	chunkSize int64        // Size of each chunk, a multiple of the OS page size
+	mu        sync.RWMutex // Protects chunks, reads only take it shared
+	chunks    [][]byte     // Chunk i maps the file range starting at i*chunkSize
+}
+
+// slice returns the mapped bytes for a range of the file
+// Returns nil without an error if the range crosses a chunk boundary
+func (m *mapping) slice(file *os.File, offset int64, size int) ([]byte, error) {
+	idx := int(offset / m.chunkSize)
+	start := offset % m.chunkSize
+	if start+int64(size) > m.chunkSize {
+		return nil, nil
+	}
+
+	m.mu.RLock()
+	var chunk []byte
+	if idx < len(m.chunks) {
+		chunk = m.chunks[idx]
+	}
+	m.mu.RUnlock()
+
+	if chunk == nil {
+		var err error
+		if chunk, err = m.mapChunk(file, idx); err != nil {
+			return nil, err
+		}
+	}
+	return chunk[start : start+int64(size) : start+int64(size)], nil
+}
+
+// mapChunk maps the chunk with the given index unless another read did already
+func (m *mapping) mapChunk(file *os.File, idx int) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for len(m.chunks) <= idx {
+		m.chunks = append(m.chunks, nil)
+	}
+	if m.chunks[idx] == nil {
+		chunk, err := mmap(file, int64(idx)*m.chunkSize, int(m.chunkSize))
+		if err != nil {
+			return nil, err
+		}
+		m.chunks[idx] = chunk
+	}
+	return m.chunks[idx], nil
+}
+
+// close unmaps all chunks
+func (m *mapping) close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var err error
+	for _, chunk := range m.chunks {
+		if chunk == nil {
+			continue
+		}
+		if uerr := munmap(chunk); err == nil {
+			err = uerr
+		}
+	}
+	m.chunks = nil
+	return err
+}
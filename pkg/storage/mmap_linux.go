@@ -0,0 +1,21 @@
+//go:build linux
+
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmapSupported reports whether reads can be served from a memory mapping
+const mmapSupported = true
+
+// mmap maps a range of the file read-only and shared with the page cache
+func mmap(file *os.File, offset int64, length int) ([]byte, error) {
+	return syscall.Mmap(int(file.Fd()), offset, length, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+// munmap releases a mapping created by mmap
+func munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
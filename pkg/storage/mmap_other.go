@@ -0,0 +1,22 @@
+//go:build !linux
+
+package storage
+
+import (
+	"errors"
+	"os"
+)
+
+// mmapSupported reports whether reads can be served from a memory mapping
+const mmapSupported = false
+
+// errMmapUnsupported is never returned, Open does not create mappings here
+var errMmapUnsupported = errors.New("storage: mmap is not supported on this platform")
+
+func mmap(file *os.File, offset int64, length int) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+func munmap(data []byte) error {
+	return errMmapUnsupported
+}
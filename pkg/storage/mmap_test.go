@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// openMmap opens a storage file with small mapped chunks, so tests cross chunk boundaries
+func openMmap(t *testing.T, path string) (*Storage, int64) {
+	t.Helper()
+	if !mmapSupported {
+		t.Skip("mmap is not supported on this platform")
+	}
+
+	chunkSize := int64(4 * os.Getpagesize())
+	storage, err := Open(path, &Options{Mmap: true, MmapChunkSize: chunkSize})
+	if err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+	return storage, chunkSize
+}
+
+// TestMmapReadWrite verifies reads through the memory mapping
+// It tests:
+// 1. Reading data written before and after the mapping was created
+// 2. Ranges inside a chunk and ranges crossing a chunk boundary
+// 3. Reads past the end of the file failing with io.EOF
+func TestMmapReadWrite(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := filepath.Join(tmpDir, "test.db")
+
+	storage, chunkSize := openMmap(t, path)
+	defer storage.Close()
+
+	first := bytes.Repeat([]byte("a"), int(chunkSize))
+	if err := storage.Write(0, first); err != nil {
+		t.Fatalf("Failed to write data: %v", err)
+	}
+	if data, err := storage.Read(0, 100); err != nil || !bytes.Equal(data, first[:100]) {
+		t.Fatalf("Failed to read mapped data: %v", err)
+	}
+
+	// Grow the file into the next chunks after the first one was mapped
+	second := bytes.Repeat([]byte("b"), int(2*chunkSize))
+	if err := storage.Write(chunkSize, second); err != nil {
+		t.Fatalf("Failed to write data: %v", err)
+	}
+	if data, err := storage.Read(2*chunkSize+10, 100); err != nil || !bytes.Equal(data, second[:100]) {
+		t.Errorf("Failed to read data appended later: %v", err)
+	}
+
+	// A range crossing a chunk boundary is still read correctly
+	data, err := storage.Read(chunkSize-50, 100)
+	if err != nil {
+		t.Fatalf("Failed to read across chunks: %v", err)
+	}
+	if !bytes.Equal(data, append(bytes.Repeat([]byte("a"), 50), bytes.Repeat([]byte("b"), 50)...)) {
+		t.Errorf("Wrong data across chunks: %s", data)
+	}
+
+	if _, err := storage.Read(3*chunkSize-50, 100); !errors.Is(err, io.EOF) {
+		t.Errorf("Expected io.EOF past the end of the file, got %v", err)
+	}
+}
+
+// TestMmapZeroCopy verifies that reads return slices of the mapping, which
+// reflect later writes to the same range without another read
+func TestMmapZeroCopy(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := filepath.Join(tmpDir, "test.db")
+
+	storage, _ := openMmap(t, path)
+	defer storage.Close()
+
+	if err := storage.Write(0, []byte("old data")); err != nil {
+		t.Fatalf("Failed to write data: %v", err)
+	}
+	data, err := storage.Read(0, 8)
+	if err != nil {
+		t.Fatalf("Failed to read data: %v", err)
+	}
+	if err := storage.Write(0, []byte("new data")); err != nil {
+		t.Fatalf("Failed to write data: %v", err)
+	}
+	if string(data) != "new data" {
+		t.Errorf("Expected the mapped slice to show the new data, got %s", data)
+	}
+}
+
+// TestMmapChunkSize verifies that a chunk size which is not a multiple
+// of the OS page size is rejected
+func TestMmapChunkSize(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := filepath.Join(tmpDir, "test.db")
+
+	if _, err := Open(path, &Options{Mmap: true, MmapChunkSize: 1000}); err == nil {
+		t.Error("Expected an error for an unaligned chunk size")
+	}
+}
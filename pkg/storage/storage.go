@@ -3,49 +3,140 @@
 package storage
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 )
 
+const (
+	// DefaultMmapChunkSize is the size by which the memory mapping grows by default
+	DefaultMmapChunkSize = 64 << 20
+
+	// DefaultPerm is the permission of a created file by default
+	DefaultPerm = os.FileMode(0644)
+)
+
+// Options configures how the storage file is accessed
+type Options struct {
+	Mmap          bool        // Serve reads from a read-only memory mapping (Linux only)
+	MmapChunkSize int64       // Size of each mapped chunk, a multiple of the OS page size
+	ReadOnly      bool        // Open the file for reading only, implies MustExist
+	MustExist     bool        // Fail with fs.ErrNotExist instead of creating a missing file
+	Exclusive     bool        // Fail with fs.ErrExist if the file already exists
+	Perm          os.FileMode // Permissions of a created file (default DefaultPerm)
+	SharedLock    bool        // Take a shared lock for read/write access too, see Open
+
+	// LockTimeout is how long Open waits for another process to release its
+	// lock on the file before failing with ErrLocked, 0 fails right away
+	LockTimeout time.Duration
+}
+
 // Storage represents a thread-safe file storage handler
 // It provides concurrent read/write operations to a single file
 type Storage struct {
 	File *os.File     // Underlying file descriptor for I/O operations
 	mu   sync.RWMutex // Read-Write mutex for thread-safe file access
+	size int64        // Size of the file, reads past it fail
+	mmap *mapping     // Memory mapping serving reads, nil if disabled
 }
 
-// NewStorage creates and initializes a new Storage instance
+// NewStorage creates and initializes a new Storage instance that reads
+// with ReadAt and holds an exclusive lock on the file
 // Parameters:
 //   - path: The file path where the storage will be created/opened
 //
 // Returns:
 //   - *Storage: Pointer to the new Storage instance
 //   - error: Any error that occurred during creation
+func NewStorage(path string) (*Storage, error) {
+	return Open(path, nil)
+}
+
+// Open creates or opens a storage file with the given options
+// Parameters:
+//   - path: The file path where the storage will be created/opened
+//   - opts: Options to open the file with, nil selects the defaults
+//
+// Returns:
+//   - *Storage: Pointer to the new Storage instance
+//   - error: Any error that occurred during creation
 //
 // The function will:
-//  1. Create all necessary directories in the path
-//  2. Create or open the file with read/write permissions
-//  3. Return a configured Storage instance
-func NewStorage(path string) (*Storage, error) {
+//  1. Create all necessary directories in the path, unless the file must exist
+//  2. Create or open the file with read/write or read-only access
+//  3. Lock the file, exclusively for read/write access and shared for
+//     read-only access, so two processes cannot write the file at once.
+//     With SharedLock read/write access takes a shared lock as well, the
+//     caller then keeps writers apart by other means.
+//  4. Set up the memory mapping if requested and supported
+//
+// A file locked by another process fails with ErrLocked. On platforms without
+// mmap support the Mmap option is ignored, on platforms without flock the
+// file is not locked.
+func Open(path string, opts *Options) (*Storage, error) {
+	var o Options
+	if opts != nil {
+		o = *opts
+	}
+	if o.MmapChunkSize <= 0 {
+		o.MmapChunkSize = DefaultMmapChunkSize
+	}
+	if o.MmapChunkSize%int64(os.Getpagesize()) != 0 {
+		return nil, fmt.Errorf("storage: mmap chunk size %d is not a multiple of the page size %d", o.MmapChunkSize, os.Getpagesize())
+	}
+	if o.Perm == 0 {
+		o.Perm = DefaultPerm
+	}
+
+	// O_RDWR: Open for reading and writing
+	// O_CREATE: Create file if it doesn't exist
+	// O_EXCL: Together with O_CREATE, fail if it does
+	flag := os.O_RDWR | os.O_CREATE
+	switch {
+	case o.ReadOnly:
+		flag = os.O_RDONLY
+	case o.MustExist:
+		flag = os.O_RDWR
+	}
+	if o.Exclusive {
+		flag |= os.O_CREATE | os.O_EXCL
+	}
+
 	// Create all directories in the path if they don't exist
 	// Uses 0755 permissions: rwx for owner, rx for group and others
-	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+	if flag&os.O_CREATE != 0 {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := os.OpenFile(path, flag, o.Perm)
+	if err != nil {
+		return nil, err
+	}
+	if err := LockFile(file, !o.ReadOnly && !o.SharedLock, o.LockTimeout); err != nil {
+		file.Close()
 		return nil, err
 	}
 
-	// Open or create the file with read-write permissions
-	// O_RDWR: Open for reading and writing
-	// O_CREATE: Create file if it doesn't exist
-	// 0644 permissions: rw for owner, r for group and others
-	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	stat, err := file.Stat()
 	if err != nil {
+		file.Close()
 		return nil, err
 	}
 
-	return &Storage{
+	s := &Storage{
 		File: file,
-	}, nil
+		size: stat.Size(),
+	}
+	if o.Mmap && mmapSupported {
+		s.mmap = &mapping{chunkSize: o.MmapChunkSize}
+	}
+	return s, nil
 }
 
 // Read performs a thread-safe read operation from the storage file
@@ -55,13 +146,27 @@ func NewStorage(path string) (*Storage, error) {
 //
 // Returns:
 //   - []byte: The read data
-//   - error: Any error that occurred during reading
+//   - error: Any error that occurred during reading, io.EOF past the end of the file
 //
-// This method is thread-safe and allows multiple concurrent reads
+// This method is thread-safe and allows multiple concurrent reads.
+// With a memory mapping the returned slice points into the mapping: it must
+// not be modified, and it reflects later writes to the same range.
 func (s *Storage) Read(offset int64, size int) ([]byte, error) {
 	s.mu.RLock()         // Acquire read lock - allows multiple concurrent reads
 	defer s.mu.RUnlock() // Ensure lock is released after function returns
 
+	if s.mmap != nil {
+		// Touching a mapped page past the end of the file would crash
+		if offset < 0 || offset+int64(size) > s.size {
+			return nil, io.EOF
+		}
+		data, err := s.mmap.slice(s.File, offset, size)
+		if data != nil || err != nil {
+			return data, err
+		}
+		// The range spans two chunks, fall back to a copy
+	}
+
 	data := make([]byte, size)
 	_, err := s.File.ReadAt(data, offset)
 	return data, err
@@ -73,14 +178,37 @@ func (s *Storage) Read(offset int64, size int) ([]byte, error) {
 //   - data: Bytes to write to the file
 //
 // Returns:
-//   - error: Any error that occurred during writing
+//   - error: Any error that occurred during writing, the file is not
+//     writable if it was opened read-only
 //
 // This method is thread-safe and ensures exclusive access during writing
 func (s *Storage) Write(offset int64, data []byte) error {
 	s.mu.Lock()         // Acquire exclusive lock - only one writer at a time
 	defer s.mu.Unlock() // Ensure lock is released after function returns
 
-	_, err := s.File.WriteAt(data, offset)
+	n, err := s.File.WriteAt(data, offset)
+	s.size = max(s.size, offset+int64(n))
+	return err
+}
+
+// Relock converts the lock on the file, see LockFile
+// Parameters:
+//   - exclusive: Whether to take an exclusive lock, otherwise a shared one
+//   - timeout: How long to wait for conflicting locks of other processes
+//
+// Returns:
+//   - error: ErrLocked if another process still holds a conflicting lock
+//
+// Converting a lock is not atomic, flock drops the shared lock before it
+// tries to take the exclusive one. If that fails, the shared lock is taken
+// again, so the file stays locked against writers.
+func (s *Storage) Relock(exclusive bool, timeout time.Duration) error {
+	err := LockFile(s.File, exclusive, timeout)
+	if err != nil && exclusive {
+		if serr := LockFile(s.File, false, timeout); serr != nil {
+			return errors.Join(err, serr)
+		}
+	}
 	return err
 }
 
@@ -91,10 +219,31 @@ func (s *Storage) Write(offset int64, data []byte) error {
 //   - error: Any error that occurred during closing
 //
 // This method should be called when the storage is no longer needed
-// to free up system resources
+// to free up system resources and release the lock on the file. Slices
+// returned by Read are invalid afterwards.
 func (s *Storage) Close() error {
 	s.mu.Lock()         // Acquire exclusive lock before closing
 	defer s.mu.Unlock() // Ensure lock is released after function returns
 
-	return s.File.Close()
+	var err error
+	if s.mmap != nil {
+		err = s.mmap.close()
+	}
+	if cerr := s.File.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Sync commits the current contents of the file to stable storage
+// Returns:
+//   - error: Any error that occurred during syncing
+//
+// Writes that completed before Sync is called are durable once it returns.
+// Sync does not change the file, so concurrent reads are allowed meanwhile.
+func (s *Storage) Sync() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.File.Sync()
 }
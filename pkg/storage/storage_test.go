@@ -4,11 +4,14 @@ package storage
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"sync"
 	"testing"
+	"time"
 )
 
 // TestNewStorage verifies the creation and initialization of a new Storage instance
@@ -161,6 +164,142 @@ func TestClose(t *testing.T) {
 	}
 }
 
+// TestOpenModes verifies the options controlling how the file is opened
+// It checks:
+// 1. MustExist and ReadOnly do not create a missing file
+// 2. Exclusive only creates a new file, with the requested permissions
+// 3. A read-only file can be read but not written
+func TestOpenModes(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := filepath.Join(tmpDir, "test.db")
+
+	for _, opts := range []*Options{{MustExist: true}, {ReadOnly: true}} {
+		if _, err := Open(path, opts); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Expected fs.ErrNotExist for %+v, got %v", *opts, err)
+		}
+	}
+
+	storage, err := Open(path, &Options{Exclusive: true, Perm: 0600})
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	if err := storage.Write(0, []byte("test data")); err != nil {
+		t.Fatalf("Failed to write data: %v", err)
+	}
+	storage.Close()
+
+	if stat, err := os.Stat(path); err != nil || stat.Mode().Perm() != 0600 {
+		t.Errorf("Expected permissions 0600, got %v, err %v", stat.Mode().Perm(), err)
+	}
+	if _, err := Open(path, &Options{Exclusive: true}); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("Expected fs.ErrExist, got %v", err)
+	}
+
+	storage, err = Open(path, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Failed to open storage read-only: %v", err)
+	}
+	defer storage.Close()
+	if data, err := storage.Read(0, 9); err != nil || string(data) != "test data" {
+		t.Errorf("Expected test data, got %q, err %v", data, err)
+	}
+	if err := storage.Write(0, []byte("x")); err == nil {
+		t.Error("Expected writing a read-only file to fail")
+	}
+}
+
+// TestLock verifies that the file is locked against other opens
+// It checks:
+// 1. A second open fails with ErrLocked while a writer holds the file
+// 2. Read-only opens share the file, but keep writers out
+// 3. With a timeout, an open waits until the lock is released
+func TestLock(t *testing.T) {
+	if !lockSupported {
+		t.Skip("file locking is not supported on this platform")
+	}
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	writer, err := NewStorage(path)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	for _, opts := range []*Options{nil, {ReadOnly: true}, {LockTimeout: 20 * time.Millisecond}} {
+		if _, err := Open(path, opts); !errors.Is(err, ErrLocked) {
+			t.Errorf("Expected ErrLocked for %+v, got %v", opts, err)
+		}
+	}
+	writer.Close()
+
+	var readers []*Storage
+	for i := 0; i < 2; i++ {
+		reader, err := Open(path, &Options{ReadOnly: true})
+		if err != nil {
+			t.Fatalf("Failed to open storage read-only: %v", err)
+		}
+		readers = append(readers, reader)
+	}
+	if _, err := NewStorage(path); !errors.Is(err, ErrLocked) {
+		t.Errorf("Expected ErrLocked while readers hold the file, got %v", err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		for _, reader := range readers {
+			reader.Close()
+		}
+	}()
+	writer, err = Open(path, &Options{LockTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("Failed to wait for the lock: %v", err)
+	}
+	writer.Close()
+}
+
+// TestRelock verifies that
+// 1. A shared lock for read/write access lets read-only opens share the file
+// 2. Relock to exclusive fails while they do, and keeps the shared lock
+// 3. Relock to exclusive succeeds once they are closed
+// 4. Relock back to shared lets read-only opens in again
+func TestRelock(t *testing.T) {
+	if !lockSupported {
+		t.Skip("file locking is not supported on this platform")
+	}
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	writer, err := Open(path, &Options{SharedLock: true})
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	defer writer.Close()
+
+	reader, err := Open(path, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Failed to open storage read-only next to a shared writer: %v", err)
+	}
+	if err := writer.Relock(true, 0); !errors.Is(err, ErrLocked) {
+		t.Errorf("Expected ErrLocked while a reader holds the file, got %v", err)
+	}
+	reader.Close()
+	if _, err := NewStorage(path); !errors.Is(err, ErrLocked) {
+		t.Errorf("Expected ErrLocked after a failed relock, got %v", err)
+	}
+
+	if err := writer.Relock(true, 0); err != nil {
+		t.Fatalf("Failed to relock exclusively: %v", err)
+	}
+	if _, err := Open(path, &Options{ReadOnly: true}); !errors.Is(err, ErrLocked) {
+		t.Errorf("Expected ErrLocked while the file is locked exclusively, got %v", err)
+	}
+	if err := writer.Relock(false, 0); err != nil {
+		t.Fatalf("Failed to relock shared: %v", err)
+	}
+	reader, err = Open(path, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Failed to open storage read-only after relocking: %v", err)
+	}
+	reader.Close()
+}
+
 // TestLargeData verifies handling of large data blocks
 // It tests:
 // 1. Writing large data blocks (1MB)
@@ -197,3 +336,36 @@ func TestLargeData(t *testing.T) {
 		t.Error("Large data mismatch")
 	}
 }
+
+// TestSync verifies that syncing the storage file
+// 1. Succeeds after writes
+// 2. Keeps the written data readable
+func TestSync(t *testing.T) {
+	// Set up test environment
+	tmpDir := t.TempDir()
+	path := filepath.Join(tmpDir, "test.db")
+
+	storage, err := NewStorage(path)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	defer storage.Close()
+
+	data := []byte("test data")
+	if err := storage.Write(0, data); err != nil {
+		t.Fatalf("Failed to write data: %v", err)
+	}
+
+	// Test sync operation
+	if err := storage.Sync(); err != nil {
+		t.Fatalf("Failed to sync storage: %v", err)
+	}
+
+	readData, err := storage.Read(0, len(data))
+	if err != nil {
+		t.Fatalf("Failed to read data: %v", err)
+	}
+	if !bytes.Equal(readData, data) {
+		t.Errorf("Expected data %s, got %s", data, readData)
+	}
+}
@@ -2,12 +2,14 @@ package testutil
 
 import (
 	"build-your-own-database/pkg/btree"
+	"fmt"
 	"sync"
 )
 
 // MockStorage provides an in-memory storage implementation for testing
 type MockStorage struct {
 	pages map[uint64][]byte
+	next  uint64
 	mu    sync.RWMutex
 }
 
@@ -17,25 +19,31 @@ func NewMockStorage() *MockStorage {
 	}
 }
 
-func (m *MockStorage) Get(ptr uint64) []byte {
+func (m *MockStorage) Get(ptr uint64) ([]byte, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-	return m.pages[ptr]
+	page, ok := m.pages[ptr]
+	if !ok {
+		return nil, fmt.Errorf("page %d not found", ptr)
+	}
+	return page, nil
 }
 
-func (m *MockStorage) New(node []byte) uint64 {
+func (m *MockStorage) New(node []byte) (uint64, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	ptr := uint64(len(m.pages) + 1)
+	m.next++
+	ptr := m.next
 	m.pages[ptr] = make([]byte, len(node))
 	copy(m.pages[ptr], node)
-	return ptr
+	return ptr, nil
 }
 
-func (m *MockStorage) Del(ptr uint64) {
+func (m *MockStorage) Del(ptr uint64) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	delete(m.pages, ptr)
+	return nil
 }
 
 // NewTestTree creates a new BTree instance with mock storage
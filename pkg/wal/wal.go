@@ -0,0 +1,333 @@
+// Package wal implements a write-ahead log of logical database mutations
+// Every record is framed with a CRC32-C checksum and carries a log sequence
+// number (LSN), so a torn write at the end of the log is detected and dropped
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+/*
+Record Layout:
+
++----------------+----------------+----------------+----------------+----------------+-----------+-------------+
+| Checksum (4B)  | Length (4B)    | LSN (8B)       | Type (1B)      | Key Len (4B)   | Key bytes | Value bytes |
++----------------+----------------+----------------+----------------+----------------+-----------+-------------+
+
+  - Checksum: CRC32-C of everything after the checksum field
+  - Length: number of bytes after the length field
+  - LSN: log sequence number, strictly increasing within the log
+  - Type: RecordPut, RecordDelete, RecordDeleteRange or RecordBatch
+  - Key Len: length of the key, the value takes the rest of the record
+
+Records are only ever appended. After a checkpoint the log is truncated and
+numbering continues with the next LSN, so replay can skip records that are
+already reflected in the checkpointed data.
+*/
+
+const (
+	frameHeaderSize = 8         // Checksum + length
+	recordFixedSize = 13        // LSN + type + key length
+	maxRecordSize   = 1<<31 - 1 // Upper bound for the length field
+	fileMode        = os.FileMode(0644)
+)
+
+// RecordType identifies the mutation stored in a record
+type RecordType uint8
+
+const (
+	RecordPut         RecordType = 1 // Insert or update of a key
+	RecordDelete      RecordType = 2 // Removal of a key
+	RecordDeleteRange RecordType = 3 // Removal of the keys from Key up to, not including, Value
+	RecordBatch       RecordType = 4 // Several mutations applied atomically, encoded in Value
+)
+
+// ErrInvalidRecord is returned when appending a record that cannot be encoded
+var ErrInvalidRecord = errors.New("wal: invalid record")
+
+// castagnoli is the CRC32-C table used for record checksums
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Record is a single logged mutation
+type Record struct {
+	LSN   uint64     // Assigned by Append
+	Type  RecordType // Kind of mutation
+	Key   []byte     // Key the mutation applies to
+	Value []byte     // New value, empty for deletes, end of the range for range deletes
+}
+
+// Log is an append-only write-ahead log stored in a single file
+type Log struct {
+	file     *os.File   // Underlying log file
+	mu       sync.Mutex // Serializes appends, syncs and resets
+	size     int64      // Size of the valid part of the file
+	nextLSN  uint64     // LSN assigned to the next appended record
+	lastSize int64      // Size of the file before the last append
+	lastLSN  uint64     // LSN of the last append, 0 if it cannot be undone
+}
+
+// Open opens or creates the log file at path
+// Parameters:
+//   - path: The file path of the log
+//
+// Returns:
+//   - *Log: The opened log, positioned after its last valid record
+//   - error: Any error that occurred while opening
+//
+// A torn or corrupted tail left behind by a crash is cut off.
+func Open(path string) (*Log, error) {
+	return OpenFile(path, fileMode)
+}
+
+// OpenFile opens or creates the log file at path, see Open
+// Parameters:
+//   - path: The file path of the log
+//   - perm: Permissions of the file if it is created
+func OpenFile(path string, perm os.FileMode) (*Log, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Log{file: file, nextLSN: 1}
+
+	// Find the end of the valid records
+	err = l.scan(func(rec Record) error {
+		l.nextLSN = rec.LSN + 1
+		return nil
+	})
+	if err == nil {
+		err = file.Truncate(l.size)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// scan decodes records from the beginning of the file until the first
+// invalid one and records where the valid part ends
+func (l *Log) scan(fn func(Record) error) error {
+	stat, err := l.file.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := l.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(l.file)
+	var offset int64
+	var lastLSN uint64
+
+	for {
+		rec, n, err := readRecord(r, stat.Size()-offset)
+		if err != nil || rec.LSN <= lastLSN {
+			// A short, corrupted or out-of-order record marks the end of the log
+			l.size = offset
+			return nil
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+		offset += n
+		lastLSN = rec.LSN
+	}
+}
+
+// readRecord decodes one framed record
+// Parameters:
+//   - r: Reader positioned at the start of the record
+//   - remaining: Number of bytes left in the file, bounds the record length
+//
+// Returns the record and the number of bytes it occupied
+func readRecord(r io.Reader, remaining int64) (Record, int64, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return Record{}, 0, err
+	}
+
+	length := binary.LittleEndian.Uint32(header[4:8])
+	if length < recordFixedSize || int64(length) > remaining-frameHeaderSize {
+		return Record{}, 0, fmt.Errorf("%w: bad length %d", ErrInvalidRecord, length)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return Record{}, 0, err
+	}
+
+	crc := crc32.Update(crc32.Checksum(header[4:8], castagnoli), castagnoli, body)
+	if crc != binary.LittleEndian.Uint32(header[0:4]) {
+		return Record{}, 0, fmt.Errorf("%w: checksum mismatch", ErrInvalidRecord)
+	}
+
+	klen := binary.LittleEndian.Uint32(body[9:13])
+	if klen > length-recordFixedSize {
+		return Record{}, 0, fmt.Errorf("%w: bad key length %d", ErrInvalidRecord, klen)
+	}
+
+	rec := Record{
+		LSN:   binary.LittleEndian.Uint64(body[0:8]),
+		Type:  RecordType(body[8]),
+		Key:   body[recordFixedSize : recordFixedSize+klen],
+		Value: body[recordFixedSize+klen:],
+	}
+	return rec, int64(frameHeaderSize + length), nil
+}
+
+// encodeRecord frames a record for appending
+func encodeRecord(rec Record) ([]byte, error) {
+	length := recordFixedSize + len(rec.Key) + len(rec.Value)
+	if length > maxRecordSize {
+		return nil, fmt.Errorf("%w: record of %d bytes is too large", ErrInvalidRecord, length)
+	}
+
+	buf := make([]byte, frameHeaderSize+length)
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(length))
+	binary.LittleEndian.PutUint64(buf[8:16], rec.LSN)
+	buf[16] = byte(rec.Type)
+	binary.LittleEndian.PutUint32(buf[17:21], uint32(len(rec.Key)))
+	copy(buf[21:], rec.Key)
+	copy(buf[21+len(rec.Key):], rec.Value)
+	binary.LittleEndian.PutUint32(buf[0:4], crc32.Checksum(buf[4:], castagnoli))
+	return buf, nil
+}
+
+// Append writes a record to the end of the log
+// Parameters:
+//   - rec: The record to append, its LSN field is ignored
+//
+// Returns:
+//   - uint64: The LSN assigned to the record
+//   - error: Any error that occurred while writing
+//
+// The record is not durable until Sync is called.
+func (l *Log) Append(rec Record) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rec.LSN = l.nextLSN
+	buf, err := encodeRecord(rec)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := l.file.WriteAt(buf, l.size); err != nil {
+		return 0, err
+	}
+
+	l.lastSize, l.lastLSN = l.size, rec.LSN
+	l.size += int64(len(buf))
+	l.nextLSN++
+	return rec.LSN, nil
+}
+
+// Undo removes the last appended record again, when the update it describes
+// could not be applied
+// Parameters:
+//   - lsn: LSN of the record to remove, must be the last one appended
+//
+// The removal is synced, so the record is not replayed after a crash.
+func (l *Log) Undo(lsn uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if lsn == 0 || lsn != l.lastLSN {
+		return fmt.Errorf("wal: record %d is not the last one appended", lsn)
+	}
+
+	if err := l.file.Truncate(l.lastSize); err != nil {
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+
+	l.size = l.lastSize
+	l.nextLSN = lsn
+	l.lastLSN = 0
+	return nil
+}
+
+// Sync commits all appended records to stable storage
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.file.Sync()
+}
+
+// Replay calls fn for every record with an LSN greater than after, in order
+// Parameters:
+//   - after: LSN of the last record that is already applied
+//   - fn: Called for each record, an error stops the replay and is returned
+func (l *Log) Replay(after uint64, fn func(Record) error) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.scan(func(rec Record) error {
+		if rec.LSN <= after {
+			return nil
+		}
+		return fn(rec)
+	})
+}
+
+// Reset discards all records, typically after a checkpoint
+// Parameters:
+//   - nextLSN: LSN for the next appended record, must be greater than
+//     the LSN of every record already checkpointed
+//   - sync: whether to fsync the truncation, without it the records may
+//     come back after a crash
+func (l *Log) Reset(nextLSN uint64, sync bool) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.file.Truncate(0); err != nil {
+		return err
+	}
+	if sync {
+		if err := l.file.Sync(); err != nil {
+			return err
+		}
+	}
+
+	l.size = 0
+	l.nextLSN = nextLSN
+	l.lastLSN = 0
+	return nil
+}
+
+// NextLSN returns the LSN that the next appended record will get
+func (l *Log) NextLSN() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.nextLSN
+}
+
+// Size returns the number of bytes occupied by the records in the log
+func (l *Log) Size() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.size
+}
+
+// Close closes the log file
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.file.Close()
+}
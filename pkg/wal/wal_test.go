@@ -0,0 +1,266 @@
+package wal
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// collect replays the log and returns all records after the given LSN
+func collect(t *testing.T, l *Log, after uint64) []Record {
+	t.Helper()
+	var records []Record
+	err := l.Replay(after, func(rec Record) error {
+		records = append(records, rec)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to replay log: %v", err)
+	}
+	return records
+}
+
+// TestAppendAndReplay verifies that appended records
+// 1. Get consecutive LSNs starting at 1
+// 2. Are replayed in order with their contents intact
+// 3. Survive reopening the log
+func TestAppendAndReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.wal")
+
+	l, err := Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open log: %v", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		rec := Record{
+			Type:  RecordPut,
+			Key:   []byte(fmt.Sprintf("key%d", i)),
+			Value: []byte(fmt.Sprintf("value%d", i)),
+		}
+		if i%3 == 0 {
+			rec = Record{Type: RecordDelete, Key: rec.Key}
+		}
+		lsn, err := l.Append(rec)
+		if err != nil {
+			t.Fatalf("Failed to append record: %v", err)
+		}
+		if lsn != uint64(i+1) {
+			t.Errorf("Expected LSN %d, got %d", i+1, lsn)
+		}
+	}
+	if err := l.Sync(); err != nil {
+		t.Fatalf("Failed to sync log: %v", err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("Failed to close log: %v", err)
+	}
+
+	l, err = Open(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen log: %v", err)
+	}
+	defer l.Close()
+
+	if l.NextLSN() != 11 {
+		t.Errorf("Expected next LSN 11 after reopen, got %d", l.NextLSN())
+	}
+
+	records := collect(t, l, 0)
+	if len(records) != 10 {
+		t.Fatalf("Expected 10 records, got %d", len(records))
+	}
+	for i, rec := range records {
+		key := []byte(fmt.Sprintf("key%d", i))
+		if rec.LSN != uint64(i+1) || !bytes.Equal(rec.Key, key) {
+			t.Errorf("Record %d: expected LSN %d key %s, got LSN %d key %s", i, i+1, key, rec.LSN, rec.Key)
+		}
+		if i%3 == 0 {
+			if rec.Type != RecordDelete || len(rec.Value) != 0 {
+				t.Errorf("Record %d: expected an empty delete, got type %d value %s", i, rec.Type, rec.Value)
+			}
+		} else if value := []byte(fmt.Sprintf("value%d", i)); rec.Type != RecordPut || !bytes.Equal(rec.Value, value) {
+			t.Errorf("Record %d: expected put of %s, got type %d value %s", i, value, rec.Type, rec.Value)
+		}
+	}
+
+	// Only records after the given LSN are replayed
+	if records := collect(t, l, 7); len(records) != 3 || records[0].LSN != 8 {
+		t.Errorf("Expected records 8-10, got %d records", len(records))
+	}
+}
+
+// TestTornTail verifies that a partially written last record
+// 1. Is dropped when the log is opened
+// 2. Gets overwritten by the next append
+func TestTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.wal")
+
+	l, err := Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open log: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := l.Append(Record{Type: RecordPut, Key: []byte("key"), Value: []byte("value")}); err != nil {
+			t.Fatalf("Failed to append record: %v", err)
+		}
+	}
+	size := l.Size()
+	l.Close()
+
+	// Cut the last record in half
+	if err := os.Truncate(path, size-5); err != nil {
+		t.Fatalf("Failed to truncate log: %v", err)
+	}
+
+	l, err = Open(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen log: %v", err)
+	}
+	defer l.Close()
+
+	if records := collect(t, l, 0); len(records) != 2 {
+		t.Errorf("Expected 2 intact records, got %d", len(records))
+	}
+
+	lsn, err := l.Append(Record{Type: RecordPut, Key: []byte("new"), Value: []byte("value")})
+	if err != nil {
+		t.Fatalf("Failed to append record: %v", err)
+	}
+	if lsn != 3 {
+		t.Errorf("Expected the torn record's LSN 3 to be reused, got %d", lsn)
+	}
+	if records := collect(t, l, 0); len(records) != 3 || string(records[2].Key) != "new" {
+		t.Errorf("Expected the new record to follow the intact ones, got %d records", len(records))
+	}
+}
+
+// TestCorruptRecord verifies that a record with a bad checksum ends the log
+func TestCorruptRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.wal")
+
+	l, err := Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open log: %v", err)
+	}
+	var offsets []int64
+	for i := 0; i < 3; i++ {
+		offsets = append(offsets, l.Size())
+		if _, err := l.Append(Record{Type: RecordPut, Key: []byte("key"), Value: []byte("value")}); err != nil {
+			t.Fatalf("Failed to append record: %v", err)
+		}
+	}
+	l.Close()
+
+	// Flip a byte inside the value of the second record
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read log: %v", err)
+	}
+	data[offsets[2]-1] ^= 0xFF
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Failed to write log: %v", err)
+	}
+
+	l, err = Open(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen log: %v", err)
+	}
+	defer l.Close()
+
+	if records := collect(t, l, 0); len(records) != 1 {
+		t.Errorf("Expected only the record before the corruption, got %d", len(records))
+	}
+	if l.Size() != offsets[1] {
+		t.Errorf("Expected log to be cut at %d, got %d", offsets[1], l.Size())
+	}
+}
+
+// TestReset verifies that resetting the log, with or without syncing
+// 1. Discards all records
+// 2. Continues numbering from the given LSN
+func TestReset(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.wal")
+
+	l, err := Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open log: %v", err)
+	}
+	defer l.Close()
+
+	for i := 0; i < 5; i++ {
+		if _, err := l.Append(Record{Type: RecordPut, Key: []byte("key")}); err != nil {
+			t.Fatalf("Failed to append record: %v", err)
+		}
+	}
+
+	if err := l.Reset(6, true); err != nil {
+		t.Fatalf("Failed to reset log: %v", err)
+	}
+	if l.Size() != 0 {
+		t.Errorf("Expected empty log after reset, got %d bytes", l.Size())
+	}
+	if records := collect(t, l, 0); len(records) != 0 {
+		t.Errorf("Expected no records after reset, got %d", len(records))
+	}
+
+	lsn, err := l.Append(Record{Type: RecordPut, Key: []byte("key")})
+	if err != nil {
+		t.Fatalf("Failed to append record: %v", err)
+	}
+	if lsn != 6 {
+		t.Errorf("Expected LSN 6 after reset, got %d", lsn)
+	}
+
+	if err := l.Reset(7, false); err != nil {
+		t.Fatalf("Failed to reset log without syncing: %v", err)
+	}
+	if records := collect(t, l, 0); l.Size() != 0 || len(records) != 0 {
+		t.Errorf("Expected an empty log after reset, got %d bytes, %d records", l.Size(), len(records))
+	}
+	if lsn, err := l.Append(Record{Type: RecordPut, Key: []byte("key")}); err != nil || lsn != 7 {
+		t.Errorf("Expected LSN 7 after reset, got %d, err %v", lsn, err)
+	}
+}
+
+// TestUndo verifies that undoing the last record
+// 1. Removes it from the log and reuses its LSN
+// 2. Is refused for any record but the last one appended
+func TestUndo(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.wal")
+
+	l, err := Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open log: %v", err)
+	}
+	defer l.Close()
+
+	if _, err := l.Append(Record{Type: RecordPut, Key: []byte("kept")}); err != nil {
+		t.Fatalf("Failed to append record: %v", err)
+	}
+	size := l.Size()
+	lsn, err := l.Append(Record{Type: RecordPut, Key: []byte("undone")})
+	if err != nil {
+		t.Fatalf("Failed to append record: %v", err)
+	}
+
+	if err := l.Undo(lsn - 1); err == nil {
+		t.Error("Expected undo of an earlier record to fail")
+	}
+	if err := l.Undo(lsn); err != nil {
+		t.Fatalf("Failed to undo record: %v", err)
+	}
+	if l.Size() != size || l.NextLSN() != lsn {
+		t.Errorf("Expected size %d and next LSN %d, got %d and %d", size, lsn, l.Size(), l.NextLSN())
+	}
+	if records := collect(t, l, 0); len(records) != 1 || string(records[0].Key) != "kept" {
+		t.Errorf("Expected only the first record, got %d records", len(records))
+	}
+
+	// A record can only be undone once
+	if err := l.Undo(lsn); err == nil {
+		t.Error("Expected a second undo to fail")
+	}
+}